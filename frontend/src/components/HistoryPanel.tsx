@@ -57,7 +57,8 @@ export const HistoryPanel: React.FC = () => {
     // 通过 currentImage 的路径推断文件夹，然后收集该文件夹的所有图片
     if (currentImage) {
       // 从 currentImage 中提取文件夹路径
-      const urlMatch = currentImage.match(/\/tmp\/([^\/]+)\//);
+      // 开启日期分区时批次位于 /tmp/2024-06-01/<批次>/ 下
+      const urlMatch = currentImage.match(/\/tmp\/((?:\d{4}-\d{2}-\d{2}\/)?[^\/]+)\//);
       if (urlMatch) {
         const folderPath = urlMatch[0]; // 例如: /tmp/text-only-1764760975/
 
@@ -98,7 +99,7 @@ export const HistoryPanel: React.FC = () => {
     try {
       const response = await fetch('http://localhost:8080/gallery');
       const data = await response.json();
-      setGalleryFolders(data.folders || []);
+      setGalleryFolders(data.data?.folders || []);
     } catch (error) {
       console.error('获取历史库失败:', error);
     } finally {
@@ -121,7 +122,7 @@ export const HistoryPanel: React.FC = () => {
     try {
       const response = await fetch(`http://localhost:8080/gallery/files?folder=${encodeURIComponent(folderName)}`);
       const data = await response.json();
-      setGalleryFiles(data.files || []);
+      setGalleryFiles(data.data?.files || []);
     } catch (error) {
       console.error('获取文件列表失败:', error);
       setGalleryFiles([]);
@@ -19,10 +19,12 @@ export interface BackendRunResponse {
 
 export interface ScenarioResult {
   id: number;
-  outcome: 'downloaded' | 'exhausted' | 'none';
+  outcome: 'downloaded' | 'exhausted' | 'suspicious' | 'blocked' | 'none';
   path: string;
   url: string;
   proxyTag?: string;
+  proxied?: boolean;
+  appliedSettings?: string[];
   outputRes?: string;
   error?: string;
 }
@@ -74,22 +76,24 @@ class BackendService {
       throw new Error(`Generation failed: cannot parse response ${response.status} ${response.statusText} - ${raw}`);
     }
 
-    const results = Array.isArray(data.results)
-      ? (data.results as ScenarioResult[]).filter(r => r.outcome === 'downloaded')
+    // 统一响应结构：{ ok, data, error: { code, message } }
+    const body = data.data || {};
+    const results = Array.isArray(body.results)
+      ? (body.results as ScenarioResult[]).filter(r => r.outcome === 'downloaded')
       : [];
 
     if (results.length > 0) {
       return {
-        status: data.status || 'ok',
-        imagePathUsed: data.imageUsed,
-        imagePathOrig: data.imageOrig,
-        scenarioCount: data.scenarioCount ?? results.length,
+        status: data.ok ? 'ok' : 'error',
+        imagePathUsed: body.imageUsed,
+        imagePathOrig: body.imageOrig,
+        scenarioCount: body.scenarioCount ?? results.length,
         results,
-        error: data.error,
+        error: data.error?.message,
       };
     }
 
-    const msg = data.error || raw || `HTTP ${response.status} ${response.statusText}`;
+    const msg = data.error?.message || raw || `HTTP ${response.status} ${response.statusText}`;
     throw new Error(`Generation failed: ${msg}`);
   }
 
@@ -99,7 +103,7 @@ class BackendService {
     if (!response.ok) {
       throw new Error(`Health check failed: ${response.status}`);
     }
-    return response.json();
+    return (await response.json()).data;
   }
 
   // 取消当前运行
@@ -113,7 +117,7 @@ class BackendService {
     if (!response.ok) {
       throw new Error(`Cancel failed: ${response.status}`);
     }
-    return response.json();
+    return (await response.json()).data;
   }
 
   // 生成图片（multipart方式）
@@ -173,7 +177,7 @@ class BackendService {
     if (!response.ok) {
       throw new Error(`Gallery request failed: ${response.status}`);
     }
-    return response.json();
+    return (await response.json()).data;
   }
 
   // 获取特定文件夹的文件列表
@@ -185,7 +189,7 @@ class BackendService {
     if (!response.ok) {
       throw new Error(`Gallery files request failed: ${response.status}`);
     }
-    return response.json();
+    return (await response.json()).data;
   }
 
   // 获取图片文件的完整URL
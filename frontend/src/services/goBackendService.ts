@@ -15,18 +15,40 @@ export interface GoBackendRunRequest {
   imageUsed?: string;
   imageOrig?: string;
   scenarioCount: number;
+  requestedScenarioCount?: number;
+  effectiveScenarioCount?: number;
+  availableProxies?: number;
+  directScenarioCount?: number;
+  note?: string;
+  aspectWarning?: string;
+  imageProcessed?: boolean;
+  processReason?: 'oversized' | 'non-png' | 'format-mismatch';
+  partial?: boolean;
+  failedCount?: number;
   results?: GoBackendScenarioResult[];
   error?: string;
 }
 
 export interface GoBackendScenarioResult {
   id: number;
-  outcome: 'downloaded' | 'exhausted' | 'none';
+  outcome: 'downloaded' | 'exhausted' | 'suspicious' | 'blocked' | 'none';
   path: string;
   url: string;
   proxyTag?: string;
+  proxied?: boolean;
+  appliedSettings?: string[];
   outputRes?: string;
   aspectRatio?: string;
+  imageHash?: string;
+  suspicious?: string;
+  quotaKind?: 'soft' | 'hard' | 'unknown';
+  timeout?: 'still_generating' | 'never_started';
+  bytes?: number;
+  uploadBytes?: number;
+  safetyReason?: string;
+  safetyRetried?: boolean;
+  originalSize?: { width: number; height: number };
+  savedSize?: { width: number; height: number };
   error?: string;
  }
  
@@ -58,11 +80,21 @@ export interface GoBackendCancelResponse {
   status: string;
 }
 
+export interface ProxySubscriptionHealth {
+  index: number;
+  cached: number;
+  usable: number;
+  penalized: number;
+  frozen: number;
+}
+
 export interface ProxySubscriptionsResponse {
   envSubscriptions: string[];
   storedSubscriptions: string[];
   effective: string[];
   subscriptions?: string[]; // fallback key
+  health?: ProxySubscriptionHealth[]; // 与 effective 一一对应
+  healthCached?: boolean;
 }
 
 // Go后端服务类
@@ -82,22 +114,34 @@ export class GoBackendService {
       throw new Error(`Go后端生成失败: 无法解析响应 ${response.status} ${response.statusText} - ${raw}`);
     }
 
-    const results = Array.isArray(data.results)
-      ? (data.results as GoBackendScenarioResult[]).filter(r => r.outcome === 'downloaded')
+    // 统一响应结构：{ ok, data, error: { code, message } }
+    const body = data.data || {};
+    const results = Array.isArray(body.results)
+      ? (body.results as GoBackendScenarioResult[]).filter(r => r.outcome === 'downloaded')
       : [];
 
     if (results.length > 0) {
       return {
-        status: data.status || 'ok',
-        imageUsed: data.imageUsed,
-        imageOrig: data.imageOrig,
-        scenarioCount: data.scenarioCount ?? results.length,
+        status: data.ok ? 'ok' : 'error',
+        imageUsed: body.imageUsed,
+        imageOrig: body.imageOrig,
+        scenarioCount: body.scenarioCount ?? results.length,
+        requestedScenarioCount: body.requestedScenarioCount,
+        effectiveScenarioCount: body.effectiveScenarioCount,
+        availableProxies: body.availableProxies,
+        directScenarioCount: body.directScenarioCount,
+        note: body.note,
+        aspectWarning: body.aspectWarning,
+        imageProcessed: body.imageProcessed,
+        processReason: body.processReason,
+        partial: body.partial,
+        failedCount: body.failedCount,
         results,
-        error: data.error,
+        error: data.error?.message,
       };
     }
 
-    const msg = data.error || raw || `HTTP ${response.status} ${response.statusText}`;
+    const msg = data.error?.message || raw || `HTTP ${response.status} ${response.statusText}`;
     throw new Error(`Go后端生成失败: ${msg}`);
   }
 
@@ -107,7 +151,7 @@ export class GoBackendService {
     if (!response.ok) {
       throw new Error(`Go后端健康检查失败: ${response.status} ${response.statusText}`);
     }
-    return response.json();
+    return (await response.json()).data;
   }
 
   // 取消当前运行
@@ -121,7 +165,7 @@ export class GoBackendService {
     if (!response.ok) {
       throw new Error(`Go后端取消运行失败: ${response.status} ${response.statusText}`);
     }
-    return response.json();
+    return (await response.json()).data;
   }
 
   // 生成图片（支持File对象和本地路径）
@@ -201,7 +245,7 @@ export class GoBackendService {
     if (!response.ok) {
       throw new Error(`Go后端画廊请求失败: ${response.status} ${response.statusText}`);
     }
-    return response.json();
+    return (await response.json()).data;
   }
 
   // 获取特定文件夹的文件列表
@@ -213,7 +257,7 @@ export class GoBackendService {
     if (!response.ok) {
       throw new Error(`Go后端画廊文件请求失败: ${response.status} ${response.statusText}`);
     }
-    return response.json();
+    return (await response.json()).data;
   }
 
   // 获取图片文件的完整URL
@@ -239,7 +283,7 @@ export class GoBackendService {
       if (!response.ok) {
         return [];
       }
-      const data = await response.json();
+      const data = (await response.json()).data || {};
       return data.proxies || [];
     } catch (error) {
       console.error('获取代理状态失败:', error);
@@ -253,11 +297,13 @@ export class GoBackendService {
     if (!res.ok) {
       throw new Error(`获取订阅失败: ${res.status} ${res.statusText}`);
     }
-    const data = await res.json();
+    const data = (await res.json()).data || {};
     return {
       envSubscriptions: data.envSubscriptions || [],
       storedSubscriptions: data.storedSubscriptions || data.subscriptions || [],
       effective: data.effective || data.storedSubscriptions || data.subscriptions || [],
+      health: data.health || [],
+      healthCached: data.healthCached,
     };
   }
 
@@ -271,7 +317,7 @@ export class GoBackendService {
       const txt = await res.text();
       throw new Error(`添加订阅失败: ${res.status} ${res.statusText} - ${txt}`);
     }
-    const data = await res.json();
+    const data = (await res.json()).data || {};
     return data.subscriptions || data.storedSubscriptions || [];
   }
 
@@ -285,10 +331,33 @@ export class GoBackendService {
       const txt = await res.text();
       throw new Error(`更新订阅失败: ${res.status} ${res.statusText} - ${txt}`);
     }
-    const data = await res.json();
+    const data = (await res.json()).data || {};
+    return data.subscriptions || data.storedSubscriptions || [];
+  }
+
+  async deleteProxySubscriptionAt(index: number): Promise<string[]> {
+    const res = await fetch(`${this.baseUrl}/proxy/subscriptions?index=${index}`, {
+      method: 'DELETE',
+    });
+    if (!res.ok) {
+      const txt = await res.text();
+      throw new Error(`删除订阅失败: ${res.status} ${res.statusText} - ${txt}`);
+    }
+    const data = (await res.json()).data || {};
     return data.subscriptions || data.storedSubscriptions || [];
   }
 
+  // 强制重新拉取订阅，返回可用节点数
+  async refreshProxySubscriptions(): Promise<number> {
+    const res = await fetch(`${this.baseUrl}/proxy/refresh`, { method: 'POST' });
+    if (!res.ok) {
+      const txt = await res.text();
+      throw new Error(`刷新订阅失败: ${res.status} ${res.statusText} - ${txt}`);
+    }
+    const data = (await res.json()).data || {};
+    return data.nodeCount ?? 0;
+  }
+
   async deleteProxySubscription(url: string): Promise<string[]> {
     const res = await fetch(`${this.baseUrl}/proxy/subscriptions?url=${encodeURIComponent(url)}`, {
       method: 'DELETE',
@@ -297,7 +366,7 @@ export class GoBackendService {
       const txt = await res.text();
       throw new Error(`删除订阅失败: ${res.status} ${res.statusText} - ${txt}`);
     }
-    const data = await res.json();
+    const data = (await res.json()).data || {};
     return data.subscriptions || data.storedSubscriptions || [];
   }
 }
@@ -0,0 +1,81 @@
+package app
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaultPauseRetryAfter 是暂停期间建议客户端重试的默认间隔
+const defaultPauseRetryAfter = time.Minute
+
+// requireAdmin 要求请求携带 Authorization: Bearer <ADMIN_TOKEN>；未配置 ADMIN_TOKEN 时管理接口不可用。
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		want := strings.TrimSpace(os.Getenv("ADMIN_TOKEN"))
+		if want == "" {
+			writeError(w, http.StatusForbidden, "未配置 ADMIN_TOKEN，管理接口已禁用")
+			return
+		}
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(strings.TrimSpace(got)), []byte(want)) != 1 {
+			writeError(w, http.StatusUnauthorized, "管理令牌无效")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleAdminPause 进入维护暂停：新的 /run 与 /ws 运行返回 503 与 Retry-After，正在进行的运行继续完成。
+// 请求体可选：{"reason":"更换订阅","retryAfter":"10m"}。
+func handleAdminPause(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "only POST allowed")
+		return
+	}
+	var body struct {
+		Reason     string `json:"reason"`
+		RetryAfter string `json:"retryAfter"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("decode body: %v", err))
+		return
+	}
+	retryAfter := defaultPauseRetryAfter
+	if raw := strings.TrimSpace(body.RetryAfter); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("retryAfter 无效: %s", raw))
+			return
+		}
+		retryAfter = d
+	}
+	state := runs.setPaused(strings.TrimSpace(body.Reason), retryAfter)
+	active := len(runs.list())
+	fmt.Printf("⏸️ 服务已暂停接受新任务（%s），进行中的运行 %d 个\n", state.Reason, active)
+	writeOK(w, http.StatusOK, map[string]any{
+		"paused":     true,
+		"pause":      state,
+		"retryAfter": retryAfterSeconds(retryAfter),
+		"activeRuns": active,
+	})
+}
+
+// handleAdminResume 解除维护暂停。
+func handleAdminResume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "only POST allowed")
+		return
+	}
+	was := runs.resume()
+	if was {
+		fmt.Println("▶️ 服务已恢复接受新任务")
+	}
+	writeOK(w, http.StatusOK, map[string]any{"paused": false, "wasPaused": was})
+}
@@ -0,0 +1,328 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrDownloadDirFull 表示下载目录超出 MAX_DOWNLOAD_BYTES 且无法腾出空间。
+var ErrDownloadDirFull = errors.New("download dir is full")
+
+const (
+	diskPolicyReject = "reject" // 超限时拒绝新任务
+	diskPolicyPrune  = "prune"  // 超限时删除最旧的批次文件夹
+)
+
+type diskUsage struct {
+	UsedBytes  int64     `json:"usedBytes"`
+	MaxBytes   int64     `json:"maxBytes,omitempty"`
+	Policy     string    `json:"policy,omitempty"`
+	MeasuredAt time.Time `json:"measuredAt"`
+}
+
+// diskUsageCache 保存最近一次测得的下载目录用量，/healthz 直接读取，不再每次遍历目录
+var diskUsageCache struct {
+	sync.Mutex
+	usage diskUsage
+	ok    bool
+}
+
+// maxDownloadBytes 返回下载目录的容量上限，<=0 表示不限制。
+func maxDownloadBytes() int64 {
+	return envInt64("MAX_DOWNLOAD_BYTES", 0)
+}
+
+func downloadFullPolicy() string {
+	if strings.EqualFold(strings.TrimSpace(os.Getenv("DOWNLOAD_FULL_POLICY")), diskPolicyPrune) {
+		return diskPolicyPrune
+	}
+	return diskPolicyReject
+}
+
+// storeDiskUsage 记录测得的下载目录用量。
+func storeDiskUsage(used int64) {
+	usage := diskUsage{UsedBytes: used, MaxBytes: maxDownloadBytes(), MeasuredAt: time.Now()}
+	if usage.MaxBytes > 0 {
+		usage.Policy = downloadFullPolicy()
+	}
+	diskUsageCache.Lock()
+	diskUsageCache.usage, diskUsageCache.ok = usage, true
+	diskUsageCache.Unlock()
+}
+
+// cachedDiskUsage 返回最近一次测得的用量；尚未测量过时 ok 为 false。
+func cachedDiskUsage() (diskUsage, bool) {
+	diskUsageCache.Lock()
+	defer diskUsageCache.Unlock()
+	return diskUsageCache.usage, diskUsageCache.ok
+}
+
+// watchDiskUsage 立即测量一次下载目录用量，之后每隔 DISK_USAGE_REFRESH（默认 1m，0 表示只测一次）刷新，
+// 直到 ctx 结束。运行前的 ensureDiskBudget 也会更新缓存。
+func watchDiskUsage(ctx context.Context, dir string) {
+	refresh := func() {
+		if used, err := dirSize(dir); err == nil {
+			storeDiskUsage(used)
+		}
+	}
+	refresh()
+	interval := envDuration("DISK_USAGE_REFRESH", time.Minute)
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			refresh()
+		}
+	}
+}
+
+func dirSize(dir string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// ensureDiskBudget 在运行前检查下载目录用量，按策略拒绝或清理最旧的批次文件夹。
+func ensureDiskBudget(dir string) error {
+	limit := maxDownloadBytes()
+	if limit <= 0 {
+		return nil
+	}
+	used, err := dirSize(dir)
+	if err != nil {
+		return fmt.Errorf("measure download dir: %w", err)
+	}
+	storeDiskUsage(used)
+	if used <= limit {
+		return nil
+	}
+	if downloadFullPolicy() != diskPolicyPrune {
+		return fmt.Errorf("%w: 已用 %d 字节，上限 %d 字节", ErrDownloadDirFull, used, limit)
+	}
+	freed, removed, err := pruneOldestBatches(dir, used-limit)
+	if err != nil {
+		return fmt.Errorf("prune download dir: %w", err)
+	}
+	storeDiskUsage(used - freed)
+	fmt.Printf("🧹 下载目录超限，已删除 %d 个最旧批次，释放 %d 字节\n", removed, freed)
+	if used-freed > limit {
+		return fmt.Errorf("%w: 清理后仍占用 %d 字节，上限 %d 字节", ErrDownloadDirFull, used-freed, limit)
+	}
+	return nil
+}
+
+// activeBatches 记录正在运行的任务写入的批次文件夹（绝对路径 → 引用数），清理时跳过
+var activeBatches = struct {
+	sync.Mutex
+	dirs map[string]int
+}{dirs: map[string]int{}}
+
+// batchKey 返回批次文件夹的绝对路径，用作 activeBatches 的键。
+func batchKey(dir, batch string) string {
+	target := filepath.Join(dir, filepath.FromSlash(batch))
+	if abs, err := filepath.Abs(target); err == nil {
+		return abs
+	}
+	return target
+}
+
+// claimBatchFolder 登记运行正在写入的批次文件夹，返回的函数在运行结束时注销。
+func claimBatchFolder(dir, batch string) func() {
+	key := batchKey(dir, batch)
+	activeBatches.Lock()
+	activeBatches.dirs[key]++
+	activeBatches.Unlock()
+	return func() {
+		activeBatches.Lock()
+		defer activeBatches.Unlock()
+		if activeBatches.dirs[key]--; activeBatches.dirs[key] <= 0 {
+			delete(activeBatches.dirs, key)
+		}
+	}
+}
+
+// batchFolderActive 判断批次文件夹是否有运行正在写入。
+func batchFolderActive(dir, batch string) bool {
+	activeBatches.Lock()
+	defer activeBatches.Unlock()
+	return activeBatches.dirs[batchKey(dir, batch)] > 0
+}
+
+// pruneOldestBatches 从最旧的画廊批次开始删除，直到释放 need 字节或没有可删的批次。
+// 只处理画廊可见的批次文件夹，traces、sing-box 等目录不会被删除；其他运行正在写入的批次也会跳过。
+func pruneOldestBatches(dir string, need int64) (int64, int, error) {
+	groups, _, err := listGalleryFolders(os.DirFS(dir), dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	var freed int64
+	removed := 0
+	for i := len(groups) - 1; i >= 0 && freed < need; i-- {
+		if batchFolderActive(dir, groups[i].Name) {
+			fmt.Printf("ℹ️ 批次 %s 正在被其他运行写入，跳过清理\n", groups[i].Name)
+			continue
+		}
+		target := filepath.Join(dir, filepath.FromSlash(groups[i].Name))
+		size, _ := dirSize(target)
+		if err := os.RemoveAll(target); err != nil {
+			return freed, removed, err
+		}
+		if partition, _, nested := strings.Cut(groups[i].Name, "/"); nested {
+			// 日期分区下的最后一个批次被删除后，顺带删除空的分区文件夹
+			_ = os.Remove(filepath.Join(dir, partition))
+		}
+		fmt.Printf("🧹 删除批次 %s (%d 字节)\n", groups[i].Name, size)
+		freed += size
+		removed++
+	}
+	return freed, removed, nil
+}
+
+// galleryPruneResult 是 /gallery/prune 的统计结果。
+type galleryPruneResult struct {
+	Removed int   `json:"removed"`
+	Freed   int64 `json:"freed"`
+	Folders int   `json:"folders"`
+}
+
+// pruneGalleryFiles 按保留策略删除画廊图片：每个批次只保留最新的 keepPerFolder 张（<=0 表示不限），
+// 并删除修改时间早于 olderThan 的图片（<=0 表示不限）。批次下节点子文件夹（OUTPUT_PROXY_TAG=folder）中的图片
+// 与批次一起计算。删空的节点子文件夹、批次与日期分区也会移除。
+func pruneGalleryFiles(dir string, keepPerFolder int, olderThan time.Duration) (galleryPruneResult, error) {
+	var res galleryPruneResult
+	fsys := os.DirFS(dir)
+	if _, err := fs.ReadDir(fsys, "."); err != nil {
+		return res, err
+	}
+	cutoff := time.Time{}
+	if olderThan > 0 {
+		cutoff = time.Now().Add(-olderThan)
+	}
+	for _, folder := range galleryBatchFolders(fsys) {
+		files, err := listFolderFiles(fsys, folder)
+		if err != nil || len(files) == 0 {
+			continue
+		}
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].ModTime.After(files[j].ModTime)
+		})
+		removed := 0
+		for i, f := range files {
+			keep := (keepPerFolder <= 0 || i < keepPerFolder) && (cutoff.IsZero() || !f.ModTime.Before(cutoff))
+			if keep {
+				continue
+			}
+			target := filepath.Join(dir, f.Name)
+			if err := os.Remove(target); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return res, err
+			}
+			if filepath.Dir(target) != filepath.Join(dir, filepath.FromSlash(folder)) {
+				// 节点子文件夹删空后移除
+				_ = os.Remove(filepath.Dir(target))
+			}
+			res.Removed++
+			res.Freed += f.Size
+			removed++
+		}
+		if removed == 0 {
+			continue
+		}
+		res.Folders++
+		fmt.Printf("🧹 批次 %s 删除 %d/%d 张图片\n", folder, removed, len(files))
+		// 只有删空的文件夹才会被移除
+		_ = os.Remove(filepath.Join(dir, filepath.FromSlash(folder)))
+		if partition, _, nested := strings.Cut(folder, "/"); nested {
+			_ = os.Remove(filepath.Join(dir, partition))
+		}
+	}
+	return res, nil
+}
+
+// traceDirName 是下载目录下存放 Playwright 追踪文件的子目录
+const traceDirName = "traces"
+
+// defaultTraceRetention 是未设置 TRACE_RETENTION 时保留的追踪文件数
+const defaultTraceRetention = 50
+
+// traceRetention 解析 TRACE_RETENTION：整数表示保留最新的 N 个，时长（如 72h）表示删除更早的文件，
+// 0 表示不清理；未设置或无效时保留最新的 defaultTraceRetention 个。
+func traceRetention() (keep int, maxAge time.Duration) {
+	raw := strings.TrimSpace(os.Getenv("TRACE_RETENTION"))
+	if raw == "" {
+		return defaultTraceRetention, 0
+	}
+	if n, err := strconv.Atoi(raw); err == nil && n >= 0 {
+		return n, 0
+	}
+	if d, err := time.ParseDuration(raw); err == nil && d > 0 {
+		return 0, d
+	}
+	fmt.Printf("⚠️ TRACE_RETENTION=%q 无效，保留最新的 %d 个追踪文件\n", raw, defaultTraceRetention)
+	return defaultTraceRetention, 0
+}
+
+// pruneTraces 按 TRACE_RETENTION 清理下载目录 traces 下的追踪文件，只处理 trace_*.zip。
+func pruneTraces(downloadDir string) {
+	keep, maxAge := traceRetention()
+	if keep == 0 && maxAge == 0 {
+		return
+	}
+	dir := filepath.Join(downloadDir, traceDirName)
+	matches, err := filepath.Glob(filepath.Join(dir, "trace_*.zip"))
+	if err != nil || len(matches) == 0 {
+		return
+	}
+	type traceFile struct {
+		path    string
+		modTime time.Time
+	}
+	files := make([]traceFile, 0, len(matches))
+	for _, m := range matches {
+		if info, err := os.Stat(m); err == nil && info.Mode().IsRegular() {
+			files = append(files, traceFile{m, info.ModTime()})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.After(files[j].modTime) })
+	cutoff := time.Now().Add(-maxAge)
+	removed := 0
+	for i, f := range files {
+		if (keep > 0 && i < keep) || (maxAge > 0 && f.modTime.After(cutoff)) {
+			continue
+		}
+		if err := os.Remove(f.path); err == nil {
+			removed++
+		}
+	}
+	if removed > 0 {
+		fmt.Printf("🧹 已清理 %d 个旧追踪文件（TRACE_RETENTION）\n", removed)
+	}
+}
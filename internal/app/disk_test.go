@@ -0,0 +1,45 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPruneOldestBatchesSkipsActiveBatch(t *testing.T) {
+	dir := t.TempDir()
+	for i, batch := range []string{"old", "older"} {
+		p := filepath.Join(dir, batch, "a.png")
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("0123456789"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		mod := time.Now().Add(-time.Duration(i+1) * time.Hour)
+		if err := os.Chtimes(p, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	release := claimBatchFolder(dir, "older")
+	freed, removed, err := pruneOldestBatches(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 || freed != 10 {
+		t.Fatalf("pruneOldestBatches() = %d bytes, %d folders, want 10 bytes, 1 folder", freed, removed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "older")); err != nil {
+		t.Errorf("active batch was removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "old")); !os.IsNotExist(err) {
+		t.Errorf("inactive batch still exists: %v", err)
+	}
+
+	release()
+	if _, removed, _ := pruneOldestBatches(dir, 1); removed != 1 {
+		t.Errorf("released batch not pruned, removed = %d", removed)
+	}
+}
@@ -0,0 +1,61 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envInt64 读取整数类环境变量，未设置或非法时返回默认值。
+func envInt64(name string, def int64) int64 {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		fmt.Printf("⚠️ %s=%q 无效，使用默认值 %d\n", name, raw, def)
+		return def
+	}
+	return n
+}
+
+// envInt 读取 int 类环境变量，未设置或非法时返回默认值。
+func envInt(name string, def int) int {
+	return int(envInt64(name, int64(def)))
+}
+
+// envBool 读取布尔类环境变量（1/true/yes/on），未设置时返回默认值。
+func envBool(name string, def bool) bool {
+	raw := strings.ToLower(strings.TrimSpace(os.Getenv(name)))
+	switch raw {
+	case "":
+		return def
+	case "1", "true", "yes", "on":
+		return true
+	case "0", "false", "no", "off":
+		return false
+	default:
+		fmt.Printf("⚠️ %s=%q 无效，使用默认值 %v\n", name, raw, def)
+		return def
+	}
+}
+
+// envDuration 读取时长类环境变量，支持 "30s" 形式或纯秒数，未设置或非法时返回默认值。
+// 0 是合法值（如 HTTP_WRITE_TIMEOUT=0 表示不限），负数视为非法；proxy 包的同名函数规则相同。
+func envDuration(name string, def time.Duration) time.Duration {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return def
+	}
+	if d, err := time.ParseDuration(raw); err == nil && d >= 0 {
+		return d
+	}
+	if n, err := strconv.Atoi(raw); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second
+	}
+	fmt.Printf("⚠️ %s=%q 无效，使用默认值 %s\n", name, raw, def)
+	return def
+}
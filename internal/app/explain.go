@@ -0,0 +1,104 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"vertex-nano-banana-unlimited/internal/steps"
+)
+
+// explainStep 是 /run?explain=1 返回的单个步骤：步骤元数据加上本次请求下的取值，
+// Skip 非空表示该步骤不会执行及其原因。
+type explainStep struct {
+	steps.StepInfo
+	Detail string `json:"detail,omitempty"`
+	Skip   string `json:"skip,omitempty"`
+}
+
+// 步骤不执行的原因
+const (
+	explainSkipRequested   = "skipSteps"   // 请求中 skipSteps 指定跳过
+	explainSkipNotProvided = "notProvided" // 未提供对应参数
+)
+
+// explainRequested 判断 /run 是否只需返回执行计划（?explain=1）。
+func explainRequested(r *http.Request) bool {
+	return r.URL.Query().Get("explain") == "1"
+}
+
+// explainScenario 按 steps.Catalog() 的顺序列出一个场景会执行的步骤与选择器，不启动浏览器。
+// 步骤顺序与选择器只来自 Catalog，这里只补充本次请求下的取值与跳过原因。
+func explainScenario(opts RunOptions) []explainStep {
+	out := []explainStep{{
+		StepInfo: steps.StepInfo{Key: "navigate", Name: "Navigate", Func: "page.Goto", Selectors: []string{}},
+		Detail:   opts.TargetURL,
+	}}
+	for _, info := range steps.Catalog() {
+		detail, skip := explainDetail(info.Key, opts)
+		if skip == "" && slices.Contains(skippableSteps, info.Key) && slices.Contains(opts.SkipSteps, info.Key) {
+			skip = explainSkipRequested
+		}
+		// 选项类步骤（分辨率、宽高比）用取值替换选择器中的 <value>
+		if info.Key == steps.StepKeyResolution || info.Key == steps.StepKeyAspectRatio {
+			for i, sel := range info.Selectors {
+				info.Selectors[i] = strings.ReplaceAll(sel, "<value>", detail)
+			}
+		}
+		out = append(out, explainStep{StepInfo: info, Detail: detail, Skip: skip})
+	}
+	return out
+}
+
+// explainDetail 返回步骤在本次请求下的取值；缺少对应参数而不会执行时返回 explainSkipNotProvided。
+func explainDetail(key string, opts RunOptions) (detail, skip string) {
+	switch key {
+	case steps.StepKeyResolution:
+		return opts.OutputRes, ""
+	case steps.StepKeyAspectRatio:
+		return opts.AspectRatio, ""
+	case steps.StepKeyTemperature:
+		if opts.setsTemperature() {
+			return fmt.Sprintf("%.1f", opts.Temperature), ""
+		}
+		return "", explainSkipNotProvided
+	case steps.StepKeyAdvancedSettings:
+		if len(opts.AdvancedSettings) == 0 {
+			return "", explainSkipNotProvided
+		}
+		names := make([]string, 0, len(opts.AdvancedSettings))
+		for name := range opts.AdvancedSettings {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return strings.Join(names, ", "), ""
+	case steps.StepKeyPrompt:
+		return fmt.Sprintf("%d chars", len([]rune(opts.PromptText))), ""
+	case steps.StepKeyUpload:
+		if opts.ImagePath == "" {
+			return "", explainSkipNotProvided
+		}
+	}
+	return "", ""
+}
+
+// writeExplain 输出 /run?explain=1 的响应：不登记运行、不启动浏览器，只返回步骤计划。
+// 有按场景覆盖时额外列出每个场景的步骤。
+func writeExplain(w http.ResponseWriter, mode string, opts RunOptions) {
+	fmt.Printf("🔍 /run (%s) explain scenario=%d res=%s aspect=%s\n", mode, opts.ScenarioCount, opts.OutputRes, opts.AspectRatio)
+	resp := map[string]any{
+		"explain":       true,
+		"scenarioCount": opts.ScenarioCount,
+		"steps":         explainScenario(opts),
+	}
+	if len(opts.ScenarioOverrides) > 0 {
+		scenarios := make([]map[string]any, 0, opts.ScenarioCount)
+		for id := 1; id <= opts.ScenarioCount; id++ {
+			scenarios = append(scenarios, map[string]any{"scenario": id, "steps": explainScenario(opts.forScenario(id))})
+		}
+		resp["scenarios"] = scenarios
+	}
+	writeOK(w, http.StatusOK, resp)
+}
@@ -0,0 +1,153 @@
+package app
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"vertex-nano-banana-unlimited/internal/imageprocessing"
+)
+
+// defaultGalleryFormats 是画廊默认展示的图片格式（当前下载结果均为 PNG）
+var defaultGalleryFormats = []string{imageprocessing.FormatPNG}
+
+// galleryFormats 读取 GALLERY_FORMATS（逗号分隔，如 "png,jpeg,webp"），忽略无法识别的格式。
+// 为空或全部无效时只展示 PNG；非图片文件始终被排除。
+func galleryFormats() []string {
+	raw := strings.TrimSpace(os.Getenv("GALLERY_FORMATS"))
+	if raw == "" {
+		return defaultGalleryFormats
+	}
+	var formats []string
+	for _, f := range strings.Split(raw, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if f == "jpg" {
+			f = imageprocessing.FormatJPEG
+		}
+		if f == "" || f == imageprocessing.FormatSVG || imageprocessing.ExtForFormat(f) == "" {
+			if f != "" {
+				fmt.Printf("⚠️ GALLERY_FORMATS 中的格式 %q 不受支持，已忽略\n", f)
+			}
+			continue
+		}
+		formats = append(formats, f)
+	}
+	if len(formats) == 0 {
+		return defaultGalleryFormats
+	}
+	return formats
+}
+
+// isGalleryImage 判断文件扩展名是否属于画廊展示的格式。
+func isGalleryImage(name string, formats []string) bool {
+	ext := filepath.Ext(name)
+	for _, f := range formats {
+		if imageprocessing.ExtMatchesFormat(ext, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// galleryExportEntry 是画廊导出中的一行记录
+type galleryExportEntry struct {
+	Folder  string    `json:"folder"`
+	Name    string    `json:"name"`
+	URL     string    `json:"url"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Width   int       `json:"width,omitempty"`
+	Height  int       `json:"height,omitempty"`
+	Prompt  string    `json:"prompt,omitempty"` // 来自 PNG 内嵌元数据，没有时为空
+}
+
+// handleGalleryExport 遍历下载目录一次，以 JSON 或 CSV 流式输出全部画廊文件的元数据。
+func handleGalleryExport(w http.ResponseWriter, r *http.Request) {
+	format := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("format")))
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("format 只支持 json 或 csv: %s", format))
+		return
+	}
+	dir := DefaultRunOptions().DownloadDir
+	if _, err := os.Stat(dir); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("list gallery: %v", err))
+		return
+	}
+
+	count := 0
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="gallery.csv"`)
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"folder", "name", "url", "size", "modTime", "width", "height", "prompt"})
+		walkGallery(os.DirFS(dir), dir, func(e galleryExportEntry) {
+			count++
+			_ = cw.Write([]string{
+				e.Folder, e.Name, e.URL,
+				strconv.FormatInt(e.Size, 10),
+				e.ModTime.Format(time.RFC3339),
+				strconv.Itoa(e.Width), strconv.Itoa(e.Height),
+				e.Prompt,
+			})
+			cw.Flush()
+		})
+		cw.Flush()
+		fmt.Printf("ℹ️ /gallery/export csv files=%d dir=%s\n", count, dir)
+		return
+	}
+
+	// JSON 同样使用统一响应结构，逐条编码写出，避免在内存中构建完整列表
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	// dir 用 encoding/json 编码：Go 的 %q 转义规则与 JSON 不同，非 UTF-8 字节等会产生非法 JSON
+	dirJSON, _ := json.Marshal(dir)
+	_, _ = fmt.Fprintf(w, `{"ok":true,"data":{"dir":%s,"files":[`, dirJSON)
+	walkGallery(os.DirFS(dir), dir, func(e galleryExportEntry) {
+		if count > 0 {
+			_, _ = w.Write([]byte(","))
+		}
+		count++
+		_ = enc.Encode(e)
+	})
+	_, _ = fmt.Fprintf(w, `],"count":%d}}`, count)
+	fmt.Printf("ℹ️ /gallery/export json files=%d dir=%s\n", count, dir)
+}
+
+// walkGallery 按批次文件夹遍历 fsys 中的图片文件并逐条回调，规则与 listFolderFiles 一致。
+func walkGallery(fsys fs.FS, baseDir string, emit func(galleryExportEntry)) {
+	formats := galleryFormats()
+	for _, folder := range galleryBatchFolders(fsys) {
+		for _, img := range galleryImages(fsys, folder, formats, true) {
+			rel := filepath.FromSlash(img.rel)
+			entry := galleryExportEntry{
+				Folder:  folder,
+				Name:    rel,
+				URL:     galleryURL(rel),
+				Size:    img.info.Size(),
+				ModTime: img.info.ModTime(),
+			}
+			if f, err := fsys.Open(img.rel); err == nil {
+				if cfg, _, err := image.DecodeConfig(f); err == nil {
+					entry.Width, entry.Height = cfg.Width, cfg.Height
+				}
+				f.Close()
+			}
+			if prompt, err := embeddedPrompt(filepath.Join(baseDir, rel)); err == nil {
+				entry.Prompt = prompt
+			}
+			emit(entry)
+		}
+	}
+}
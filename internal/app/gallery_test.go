@@ -0,0 +1,141 @@
+package app
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestGalleryFileHandlerRangeAndHead(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("0123456789abcdefghij")
+	if err := os.MkdirAll(filepath.Join(dir, "batch"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "batch", "a.png"), content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h := http.StripPrefix(downloadURLPrefix, galleryFileHandler(dir))
+
+	req := httptest.NewRequest(http.MethodGet, downloadURLPrefix+"batch/a.png", nil)
+	req.Header.Set("Range", "bytes=0-9")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("range GET status = %d, want %d", rec.Code, http.StatusPartialContent)
+	}
+	if got, want := rec.Header().Get("Content-Range"), "bytes 0-9/20"; got != want {
+		t.Errorf("Content-Range = %q, want %q", got, want)
+	}
+	if got := rec.Body.String(); got != "0123456789" {
+		t.Errorf("range body = %q, want %q", got, "0123456789")
+	}
+
+	req = httptest.NewRequest(http.MethodHead, downloadURLPrefix+"batch/a.png", nil)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("HEAD status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("HEAD body has %d bytes, want none", rec.Body.Len())
+	}
+	if got := rec.Header().Get("Content-Length"); got != "20" {
+		t.Errorf("HEAD Content-Length = %q, want %q", got, "20")
+	}
+}
+
+func TestGalleryURL(t *testing.T) {
+	tests := []struct {
+		rel  string
+		want string
+	}{
+		{"batch/a.png", "/tmp/batch/a.png"},
+		{"2024-06-01/batch/a.png", "/tmp/2024-06-01/batch/a.png"},
+		{"batch/node-1/a.png", "/tmp/batch/node-1/a.png"},
+		{"/batch/a.png", "/tmp/batch/a.png"},
+		{"batch/./sub/../a.png", "/tmp/batch/a.png"},
+		{filepath.Join("batch", "a b.png"), "/tmp/batch/a b.png"},
+	}
+	for _, tt := range tests {
+		if got := galleryURL(tt.rel); got != tt.want {
+			t.Errorf("galleryURL(%q) = %q, want %q", tt.rel, got, tt.want)
+		}
+	}
+}
+
+func TestListFolderFilesURLs(t *testing.T) {
+	mod := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	fsys := fstest.MapFS{
+		"batch/a.png":        {Data: []byte("a"), ModTime: mod},
+		"batch/node-1/b.png": {Data: []byte("b"), ModTime: mod},
+		"batch/notes.txt":    {Data: []byte("x"), ModTime: mod},
+	}
+	files, err := listFolderFiles(fs.FS(fsys), "batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, f := range files {
+		got[f.Name] = f.URL
+	}
+	want := map[string]string{
+		filepath.Join("batch", "a.png"):           "/tmp/batch/a.png",
+		filepath.Join("batch", "node-1", "b.png"): "/tmp/batch/node-1/b.png",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("listFolderFiles() = %v, want %v", got, want)
+	}
+	for name, url := range want {
+		if got[name] != url {
+			t.Errorf("URL for %s = %q, want %q", name, got[name], url)
+		}
+	}
+}
+
+func TestGalleryFileHandlerOnlyServesGalleryImages(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{
+		"batch/a.png",
+		"2024-06-01/batch/node-1/b.png",
+		"batch/notes.txt",
+		"batch/c.png.part",
+		"batch/.d.png",
+		"root.png",
+		"singbox/config.json",
+		"singbox/outbounds.json",
+		"singbox/e.png",
+		"traces/trace_1.zip",
+		"traces/f.png",
+	}
+	for _, name := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := http.StripPrefix(downloadURLPrefix, galleryFileHandler(dir))
+	want := map[string]int{
+		"batch/a.png":                   http.StatusOK,
+		"2024-06-01/batch/node-1/b.png": http.StatusOK,
+	}
+	for _, name := range files {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, downloadURLPrefix+name, nil))
+		code, ok := want[name]
+		if !ok {
+			code = http.StatusNotFound
+		}
+		if rec.Code != code {
+			t.Errorf("GET %s status = %d, want %d", name, rec.Code, code)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// idempotencyKeyHeader 是客户端重试时携带的幂等键请求头
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotentRun 记录一个带幂等键的 /run 请求：进行中时重复请求等待其结束，
+// 完成后在 IDEMPOTENCY_TTL 内直接返回相同结果，避免重试重复消耗配额。
+type idempotentRun struct {
+	done      chan struct{}
+	completed bool // 运行已结束并记录结果；为 false 时表示请求未能开始运行
+	expires   time.Time
+
+	mode      string
+	opts      RunOptions
+	imageOrig string
+	obs       runObserver
+	results   []ScenarioResult
+	err       error
+}
+
+type idempotencyStore struct {
+	mu      sync.Mutex
+	entries map[string]*idempotentRun
+}
+
+var idempotentRuns = &idempotencyStore{entries: map[string]*idempotentRun{}}
+
+type idempotencyCtxKey struct{}
+
+// claim 返回幂等键对应的记录。leader 为 true 时由调用方执行运行，
+// 之后必须调用 abandon（运行已记录时为空操作）。
+func (s *idempotencyStore) claim(key string) (*idempotentRun, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, e := range s.entries {
+		if e.completed && now.After(e.expires) {
+			delete(s.entries, k)
+		}
+	}
+	if e, ok := s.entries[key]; ok {
+		return e, false
+	}
+	e := &idempotentRun{done: make(chan struct{})}
+	s.entries[key] = e
+	return e, true
+}
+
+// complete 记录运行结果并唤醒等待者；keep 为 false 或 TTL 为 0 时不保留结果。
+func (s *idempotencyStore) complete(key string, e *idempotentRun, keep bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e.completed {
+		return
+	}
+	e.completed = true
+	ttl := envDuration("IDEMPOTENCY_TTL", 10*time.Minute)
+	e.expires = time.Now().Add(ttl)
+	if (!keep || ttl <= 0) && s.entries[key] == e {
+		delete(s.entries, key)
+	}
+	close(e.done)
+}
+
+// abandon 在请求未能开始运行（如参数校验失败）时删除记录，让客户端可以重试。
+func (s *idempotencyStore) abandon(key string, e *idempotentRun) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e.completed {
+		return
+	}
+	if s.entries[key] == e {
+		delete(s.entries, key)
+	}
+	select {
+	case <-e.done:
+	default:
+		close(e.done)
+	}
+}
+
+// withIdempotency 为 /run 处理函数加上 Idempotency-Key 支持；未携带该请求头时直接执行。
+func withIdempotency(w http.ResponseWriter, r *http.Request, handle func(http.ResponseWriter, *http.Request)) {
+	key := strings.TrimSpace(r.Header.Get(idempotencyKeyHeader))
+	if key == "" {
+		handle(w, r)
+		return
+	}
+	e, leader := idempotentRuns.claim(key)
+	if leader {
+		defer idempotentRuns.abandon(key, e)
+		handle(w, r.WithContext(context.WithValue(r.Context(), idempotencyCtxKey{}, &idempotentRecord{key: key, run: e})))
+		return
+	}
+
+	fmt.Printf("🔂 /run 幂等键 %q 已有请求，复用其结果\n", key)
+	select {
+	case <-e.done:
+	case <-r.Context().Done():
+		return
+	}
+	if !e.completed {
+		writeError(w, http.StatusConflict, "相同 Idempotency-Key 的请求未能开始运行，请重试")
+		return
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	// 每个重放请求使用自己的副本：inline=1 会在结果中填充 ImageBase64
+	writeRunResponse(w, r, e.mode, e.opts, e.imageOrig, &e.obs, cloneScenarioResults(e.results), e.err)
+}
+
+// idempotentRecord 通过请求 context 传给 writeRunResponse，用于记录运行结果。
+type idempotentRecord struct {
+	key string
+	run *idempotentRun
+}
+
+// recordIdempotentRun 在请求带有幂等键时保存本次运行的结果。
+func recordIdempotentRun(r *http.Request, mode string, opts RunOptions, imageOrig string, obs *runObserver, results []ScenarioResult, runErr error) {
+	rec, ok := r.Context().Value(idempotencyCtxKey{}).(*idempotentRecord)
+	if !ok {
+		return
+	}
+	e := rec.run
+	e.mode, e.opts, e.imageOrig, e.obs, e.results, e.err = mode, opts, imageOrig, *obs, cloneScenarioResults(results), runErr
+	idempotentRuns.complete(rec.key, e, idempotentFinal(runErr))
+}
+
+// idempotentFinal 判断运行结果是否为最终结果、可以按幂等键保留。被取消的运行，以及额度冷却、
+// 维护暂停、并发上限、代理不可用、磁盘已满等未真正开始运行的拒绝都不保留，客户端重试时会重新运行。
+func idempotentFinal(err error) bool {
+	for _, transient := range []error{context.Canceled, errQuotaCooldown, errRunsPaused, errTooManyRuns, ErrNoProxyAvailable, errProxiesBusy, errProxiesExcluded, ErrDownloadDirFull} {
+		if errors.Is(err, transient) {
+			return false
+		}
+	}
+	return true
+}
+
+// cloneScenarioResults 深拷贝运行结果，保存的结果与各个响应互不影响。
+func cloneScenarioResults(results []ScenarioResult) []ScenarioResult {
+	if results == nil {
+		return nil
+	}
+	out := make([]ScenarioResult, len(results))
+	for i, r := range results {
+		r.AppliedSettings = append([]string(nil), r.AppliedSettings...)
+		if r.OriginalSize != nil {
+			size := *r.OriginalSize
+			r.OriginalSize = &size
+		}
+		if r.SavedSize != nil {
+			size := *r.SavedSize
+			r.SavedSize = &size
+		}
+		out[i] = r
+	}
+	return out
+}
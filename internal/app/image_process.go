@@ -0,0 +1,101 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"vertex-nano-banana-unlimited/internal/imageprocessing"
+)
+
+// maxProcessInputBytes 是 /image/process 接受的上传大小上限
+const maxProcessInputBytes int64 = 32 << 20
+
+// handleImageProcess 只做图片转换/缩放，不启动浏览器：
+// multipart 字段 image（必填）、format（png|jpeg，默认 png）、maxWidth、maxHeight、quality、maxBytes。
+// 成功时直接返回处理后的图片字节。
+func handleImageProcess(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxProcessInputBytes+1<<20)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("parse form: %v", err))
+		return
+	}
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("读取 image 文件字段失败: %v", err))
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxProcessInputBytes+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("读取图片失败: %v", err))
+		return
+	}
+	if int64(len(data)) > maxProcessInputBytes {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("图片超过 %d 字节上限", maxProcessInputBytes))
+		return
+	}
+	format := imageprocessing.DetectFormat(data)
+	if !imageprocessing.IsDecodableFormat(format) {
+		writeError(w, http.StatusUnsupportedMediaType, fmt.Sprintf("%v: %s", errUnsupportedImage, format))
+		return
+	}
+
+	opts := imageprocessing.DefaultProcessImageOptions()
+	opts.MaxSizeBytes = maxProcessInputBytes
+	switch f := strings.ToLower(strings.TrimSpace(r.FormValue("format"))); f {
+	case "", imageprocessing.FormatPNG:
+		opts.OutputFormat = imageprocessing.FormatPNG
+	case imageprocessing.FormatJPEG, "jpg":
+		opts.OutputFormat = imageprocessing.FormatJPEG
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("format 只支持 png 或 jpeg: %s", f))
+		return
+	}
+	for _, field := range []struct {
+		name string
+		dst  *int
+		max  int
+	}{
+		{"maxWidth", &opts.MaxWidth, 16384},
+		{"maxHeight", &opts.MaxHeight, 16384},
+		{"quality", &opts.Quality, 100},
+	} {
+		raw := strings.TrimSpace(r.FormValue(field.name))
+		if raw == "" {
+			continue
+		}
+		v, err := strconv.Atoi(raw)
+		if err != nil || v < 1 || v > field.max {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("%s 需为 1-%d 的整数: %s", field.name, field.max, raw))
+			return
+		}
+		*field.dst = v
+	}
+	if raw := strings.TrimSpace(r.FormValue("maxBytes")); raw != "" {
+		v, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || v < 1 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("maxBytes 无效: %s", raw))
+			return
+		}
+		opts.MaxSizeBytes = v
+	}
+
+	out, ext, err := imageprocessing.ProcessImage(data, opts)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("process image: %v", err))
+		return
+	}
+	contentType := "image/png"
+	if opts.OutputFormat == imageprocessing.FormatJPEG {
+		contentType = "image/jpeg"
+	}
+	fmt.Printf("🖼️ /image/process %s -> %s %d -> %d bytes\n", format, opts.OutputFormat, len(data), len(out))
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(out)))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="processed%s"`, ext))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(out)
+}
@@ -0,0 +1,45 @@
+package app
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"vertex-nano-banana-unlimited/internal/steps"
+)
+
+// handleOptions 返回服务端支持的可选项，客户端据此生成下拉框而不必硬编码。
+// 分辨率、宽高比与温度范围与请求校验使用同一份定义（steps 包）。
+func handleOptions(w http.ResponseWriter, r *http.Request) {
+	defaults := DefaultRunOptions()
+	models := []string{}
+	if model := targetModel(defaults.TargetURL); model != "" {
+		models = append(models, model)
+	}
+	writeOK(w, http.StatusOK, map[string]any{
+		"resolutions":  steps.Resolutions,
+		"aspectRatios": steps.ResolutionAspectRatios,
+		"models":       models,
+		"temperature": map[string]any{
+			"min":     steps.MinTemperature,
+			"max":     steps.MaxTemperature,
+			"default": defaults.Temperature,
+			"presets": steps.TemperaturePresets,
+		},
+		"defaults": map[string]any{
+			"resolution":  defaults.OutputRes,
+			"aspectRatio": defaults.AspectRatio,
+		},
+		"skipSteps":         skippableSteps,
+		"promptPostprocess": promptPostprocessNames(),
+	})
+}
+
+// targetModel 从目标地址的 model 查询参数中取出模型名（控制台地址形如 ...;mode=prompt?model=xxx）。
+func targetModel(target string) string {
+	u, err := url.Parse(strings.TrimSpace(target))
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get("model")
+}
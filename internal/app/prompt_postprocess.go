@@ -0,0 +1,45 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// promptQualitySuffix 是 append-quality 追加的质量标签
+const promptQualitySuffix = "highly detailed, sharp focus, high quality"
+
+// promptPostprocessors 是内置的提示词后处理器，均为确定性的纯字符串变换。
+var promptPostprocessors = map[string]func(string) string{
+	"none": func(p string) string { return p },
+	"append-quality": func(p string) string {
+		p = strings.TrimRight(strings.TrimSpace(p), " ,，。.")
+		if strings.Contains(strings.ToLower(p), promptQualitySuffix) {
+			return p
+		}
+		return p + ", " + promptQualitySuffix
+	},
+}
+
+// postprocessPrompt 按名称对提示词做后处理，空名称视为 none，未知名称返回错误。
+func postprocessPrompt(name, prompt string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return prompt, nil
+	}
+	fn, ok := promptPostprocessors[name]
+	if !ok {
+		return "", fmt.Errorf("未知的提示词后处理 %q，可选：%s", name, strings.Join(promptPostprocessNames(), ", "))
+	}
+	return fn(prompt), nil
+}
+
+// promptPostprocessNames 返回按名称排序的内置后处理器。
+func promptPostprocessNames() []string {
+	names := make([]string, 0, len(promptPostprocessors))
+	for n := range promptPostprocessors {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
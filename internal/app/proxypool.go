@@ -0,0 +1,164 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"vertex-nano-banana-unlimited/internal/proxy"
+)
+
+// errProxiesBusy 表示配置了代理，但所有节点都被其他运行占用。此时不回退直连，
+// 避免本应经代理的运行暴露真实出口。
+var errProxiesBusy = errors.New("所有代理节点都被其他运行占用，请稍后重试")
+
+// errProxiesExcluded 表示空闲节点都在本次运行的 excludeProxyTags 中，同样不回退直连。
+var errProxiesExcluded = errors.New("excludeProxyTags 排除了所有空闲代理节点")
+
+// proxyPool 让并发运行共享同一个 sing-box 进程，并保证同一节点同一时间只分配给一个运行。
+type proxyPool struct {
+	mu        sync.Mutex
+	startMu   sync.Mutex       // 串行化 sing-box 的启动；启动期间不持有 mu
+	refs      int              // 正在使用（或正在启动）sing-box 的运行数
+	endpoints []proxy.Endpoint // sing-box 启动时的全部可用节点
+	stop      func()
+	leased    map[string]bool // 已被某个运行占用的节点 tag
+}
+
+var sharedProxyPool = &proxyPool{leased: map[string]bool{}}
+
+// retain 登记一个使用者，并在 sing-box 未运行时启动它。启动在 mu 之外进行，
+// 不阻塞其他运行归还节点或查询状态。返回 false 表示未配置代理或启动失败，此时登记已撤销。
+func (p *proxyPool) retain() bool {
+	p.mu.Lock()
+	p.refs++
+	started := p.endpoints != nil
+	p.mu.Unlock()
+	if started {
+		return true
+	}
+
+	p.startMu.Lock()
+	p.mu.Lock()
+	started = p.endpoints != nil
+	p.mu.Unlock()
+	if !started {
+		// 使用 context.Background() 启动 sing-box，使其生命周期与应用程序保持一致，
+		// 而不是与单个请求的 context 绑定。这可以防止因为请求结束或取消
+		// (例如在 page.Goto 期间) 导致 sing-box 进程被提前终止。
+		endpoints, stop, err := proxy.StartSingBox(context.Background())
+		if err != nil {
+			fmt.Printf("⚠️ sing-box 启动失败：%v\n", err)
+		}
+		if err != nil || len(endpoints) == 0 {
+			if stop != nil {
+				stop()
+			}
+		} else {
+			p.mu.Lock()
+			p.endpoints, p.stop = endpoints, stop
+			p.mu.Unlock()
+			started = true
+		}
+	}
+	p.startMu.Unlock()
+
+	if !started {
+		p.mu.Lock()
+		p.releaseLocked()
+		p.mu.Unlock()
+	}
+	return started
+}
+
+// releaseLocked 撤销一个使用者，最后一个使用者离开时停止 sing-box，需在持有 mu 时调用。
+func (p *proxyPool) releaseLocked() {
+	p.refs--
+	if p.refs == 0 {
+		p.shutdownLocked()
+	}
+}
+
+// acquire 启动或复用 sing-box，为本次运行租用最多 want 个未被占用且不在 exclude 中的节点，
+// 由 strategy 从这些空闲节点中选取（nil 时按冷却状态排序后依次选取）。
+// 未配置代理时返回空列表与 nil（直连）；空闲节点都被 exclude 排除时返回 errProxiesExcluded，
+// 节点都被占用时返回 errProxiesBusy。
+// 返回的 release 归还节点，并在最后一个运行结束时停止 sing-box。
+func (p *proxyPool) acquire(want int, exclude []string, strategy ProxyStrategy) ([]proxy.Endpoint, func(), error) {
+	if !p.retain() {
+		return nil, func() {}, nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// 按最新的冷却状态排序后筛出空闲节点，再由策略选取
+	var free []proxy.Endpoint
+	excluded := 0
+	for _, ep := range proxy.OrderByCooldown(p.endpoints) {
+		switch {
+		case p.leased[ep.Tag]:
+		case slices.Contains(exclude, ep.Tag):
+			excluded++
+		default:
+			free = append(free, ep)
+		}
+	}
+	out := assignProxies(free, want, strategy, false)
+	for _, ep := range out {
+		p.leased[ep.Tag] = true
+	}
+	if len(out) == 0 {
+		p.releaseLocked()
+		if len(free) == 0 && excluded > 0 {
+			fmt.Printf("⚠️ excludeProxyTags 排除了全部 %d 个空闲代理节点\n", excluded)
+			return nil, func() {}, errProxiesExcluded
+		}
+		fmt.Println("⚠️ 所有代理节点都被其他运行占用")
+		return nil, func() {}, errProxiesBusy
+	}
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			for _, ep := range out {
+				delete(p.leased, ep.Tag)
+			}
+			p.releaseLocked()
+		})
+	}
+	return out, release, nil
+}
+
+// borrowAll 启动或复用 sing-box，返回全部节点但不租用，供健康检查等只读用途使用。
+// 返回的 release 在最后一个使用者结束时停止 sing-box。
+func (p *proxyPool) borrowAll() ([]proxy.Endpoint, func()) {
+	if !p.retain() {
+		return nil, func() {}
+	}
+	p.mu.Lock()
+	out := append([]proxy.Endpoint(nil), p.endpoints...)
+	p.mu.Unlock()
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.releaseLocked()
+		})
+	}
+	return out, release
+}
+
+// shutdownLocked 停止 sing-box 并清空节点列表，需在持有 mu 时调用。
+func (p *proxyPool) shutdownLocked() {
+	if p.stop != nil {
+		p.stop()
+	}
+	p.stop = nil
+	p.endpoints = nil
+}
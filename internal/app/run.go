@@ -2,45 +2,260 @@ package app
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"image"
+	"math"
+	"math/rand"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	playwright "github.com/playwright-community/playwright-go"
 
+	"vertex-nano-banana-unlimited/internal/fsperm"
+	"vertex-nano-banana-unlimited/internal/imageprocessing"
 	"vertex-nano-banana-unlimited/internal/proxy"
 	"vertex-nano-banana-unlimited/internal/steps"
 )
 
+const defaultTargetURL = "https://console.cloud.google.com/vertex-ai/studio/multimodal;mode=prompt?model=gemini-3-pro-image-preview"
+
 type RunOptions struct {
-	TargetURL     string
-	ImagePath     string
-	PromptText    string
-	DownloadDir   string
-	Headless      bool
-	ScenarioCount int
-	StepPause     time.Duration
-	SubStepPause  time.Duration
-	OutputRes     string
-	AspectRatio   string
-	Temperature   float64
+	TargetURL  string
+	ImagePath  string
+	TempDir    string // 本次运行的临时目录（上传与预处理的图片），由调用方创建并在运行结束后整体删除
+	SourceName string // 原始文件名或图片地址，用于命名批次文件夹；为空时使用 ImagePath
+	// ImageProcessReason 图片在运行前被重新编码的原因（见 imageProcessReason），空表示使用原图
+	ImageProcessReason string
+	PromptText         string
+	DownloadDir        string
+	Headless           bool
+	ScenarioCount      int
+	StepPause          time.Duration
+	SubStepPause       time.Duration
+	OutputRes          string
+	AspectRatio        string
+	Temperature        float64
+	// TemperaturePreset 请求中使用的温度预设名称（见 steps.TemperaturePresets），仅用于回显
+	TemperaturePreset string
+	// TemperatureExplicit 表示 Temperature 为显式指定的值：为 0 时也会设置温度，而不是沿用页面默认值。
+	// 逐场景覆盖指定温度时设置
+	TemperatureExplicit bool
+	GotoAttempts        int           // 打开目标页的尝试次数
+	GotoTimeout         time.Duration // 单次打开目标页的超时
+	LaunchAttempts      int           // 浏览器启动的尝试次数，瞬时失败时退避重试
+	LaunchStagger       time.Duration // 场景依次错开启动的间隔，避免同时请求触发 429
+	// WaitNetworkIdle 导航后额外等待 networkidle。控制台的长轮询/websocket 常让它迟迟不触发，
+	// 而后续步骤自带等待，默认关闭；开启时最多等待 NetworkIdleTimeout
+	WaitNetworkIdle    bool
+	NetworkIdleTimeout time.Duration
+	// KeepOpenOnFailure 仅在 Headless=false 时生效：步骤失败后保留浏览器窗口供调试，
+	// 直到运行被取消或 KeepOpenTimeout 到期
+	KeepOpenOnFailure bool
+	KeepOpenTimeout   time.Duration
+	// PersistentPage 仅在 Headless=false 且单代理/直连时生效：只导航与设置一次，
+	// 之后在同一页面上依次为各场景输入提示词、提交并下载
+	PersistentPage bool
+	ProxyStrategy  ProxyStrategy // 从代理池空闲节点中选取节点的策略，nil 时按节点顺序选取
+	RequireProxy   bool          // 没有可用代理节点时报错，而不是回退直连（避免暴露真实 IP）
+	// AllowDirectFill 场景数超过可用代理时，多出的场景直连运行而不是被截掉（RequireProxy 时无效）
+	AllowDirectFill bool
+	// AllowProxyReuse 允许同一运行中多个并发场景共用一个节点：节点不足时轮流复用而不是截掉场景
+	// （优先于 AllowDirectFill）。默认关闭，同一节点只分配给一个场景，避免自己触发节点限流。
+	// 复用时节点冷却与失败计数仍按场景记录：共用节点的每个失败场景都会计一次失败，节点更快被硬冻结；
+	// 结果中的 proxyTag 与 summary.proxyTags（去重）照常反映各场景实际使用的节点
+	AllowProxyReuse bool
+	// DownloadPollInterval 等待生成结果时的轮询间隔，默认 1s
+	DownloadPollInterval time.Duration
+	DownloadRetries      int           // 下载阶段瞬时失败时的重试次数（不重新提交提示词）
+	RegionRetries        int           // 节点地区不受支持时换用其他节点重试的次数
+	RunRetries           int           // 所有场景均未成功时整批重跑的次数（重新分配节点，遵循冷却记录）
+	RunRetryDelay        time.Duration // 整批重跑前的等待时间
+	RegionFreeze         time.Duration // 地区不受支持的节点硬冻结时长，默认 24h
+	TermsTimeout         time.Duration // 等待并接受使用条款弹窗的超时，默认 45s
+	TermsOptional        bool          // 弹窗始终未出现时视为已接受（跳过），而不是失败
+	TermsAppearWait      time.Duration // TermsOptional 时等待弹窗出现的时长，默认 0（立即判断）
+	VerifyImage          bool          // 下载后检查图片是否近乎空白或与参考图相同，命中则标记为可疑
+	EmbedMetadata        bool          // 下载后将提示词与生成参数写入 PNG 的 iTXt 文本块
+	// MaxSaveDimension 保存前将下载图片的最长边缩小到该像素数以内，0 表示保留原尺寸
+	MaxSaveDimension int
+	// SkipSteps 跳过的可选步骤（见 skippableSteps），用于某个步骤在特定界面变体上失效时临时绕过
+	SkipSteps []string
+	// PromptPostprocess 输入前对提示词做的后处理（见 promptPostprocessors），空或 none 表示原样使用
+	PromptPostprocess string
+	// SafetyPolicy 提示词被安全拦截时的处理：fail（默认，立即失败）或 retry（改写提示词后重试一次）
+	SafetyPolicy string
+	// SafetySanitizer retry 策略下改写提示词的钩子，为 nil 时不重试
+	SafetySanitizer SafetySanitizer
+	// ProxyTagOutput 在输出路径中标注场景使用的代理节点：空（默认，不标注）、
+	// "folder"（放到 batchFolder/<tag>/ 下，画廊不列出子目录）或 "filename"（文件名追加 _<tag>）
+	ProxyTagOutput string
+	// DatePartition 按日期分区存放批次文件夹（DownloadDir/2024-06-01/batchFolder），画廊会自动向下多走一层
+	DatePartition bool
+	// QuotaSoftFreeze / QuotaHardFreeze 是 soft（每分钟限流）与 hard（每日额度/账号封禁）配额提示下节点的冻结时长
+	QuotaSoftFreeze time.Duration
+	QuotaHardFreeze time.Duration
+	// ExcludeProxyTags 仅对本次运行排除的节点 tag，不影响全局冷却记录
+	ExcludeProxyTags []string
+	// ScenarioOverrides 按场景顺序覆盖分辨率/宽高比/温度，便于同一请求内对比；未覆盖的场景沿用顶层设置
+	ScenarioOverrides []ScenarioOverride
+	// AdvancedSettings 按控件名称设置的其他模型参数（如 "Top-P": "0.9"），页面上没有的控件跳过
+	AdvancedSettings map[string]string
+	UserAgent        string              // 浏览器上下文的 User-Agent，为空时使用引擎默认值
+	Locale           string              // 浏览器语言区域，如 en-US
+	TimezoneID       string              // 浏览器时区，如 America/Los_Angeles
+	OnProgress       func(ProgressEvent) // 可选，步骤进度回调（供 WebSocket 等流式接口推送）
+	OnPlan           func(RunPlan)       // 可选，确定实际场景数后、启动浏览器前回调一次
+	OnSummary        func(RunSummary)    // 可选，场景全部结束后回调一次运行汇总
+}
+
+// RunSummary 汇总一次运行中各场景的结果，供仪表盘直接展示。
+type RunSummary struct {
+	Total       int      `json:"total"`
+	Downloaded  int      `json:"downloaded"`
+	Exhausted   int      `json:"exhausted"`
+	Suspicious  int      `json:"suspicious"`
+	Blocked     int      `json:"blocked"` // 被安全过滤拦截
+	None        int      `json:"none"`
+	Errors      int      `json:"errors"`
+	SuccessRate float64  `json:"successRate"` // 0-1
+	DurationMs  int64    `json:"durationMs"`
+	ProxyTags   []string `json:"proxyTags"`
+	Attempts    int      `json:"attempts"` // 整批运行的次数，RunRetries 重跑时大于 1
+	// TotalBytes 为各场景下载图片的字节数之和，UploadedBytes 为各场景上传参考图的字节数之和
+	TotalBytes    int64 `json:"totalBytes"`
+	UploadedBytes int64 `json:"uploadedBytes"`
+}
+
+// RunPlan 描述请求的场景数与按可用代理限制后实际执行的场景数。
+type RunPlan struct {
+	RequestedScenarioCount int    `json:"requestedScenarioCount"`
+	EffectiveScenarioCount int    `json:"effectiveScenarioCount"`
+	AvailableProxies       int    `json:"availableProxies"`              // 0 表示直连
+	DirectScenarioCount    int    `json:"directScenarioCount,omitempty"` // AllowDirectFill 时直连运行的场景数
+	Note                   string `json:"note,omitempty"`
+	// AspectWarning 参考图宽高比与请求的宽高比相差较大时的提示，不影响运行
+	AspectWarning string `json:"aspectWarning,omitempty"`
+}
+
+// ProgressEvent 描述单个场景的步骤进度。
+type ProgressEvent struct {
+	Scenario int    `json:"scenario"`
+	Step     string `json:"step"`
+	Status   string `json:"status"` // started / progress / done / failed / skipped
+	Message  string `json:"message,omitempty"`
 }
 
+const (
+	progressStarted = "started"
+	progressDone    = "done"
+	progressFailed  = "failed"
+	progressSkipped = "skipped"
+	progressRunning = "progress" // 长步骤的中间进度，message 中带已等待时长
+)
+
 type ScenarioResult struct {
 	ID          int                   `json:"id"`
 	Outcome     steps.DownloadOutcome `json:"outcome"`
 	Path        string                `json:"path"`
 	URL         string                `json:"url"`
 	ProxyTag    string                `json:"proxyTag,omitempty"`
+	Proxied     bool                  `json:"proxied"` // 是否经代理运行，false 表示直连
 	OutputRes   string                `json:"outputRes,omitempty"`
 	AspectRatio string                `json:"aspectRatio,omitempty"`
 	Error       string                `json:"error,omitempty"`
+	ErrorCode   string                `json:"errorCode,omitempty"`
+	ImageBase64 string                `json:"imageBase64,omitempty"` // 仅 /run?inline=1 时填充
+	ImageHash   string                `json:"imageHash,omitempty"`   // 平均哈希，VerifyImage 开启时填充
+	Suspicious  string                `json:"suspicious,omitempty"`  // 可疑原因（空白图/与参考图相同）
+	QuotaKind   steps.QuotaKind       `json:"quotaKind,omitempty"`   // exhausted 时的配额类型：soft/hard/unknown
+	// Timeout 等待超时（outcome 为 none）时的状态：still_generating 表示后端较慢，可延长等待；
+	// never_started 表示从未进入生成，提交多半没有成功
+	Timeout     steps.DownloadTimeout `json:"timeout,omitempty"`
+	Bytes       int64                 `json:"bytes,omitempty"`       // 下载图片的字节数（含写入的元数据）
+	UploadBytes int64                 `json:"uploadBytes,omitempty"` // 本场景上传参考图的字节数
+	// SafetyReason 安全拦截提示的原文；SafetyRetried 表示已改写提示词重试（重试成功时两者仍保留）
+	SafetyReason  string `json:"safetyReason,omitempty"`
+	SafetyRetried bool   `json:"safetyRetried,omitempty"`
+	// OriginalSize / SavedSize 下载图片的原始与保存尺寸，仅 MaxSaveDimension 开启时填充
+	OriginalSize *imageprocessing.Dimensions `json:"originalSize,omitempty"`
+	SavedSize    *imageprocessing.Dimensions `json:"savedSize,omitempty"`
+	// AppliedSettings 实际设置成功的 AdvancedSettings 名称
+	AppliedSettings []string `json:"appliedSettings,omitempty"`
+}
+
+// OutcomeSuspicious 表示图片已下载但疑似生成失败（空白或与参考图相同）。图片保留在批次中，
+// 不计入 downloaded，但也不会触发整批重跑（见 shouldRetryRun）。
+const OutcomeSuspicious steps.DownloadOutcome = "suspicious"
+
+// 图片校验阈值
+const (
+	blankStdDevThreshold   = 2.0 // 缩略图亮度标准差低于该值视为近乎纯色
+	duplicateHashThreshold = 2   // 与参考图哈希的汉明距离不超过该值视为相同
+)
+
+// ErrBrowserNotInstalled 表示 Playwright 找不到浏览器可执行文件，重试无意义，需要先安装浏览器。
+var ErrBrowserNotInstalled = errors.New("浏览器未安装（请运行 playwright install chromium）")
+
+// launchBrowser 启动浏览器，瞬时失败（残留锁、资源争用等）时按 2s、4s... 退避重试，
+// 最多 attempts 次；浏览器未安装时立即返回 ErrBrowserNotInstalled。
+func launchBrowser(ctx context.Context, browserType playwright.BrowserType, launchOpts playwright.BrowserTypeLaunchOptions, attempts int) (playwright.Browser, error) {
+	if attempts < 1 {
+		attempts = 1
+	}
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		var browser playwright.Browser
+		browser, err = browserType.Launch(launchOpts)
+		if err == nil {
+			return browser, nil
+		}
+		if browser != nil {
+			_ = browser.Close()
+		}
+		if browserNotInstalled(err) {
+			return nil, fmt.Errorf("%w: %v", ErrBrowserNotInstalled, err)
+		}
+		fmt.Printf("⚠️ 浏览器启动失败 (%d/%d): %v\n", attempt, attempts, err)
+		if attempt < attempts {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(time.Duration(attempt) * 2 * time.Second):
+			}
+		}
+	}
+	return nil, fmt.Errorf("launch browser: %d 次尝试均失败（瞬时启动错误）: %w", attempts, err)
+}
+
+// browserNotInstalled 根据 Playwright 的错误信息判断是否缺少浏览器可执行文件。
+func browserNotInstalled(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "executable doesn't exist") ||
+		strings.Contains(msg, "playwright install") ||
+		strings.Contains(msg, "please install")
 }
 
+// ErrNoProxyAvailable 表示设置了 RequireProxy 但没有可分配的代理节点。
+var ErrNoProxyAvailable = errors.New("没有可用的代理节点（已设置 REQUIRE_PROXY，不回退直连）")
+
+// 场景错误码，便于客户端区分失败原因
+const (
+	ErrorCodeProxy     = "PROXY"      // 代理节点无法完成导航，节点已冻结
+	ErrorCodeCancelled = "CANCELLED"  // 运行被取消（如 POST /cancel），未完成的下载已清理
+	ErrorCodeProxyDown = "PROXY_DOWN" // sing-box 进程已退出，节点本身未被冻结
+	ErrorCodeRegion    = "REGION"     // 节点所在地区不支持 Vertex Studio，节点已硬冻结
+)
+
 func DefaultRunOptions() RunOptions {
 	imagePath := "" // 不设置默认图片路径，要求用户上传
 
@@ -58,22 +273,110 @@ func DefaultRunOptions() RunOptions {
 	subStepPause := 500 * time.Millisecond
 	temperature := 1.0 // 默认温度值
 
+	// TARGET_URL 用于指向预发环境或其他语言版本的控制台
+	targetURL := strings.TrimSpace(os.Getenv("TARGET_URL"))
+	if targetURL == "" {
+		targetURL = defaultTargetURL
+	}
+
 	return RunOptions{
-		TargetURL:     "https://console.cloud.google.com/vertex-ai/studio/multimodal;mode=prompt?model=gemini-3-pro-image-preview",
-		ImagePath:     imagePath,
-		PromptText:    "",
-		DownloadDir:   downloadDir,
-		Headless:      true,
-		ScenarioCount: scenarioCount,
-		StepPause:     stepPause,
-		SubStepPause:  subStepPause,
-		OutputRes:     outputRes,
-		AspectRatio:   aspectRatio,
-		Temperature:   temperature,
+		TargetURL:      targetURL,
+		ImagePath:      imagePath,
+		PromptText:     "",
+		DownloadDir:    downloadDir,
+		Headless:       envBool("RUN_HEADLESS", true),
+		ScenarioCount:  scenarioCount,
+		StepPause:      stepPause,
+		SubStepPause:   subStepPause,
+		OutputRes:      outputRes,
+		AspectRatio:    aspectRatio,
+		Temperature:    temperature,
+		GotoAttempts:   envInt("GOTO_ATTEMPTS", 3),
+		GotoTimeout:    envDuration("GOTO_TIMEOUT", 30*time.Second),
+		LaunchAttempts: envInt("BROWSER_LAUNCH_ATTEMPTS", 3),
+		LaunchStagger:  envDuration("LAUNCH_STAGGER", 0),
+
+		WaitNetworkIdle:    envBool("WAIT_NETWORK_IDLE", false),
+		NetworkIdleTimeout: envDuration("NETWORK_IDLE_TIMEOUT", 10*time.Second),
+
+		KeepOpenOnFailure:    envBool("KEEP_OPEN_ON_FAILURE", false),
+		KeepOpenTimeout:      envDuration("KEEP_OPEN_TIMEOUT", 10*time.Minute),
+		PersistentPage:       envBool("PERSISTENT_PAGE", false),
+		RequireProxy:         envBool("REQUIRE_PROXY", false),
+		AllowDirectFill:      envBool("ALLOW_DIRECT_FILL", false),
+		AllowProxyReuse:      envBool("PROXY_ALLOW_REUSE", false),
+		ProxyStrategy:        proxyStrategyFromEnv(),
+		VerifyImage:          envBool("VERIFY_IMAGE", false),
+		EmbedMetadata:        envBool("EMBED_METADATA", false),
+		MaxSaveDimension:     envInt("MAX_SAVE_DIMENSION", 0),
+		SkipSteps:            splitList(os.Getenv("SKIP_STEPS")),
+		PromptPostprocess:    os.Getenv("PROMPT_POSTPROCESS"),
+		SafetyPolicy:         strings.ToLower(strings.TrimSpace(os.Getenv("SAFETY_POLICY"))),
+		SafetySanitizer:      commandSanitizer(os.Getenv("SAFETY_SANITIZER_CMD")),
+		ProxyTagOutput:       strings.ToLower(strings.TrimSpace(os.Getenv("OUTPUT_PROXY_TAG"))),
+		DatePartition:        envBool("OUTPUT_DATE_PARTITION", false),
+		QuotaSoftFreeze:      envDuration("QUOTA_SOFT_FREEZE", 2*time.Minute),
+		QuotaHardFreeze:      envDuration("QUOTA_HARD_FREEZE", 12*time.Hour),
+		DownloadPollInterval: envDuration("DOWNLOAD_POLL_INTERVAL", time.Second),
+		DownloadRetries:      envInt("DOWNLOAD_RETRIES", 1),
+		RegionRetries:        envInt("REGION_RETRIES", 1),
+		RunRetries:           envInt("RUN_RETRIES", 0),
+		RunRetryDelay:        envDuration("RUN_RETRY_DELAY", 5*time.Second),
+		RegionFreeze:         envDuration("REGION_FREEZE", 24*time.Hour),
+		TermsTimeout:         envDuration("TERMS_TIMEOUT", 45*time.Second),
+		TermsOptional:        envBool("TERMS_OPTIONAL", true),
+		TermsAppearWait:      envDuration("TERMS_APPEAR_WAIT", 0),
+		UserAgent:            strings.TrimSpace(os.Getenv("BROWSER_USER_AGENT")),
+		Locale:               strings.TrimSpace(os.Getenv("BROWSER_LOCALE")),
+		TimezoneID:           strings.TrimSpace(os.Getenv("BROWSER_TIMEZONE")),
 	}
 }
 
+// RunWithOptions 执行一批场景；全部未成功时按 RunRetries 整批重跑，返回最后一次的结果。
 func RunWithOptions(ctx context.Context, opts RunOptions) ([]ScenarioResult, error) {
+	started := time.Now()
+	attempts := 1
+	results, err := runWithOptions(ctx, opts)
+	for ; attempts <= opts.RunRetries && shouldRetryRun(ctx, results); attempts++ {
+		fmt.Printf("🔁 本批 %d 个场景均未成功，%s 后整批重跑 (%d/%d)\n", len(results), opts.RunRetryDelay, attempts, opts.RunRetries)
+		select {
+		case <-ctx.Done():
+		case <-time.After(opts.RunRetryDelay):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		results, err = runWithOptions(ctx, opts)
+	}
+	if opts.OnSummary != nil && results != nil {
+		sum := summarizeResults(results, time.Since(started))
+		sum.Attempts = attempts
+		opts.OnSummary(sum)
+	}
+	return results, err
+}
+
+// shouldRetryRun 判断是否值得整批重跑：场景确实运行过、没有任何图片保存下来，且不是全部额度耗尽
+// 或被安全拦截（额度耗尽由账号冷却处理，立即重跑只会继续消耗；相同提示词重跑仍会被拦截）。
+// 可疑图片（OutcomeSuspicious）同样算作已保存：整批重跑会重新生成已保存的图片，
+// 是否重跑由客户端根据结果中的 suspicious 字段决定。
+func shouldRetryRun(ctx context.Context, results []ScenarioResult) bool {
+	if ctx.Err() != nil || len(results) == 0 {
+		return false
+	}
+	hopeless := 0
+	for _, r := range results {
+		switch r.Outcome {
+		case steps.DownloadOutcomeDownloaded, OutcomeSuspicious:
+			return false
+		case steps.DownloadOutcomeExhausted, steps.DownloadOutcomeBlocked:
+			hopeless++
+		}
+	}
+	return hopeless < len(results)
+}
+
+func runWithOptions(ctx context.Context, opts RunOptions) ([]ScenarioResult, error) {
 	select {
 	case <-ctx.Done():
 		return nil, ctx.Err()
@@ -82,9 +385,43 @@ func RunWithOptions(ctx context.Context, opts RunOptions) ([]ScenarioResult, err
 	if opts.TargetURL == "" {
 		return nil, errors.New("TargetURL 不能为空")
 	}
+	if err := validateTargetURL(opts.TargetURL); err != nil {
+		return nil, err
+	}
 	if opts.PromptText == "" {
 		return nil, errors.New("PromptText 不能为空")
 	}
+	if err := validateTemperature(opts.Temperature); err != nil {
+		return nil, err
+	}
+	if err := normalizeAspectRatios(&opts); err != nil {
+		return nil, err
+	}
+	if err := validateResolutionAspect(opts.OutputRes, opts.AspectRatio); err != nil {
+		return nil, err
+	}
+	if err := validateSkipSteps(opts.SkipSteps); err != nil {
+		return nil, err
+	}
+	if err := validateExcludeProxyTags(opts.ExcludeProxyTags); err != nil {
+		return nil, err
+	}
+	if err := validateSafetyPolicy(opts.SafetyPolicy); err != nil {
+		return nil, err
+	}
+	switch opts.ProxyTagOutput {
+	case "", ProxyTagOutputFolder, ProxyTagOutputFilename:
+	default:
+		return nil, fmt.Errorf("未知的 ProxyTagOutput %q，可选：%s, %s", opts.ProxyTagOutput, ProxyTagOutputFolder, ProxyTagOutputFilename)
+	}
+	prompt, err := postprocessPrompt(opts.PromptPostprocess, opts.PromptText)
+	if err != nil {
+		return nil, err
+	}
+	if prompt != opts.PromptText {
+		fmt.Printf("✏️ 提示词经 %s 后处理：%d → %d 字符\n", opts.PromptPostprocess, len(opts.PromptText), len(prompt))
+		opts.PromptText = prompt
+	}
 	// ImagePath现在可以为空，支持纯文本生成
 	if opts.ScenarioCount < 1 {
 		opts.ScenarioCount = 1
@@ -104,18 +441,74 @@ func RunWithOptions(ctx context.Context, opts RunOptions) ([]ScenarioResult, err
 	if opts.AspectRatio == "" {
 		opts.AspectRatio = "1:1"
 	}
+	if opts.GotoAttempts < 1 {
+		opts.GotoAttempts = 1
+	}
+	if opts.GotoTimeout <= 0 {
+		opts.GotoTimeout = 30 * time.Second
+	}
+	if opts.NetworkIdleTimeout <= 0 {
+		opts.NetworkIdleTimeout = 10 * time.Second
+	}
+	if err := validateScenarioOverrides(opts); err != nil {
+		return nil, err
+	}
 
-	if err := os.MkdirAll(opts.DownloadDir, 0o755); err != nil {
+	if err := os.MkdirAll(opts.DownloadDir, fsperm.Dir()); err != nil {
 		return nil, fmt.Errorf("make download dir: %w", err)
 	}
+	if err := ensureDiskBudget(opts.DownloadDir); err != nil {
+		return nil, err
+	}
+	defer pruneTraces(opts.DownloadDir)
 
-	proxyEndpoints := pickProxyEndpoints(ctx)
+	proxyEndpoints, releaseProxies, err := pickProxyEndpoints(opts.ScenarioCount, opts.RequireProxy, opts.ExcludeProxyTags, opts.ProxyStrategy)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseProxies()
+	if len(proxyEndpoints) == 0 && opts.RequireProxy {
+		return nil, ErrNoProxyAvailable
+	}
+
+	batchFolder := batchFolderName(opts, time.Now())
+	if opts.DatePartition {
+		batchFolder = filepath.Join(time.Now().Format(datePartitionLayout), batchFolder)
+	}
+	if !withinDir(opts.DownloadDir, filepath.Join(opts.DownloadDir, batchFolder)) {
+		return nil, fmt.Errorf("批次目录 %q 不在下载目录内", batchFolder)
+	}
+	// 登记批次文件夹，其他运行按 DOWNLOAD_FULL_POLICY=prune 清理时不会删除它
+	defer claimBatchFolder(opts.DownloadDir, batchFolder)()
 
-	batchFolder := ""
+	runCount := opts.ScenarioCount
+	// 节点已由代理池按 ProxyStrategy 选出，这里按租用顺序分配给场景
+	assigned := assignProxies(proxyEndpoints, runCount, nil, opts.AllowProxyReuse)
+	// 持久页面模式在同一页面上顺序生成，不受代理数量限制
+	// 各场景设置不同时无法复用同一页面的设置，因此逐场景覆盖时也不使用持久页面
+	persistent := opts.PersistentPage && !opts.Headless && len(assigned) <= 1 && len(opts.ScenarioOverrides) == 0
+	if opts.PersistentPage && !persistent {
+		fmt.Println("ℹ️ 持久页面模式仅适用于有头、单代理/直连且没有逐场景覆盖的运行，按常规方式执行")
+	}
+	plan := RunPlan{RequestedScenarioCount: runCount, AvailableProxies: len(assigned)}
+	if !persistent && len(assigned) > 0 && runCount > len(assigned) && opts.AllowDirectFill && !opts.RequireProxy {
+		plan.DirectScenarioCount = runCount - len(assigned)
+		fmt.Printf("ℹ️ 并发数 %d 超过可用代理 %d，其余 %d 个场景直连运行\n", runCount, len(assigned), plan.DirectScenarioCount)
+		plan.Note = fmt.Sprintf("请求 %d 个场景，只有 %d 个可用代理节点：%d 个经代理、%d 个直连", runCount, len(assigned), len(assigned), plan.DirectScenarioCount)
+	} else if !persistent && len(assigned) > 0 && runCount > len(assigned) {
+		fmt.Printf("⚠️ 并发数 %d 超过可用代理 %d，将限制为 %d\n", runCount, len(assigned), len(assigned))
+		plan.Note = fmt.Sprintf("请求 %d 个场景，但只有 %d 个可用代理节点，实际运行 %d 个", runCount, len(assigned), len(assigned))
+		runCount = len(assigned)
+	}
+	plan.EffectiveScenarioCount = runCount
 	if opts.ImagePath != "" {
-		batchFolder = sanitizeSegment(strings.TrimSuffix(filepath.Base(opts.ImagePath), filepath.Ext(opts.ImagePath)))
-	} else {
-		batchFolder = fmt.Sprintf("text-only-%d", time.Now().Unix())
+		plan.AspectWarning = aspectMismatchWarning(opts.ImagePath, opts, runCount)
+		if plan.AspectWarning != "" {
+			fmt.Printf("⚠️ %s\n", plan.AspectWarning)
+		}
+	}
+	if opts.OnPlan != nil {
+		opts.OnPlan(plan)
 	}
 
 	pw, err := playwright.Run()
@@ -124,25 +517,37 @@ func RunWithOptions(ctx context.Context, opts RunOptions) ([]ScenarioResult, err
 	}
 	defer pw.Stop()
 
+	if !opts.Headless && !displayAvailable() {
+		fmt.Println("⚠️ 请求了有头模式，但未检测到 DISPLAY/WAYLAND_DISPLAY，浏览器可能无法启动（可使用 xvfb-run）")
+	}
+
 	browserType := pw.Chromium
 	engineName := browserType.Name()
 	launchOpts := playwright.BrowserTypeLaunchOptions{
 		Headless: playwright.Bool(opts.Headless),
 		Args:     chromiumArgs,
 	}
-	browser, err := browserType.Launch(launchOpts)
+	browser, err := launchBrowser(ctx, browserType, launchOpts, opts.LaunchAttempts)
 	if err != nil {
-		return nil, fmt.Errorf("launch browser: %w", err)
+		return nil, err
 	}
 	defer browser.Close()
 
 	viewport := playwright.Size{Width: 1920, Height: 1080}
-	runCount := opts.ScenarioCount
 
-	assigned := proxyEndpoints
-	if len(assigned) > 0 && runCount > len(assigned) {
-		fmt.Printf("⚠️ 并发数 %d 超过可用代理 %d，将限制为 %d\n", runCount, len(assigned), len(assigned))
-		runCount = len(assigned)
+	if persistent {
+		var proxyURL, proxyTag string
+		if len(assigned) == 1 {
+			proxyURL, proxyTag = assigned[0].URL, assigned[0].Tag
+		}
+		fmt.Printf("🔁 持久页面模式：同一页面依次生成 %d 个场景\n", runCount)
+		results, err := runPersistentScenarios(ctx, browser, viewport, engineName, proxyURL, proxyTag, runCount, opts, batchFolder)
+		for _, r := range results {
+			if r.Outcome == steps.DownloadOutcomeDownloaded {
+				return results, nil
+			}
+		}
+		return results, err
 	}
 
 	var wg sync.WaitGroup
@@ -150,7 +555,7 @@ func RunWithOptions(ctx context.Context, opts RunOptions) ([]ScenarioResult, err
 	resultCh := make(chan ScenarioResult, runCount)
 	for i := 0; i < runCount; i++ {
 		var proxyURL, proxyTag string
-		if len(assigned) > 0 {
+		if i < len(assigned) {
 			proxyURL = assigned[i].URL
 			proxyTag = assigned[i].Tag
 			fmt.Printf("🧭 [%d] Using proxy %s (tag=%s)\n", i+1, proxyURL, proxyTag)
@@ -158,7 +563,25 @@ func RunWithOptions(ctx context.Context, opts RunOptions) ([]ScenarioResult, err
 		wg.Add(1)
 		go func(id int, pURL, pTag string) {
 			defer wg.Done()
+			if delay := time.Duration(id-1) * opts.LaunchStagger; delay > 0 {
+				select {
+				case <-ctx.Done():
+				case <-time.After(delay):
+				}
+			}
 			res, err := runScenario(ctx, browser, viewport, engineName, pURL, pTag, id, opts, batchFolder)
+			// 节点地区不受支持时，从节点池另租一个节点重试
+			for retry := 0; err != nil && res.ErrorCode == ErrorCodeRegion && pTag != "" && retry < opts.RegionRetries && ctx.Err() == nil; retry++ {
+				spare, releaseSpare, _ := sharedProxyPool.acquire(1, opts.ExcludeProxyTags, opts.ProxyStrategy)
+				if len(spare) == 0 {
+					fmt.Printf("⚠️ [%d] 没有可替换的代理节点，放弃重试\n", id)
+					break
+				}
+				defer releaseSpare()
+				fmt.Printf("🔁 [%d] 节点 %s 地区不受支持，换用节点 %s 重试\n", id, pTag, spare[0].Tag)
+				pURL, pTag = spare[0].URL, spare[0].Tag
+				res, err = runScenario(ctx, browser, viewport, engineName, pURL, pTag, id, opts, batchFolder)
+			}
 			if err != nil {
 				res.Error = err.Error()
 				errCh <- fmt.Errorf("scenario %d: %w", id, err)
@@ -195,6 +618,317 @@ func RunWithOptions(ctx context.Context, opts RunOptions) ([]ScenarioResult, err
 	return results, firstErr
 }
 
+// summarizeResults 统计各结果类型的数量、成功率与使用的代理节点。
+func summarizeResults(results []ScenarioResult, elapsed time.Duration) RunSummary {
+	sum := RunSummary{Total: len(results), DurationMs: elapsed.Milliseconds(), ProxyTags: []string{}}
+	seenTags := map[string]bool{}
+	for _, r := range results {
+		switch {
+		case r.Outcome == steps.DownloadOutcomeDownloaded:
+			sum.Downloaded++
+		case r.Outcome == steps.DownloadOutcomeExhausted:
+			sum.Exhausted++
+		case r.Outcome == OutcomeSuspicious:
+			sum.Suspicious++
+		case r.Outcome == steps.DownloadOutcomeBlocked:
+			sum.Blocked++
+		case r.Error != "":
+			sum.Errors++
+		default:
+			sum.None++
+		}
+		sum.TotalBytes += r.Bytes
+		sum.UploadedBytes += r.UploadBytes
+		if r.ProxyTag != "" && !seenTags[r.ProxyTag] {
+			seenTags[r.ProxyTag] = true
+			sum.ProxyTags = append(sum.ProxyTags, r.ProxyTag)
+		}
+	}
+	if sum.Total > 0 {
+		sum.SuccessRate = float64(sum.Downloaded) / float64(sum.Total)
+	}
+	return sum
+}
+
+// validateTemperature 是温度校验的唯一入口，handler 与 RunWithOptions 共用。
+func validateTemperature(t float64) error {
+	if math.IsNaN(t) || t < steps.MinTemperature || t > steps.MaxTemperature {
+		return fmt.Errorf("temperature 必须在 %.0f 到 %.0f 之间（0 表示使用默认值）: %v", steps.MinTemperature, steps.MaxTemperature, t)
+	}
+	return nil
+}
+
+// 可通过 SkipSteps 跳过的步骤；导航、输入提示词、提交与下载是必需步骤，不能跳过
+const (
+	StepTerms            = "terms"
+	StepCookies          = "cookies"
+	StepModelSettings    = "modelSettings"
+	StepResolution       = "resolution"
+	StepAspectRatio      = "aspectRatio"
+	StepTemperature      = "temperature"
+	StepAdvancedSettings = "advancedSettings"
+)
+
+var skippableSteps = []string{StepTerms, StepCookies, StepModelSettings, StepResolution, StepAspectRatio, StepTemperature, StepAdvancedSettings}
+
+// validateSkipSteps 拒绝未知的步骤名称。
+func validateSkipSteps(names []string) error {
+	for _, name := range names {
+		known := false
+		for _, step := range skippableSteps {
+			if name == step {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("未知的跳过步骤 %q，可选：%s", name, strings.Join(skippableSteps, ", "))
+		}
+	}
+	return nil
+}
+
+// validateExcludeProxyTags 拒绝 outbounds 缓存中不存在的节点 tag；没有缓存时无法校验，直接放行。
+func validateExcludeProxyTags(tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	known, cached := proxy.CachedTags()
+	if !cached {
+		return nil
+	}
+	for _, tag := range tags {
+		if !slices.Contains(known, tag) {
+			return fmt.Errorf("未知的代理节点 %q（可在 /proxy/healthcheck 结果中查看节点 tag）", tag)
+		}
+	}
+	return nil
+}
+
+// splitList 按逗号拆分并去掉空白项。
+func splitList(raw string) []string {
+	var out []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// ScenarioOverride 覆盖单个场景的输出参数，空值或 nil 表示沿用顶层设置；温度可以显式覆盖为 0。
+type ScenarioOverride struct {
+	OutputRes   string   `json:"resolution,omitempty"`
+	AspectRatio string   `json:"aspectRatio,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+}
+
+// buildScenarioOverrides 将按场景排列的分辨率、宽高比与温度数组合并为逐场景覆盖，
+// 第 i 项对应场景 i+1，各数组长度可以不同；全部为空时返回 nil。
+func buildScenarioOverrides(resolutions, aspects []string, temps []*float64) []ScenarioOverride {
+	n := max(len(resolutions), len(aspects), len(temps))
+	if n == 0 {
+		return nil
+	}
+	out := make([]ScenarioOverride, n)
+	for i := range out {
+		if i < len(resolutions) {
+			out[i].OutputRes = strings.TrimSpace(resolutions[i])
+		}
+		if i < len(aspects) {
+			out[i].AspectRatio = strings.TrimSpace(aspects[i])
+		}
+		if i < len(temps) {
+			out[i].Temperature = temps[i]
+		}
+	}
+	return out
+}
+
+// forScenario 返回应用了场景 id（从 1 开始）覆盖后的运行选项。
+func (o RunOptions) forScenario(id int) RunOptions {
+	if id < 1 || id > len(o.ScenarioOverrides) {
+		return o
+	}
+	ov := o.ScenarioOverrides[id-1]
+	if ov.OutputRes != "" {
+		o.OutputRes = ov.OutputRes
+	}
+	if ov.AspectRatio != "" {
+		o.AspectRatio = ov.AspectRatio
+	}
+	if ov.Temperature != nil {
+		o.Temperature = *ov.Temperature
+		o.TemperatureExplicit = true
+	}
+	return o
+}
+
+// setsTemperature 判断场景是否需要设置温度：温度大于 0，或显式指定（包括 0）。
+func (o RunOptions) setsTemperature() bool {
+	return o.Temperature > 0 || o.TemperatureExplicit
+}
+
+// normalizeAspectRatios 将顶层与逐场景覆盖的宽高比统一为 N:M 形式（见 steps.NormalizeAspectRatio），空值保持不变。
+// handler 与 RunWithOptions 共用，保证各入口接受的写法一致。
+func normalizeAspectRatios(opts *RunOptions) error {
+	if opts.AspectRatio != "" {
+		a, err := steps.NormalizeAspectRatio(opts.AspectRatio)
+		if err != nil {
+			return err
+		}
+		opts.AspectRatio = a
+	}
+	for i, ov := range opts.ScenarioOverrides {
+		if ov.AspectRatio == "" {
+			continue
+		}
+		a, err := steps.NormalizeAspectRatio(ov.AspectRatio)
+		if err != nil {
+			return fmt.Errorf("场景 %d: %w", i+1, err)
+		}
+		opts.ScenarioOverrides[i].AspectRatio = a
+	}
+	return nil
+}
+
+// aspectMismatchRatio 是参考图与请求宽高比之比超过该值时给出提示的阈值（如 4:3 对 1:1 为 1.33）
+const aspectMismatchRatio = 1.2
+
+// aspectMismatchWarning 比较参考图的宽高比与前 count 个场景请求的宽高比，相差较大时返回提示；
+// 读取图片尺寸失败时不提示。
+func aspectMismatchWarning(imagePath string, opts RunOptions, count int) string {
+	f, err := os.Open(imagePath)
+	if err != nil {
+		return ""
+	}
+	cfg, _, err := image.DecodeConfig(f)
+	f.Close()
+	if err != nil || cfg.Width <= 0 || cfg.Height <= 0 {
+		return ""
+	}
+	imageRatio := float64(cfg.Width) / float64(cfg.Height)
+	var mismatched []string
+	for id := 1; id <= count; id++ {
+		aspect := opts.forScenario(id).AspectRatio
+		w, h, ok := parseAspectRatio(aspect)
+		if !ok || slices.Contains(mismatched, aspect) {
+			continue
+		}
+		diff := imageRatio / (w / h)
+		if diff < 1 {
+			diff = 1 / diff
+		}
+		if diff > aspectMismatchRatio {
+			mismatched = append(mismatched, aspect)
+		}
+	}
+	if len(mismatched) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("参考图尺寸为 %dx%d（约 %.2f:1），与请求的宽高比 %s 相差较大，生成结果可能被裁切或变形", cfg.Width, cfg.Height, imageRatio, strings.Join(mismatched, ", "))
+}
+
+// parseAspectRatio 解析规范化后的 N:M 宽高比。
+func parseAspectRatio(aspect string) (float64, float64, bool) {
+	ws, hs, ok := strings.Cut(aspect, ":")
+	if !ok {
+		return 0, 0, false
+	}
+	w, werr := strconv.ParseFloat(ws, 64)
+	h, herr := strconv.ParseFloat(hs, 64)
+	if werr != nil || herr != nil || w <= 0 || h <= 0 {
+		return 0, 0, false
+	}
+	return w, h, true
+}
+
+// validateScenarioOverrides 校验覆盖数组不超过场景数，且每个场景与顶层设置合并后的组合有效。
+func validateScenarioOverrides(opts RunOptions) error {
+	if len(opts.ScenarioOverrides) > opts.ScenarioCount {
+		return fmt.Errorf("逐场景覆盖有 %d 项，超过场景数 %d", len(opts.ScenarioOverrides), opts.ScenarioCount)
+	}
+	for i := range opts.ScenarioOverrides {
+		merged := opts.forScenario(i + 1)
+		if err := validateTemperature(merged.Temperature); err != nil {
+			return fmt.Errorf("场景 %d: %w", i+1, err)
+		}
+		if err := validateResolutionAspect(merged.OutputRes, merged.AspectRatio); err != nil {
+			return fmt.Errorf("场景 %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// validateResolutionAspect 在启动浏览器前拒绝控制台不支持的分辨率/宽高比组合，空值表示使用默认值。
+func validateResolutionAspect(res, aspect string) error {
+	res, aspect = strings.ToUpper(strings.TrimSpace(res)), strings.TrimSpace(aspect)
+	if res == "" || aspect == "" {
+		return nil
+	}
+	allowed, ok := steps.ResolutionAspectRatios[res]
+	if !ok {
+		return fmt.Errorf("不支持的分辨率 %s（可选 %s）", res, strings.Join(steps.Resolutions, "、"))
+	}
+	for _, a := range allowed {
+		if a == aspect {
+			return nil
+		}
+	}
+	return fmt.Errorf("分辨率 %s 不支持宽高比 %s，可选：%s", res, aspect, strings.Join(allowed, ", "))
+}
+
+// displayAvailable 粗略判断当前环境能否显示有头浏览器窗口。
+func displayAvailable() bool {
+	switch runtime.GOOS {
+	case "windows", "darwin":
+		return true
+	default:
+		return os.Getenv("DISPLAY") != "" || os.Getenv("WAYLAND_DISPLAY") != ""
+	}
+}
+
+// validateTargetURL 确认目标地址是 Google 控制台页面，设置 ALLOW_ANY_TARGET=1 时跳过主机检查。
+func validateTargetURL(raw string) error {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return fmt.Errorf("targetUrl 无效: %w", err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return fmt.Errorf("targetUrl 必须是 http(s) 地址: %s", raw)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("targetUrl 缺少主机名: %s", raw)
+	}
+	if os.Getenv("ALLOW_ANY_TARGET") == "1" {
+		return nil
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, prefix := range allowedTargetHostPrefixes {
+		if strings.HasPrefix(host, prefix) && strings.HasSuffix(host, ".google.com") {
+			return nil
+		}
+	}
+	return fmt.Errorf("targetUrl 主机 %s 不是 Google 控制台（如需放行请设置 ALLOW_ANY_TARGET=1）", host)
+}
+
+// applyBrowserIdentity 设置 User-Agent、语言区域与时区；空值或无效时区保持引擎默认值。
+func applyBrowserIdentity(ctxOpts *playwright.BrowserNewContextOptions, opts RunOptions) {
+	if ua := strings.TrimSpace(opts.UserAgent); ua != "" {
+		ctxOpts.UserAgent = playwright.String(ua)
+	}
+	if locale := strings.TrimSpace(opts.Locale); locale != "" {
+		ctxOpts.Locale = playwright.String(locale)
+	}
+	if tz := strings.TrimSpace(opts.TimezoneID); tz != "" {
+		if _, err := time.LoadLocation(tz); err != nil {
+			fmt.Printf("⚠️ 时区 %q 无效，使用浏览器默认时区: %v\n", tz, err)
+		} else {
+			ctxOpts.TimezoneId = playwright.String(tz)
+		}
+	}
+}
+
 func proxyOptions(url string) *playwright.Proxy {
 	if url == "" {
 		return nil
@@ -204,97 +938,360 @@ func proxyOptions(url string) *playwright.Proxy {
 	}
 }
 
-func pickProxyEndpoints(ctx context.Context) []proxy.Endpoint {
-	// 使用 context.Background() 启动 sing-box，使其生命周期与应用程序保持一致，
-	// 而不是与单个请求的 context 绑定。这可以防止因为请求结束或取消
-	// (例如在 page.Goto 期间) 导致 sing-box 进程被提前终止。
-	processCtx := context.Background()
-	if endpoints, stop, err := proxy.StartSingBox(processCtx); err == nil && len(endpoints) > 0 {
-		fmt.Printf("🧭 使用 sing-box 代理，节点数：%d\n", len(endpoints))
-		if stop != nil {
-			go func() {
-				<-ctx.Done()
-				stop()
-			}()
+// ProxyStrategy 从可用节点中为 count 个场景选出代理，返回的切片长度不超过 count。
+type ProxyStrategy func(endpoints []proxy.Endpoint, count int) []proxy.Endpoint
+
+// OrderedProxyStrategy 按节点顺序（未冷却的在前）依次分配，是默认策略。
+func OrderedProxyStrategy(endpoints []proxy.Endpoint, count int) []proxy.Endpoint {
+	if count > len(endpoints) {
+		count = len(endpoints)
+	}
+	return append([]proxy.Endpoint(nil), endpoints[:count]...)
+}
+
+// SeededProxyStrategy 用固定种子打乱节点后分配，相同种子与节点列表得到相同结果，便于测试复现。
+func SeededProxyStrategy(seed int64) ProxyStrategy {
+	return func(endpoints []proxy.Endpoint, count int) []proxy.Endpoint {
+		shuffled := append([]proxy.Endpoint(nil), endpoints...)
+		rng := rand.New(rand.NewSource(seed))
+		rng.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		return OrderedProxyStrategy(shuffled, count)
+	}
+}
+
+// assignProxies 按策略为场景分配代理节点，策略为空时使用 OrderedProxyStrategy。
+// 不允许复用时保证同一节点只分配给一个场景（自定义策略返回的重复节点会被去掉）；
+// 允许复用且节点不足时，按顺序轮流复用节点补足 count 个场景。两种情况都会打印警告。
+func assignProxies(endpoints []proxy.Endpoint, count int, strategy ProxyStrategy, allowReuse bool) []proxy.Endpoint {
+	if len(endpoints) == 0 || count < 1 {
+		return nil
+	}
+	if strategy == nil {
+		strategy = OrderedProxyStrategy
+	}
+	assigned := strategy(endpoints, count)
+	if len(assigned) > count {
+		assigned = assigned[:count]
+	}
+	if !allowReuse {
+		seen := map[string]bool{}
+		unique := assigned[:0:0]
+		for _, ep := range assigned {
+			if seen[ep.Tag] {
+				fmt.Printf("⚠️ 代理策略将节点 %s 分配给了多个场景，已去重（PROXY_ALLOW_REUSE=1 可允许复用）\n", ep.Tag)
+				continue
+			}
+			seen[ep.Tag] = true
+			unique = append(unique, ep)
 		}
-		return endpoints
-	} else if err != nil {
-		fmt.Printf("⚠️ sing-box 启动失败，将直接直连：%v\n", err)
+		return unique
+	}
+	if n := len(assigned); n > 0 && n < count {
+		fmt.Printf("⚠️ 可用代理节点不足：%d 个场景轮流复用 %d 个节点，单个节点可能被限流\n", count, n)
+		for i := n; i < count; i++ {
+			assigned = append(assigned, assigned[i%n])
+		}
+	}
+	return assigned
+}
+
+// proxyStrategyFromEnv 读取 PROXY_STRATEGY（ordered/seeded）与 PROXY_SEED。
+func proxyStrategyFromEnv() ProxyStrategy {
+	switch strings.ToLower(strings.TrimSpace(os.Getenv("PROXY_STRATEGY"))) {
+	case "seeded", "random":
+		return SeededProxyStrategy(envInt64("PROXY_SEED", time.Now().UnixNano()))
+	default:
+		return nil
+	}
+}
+
+// pickProxyEndpoints 从共享代理池租用最多 want 个节点，返回空列表表示直连（未配置代理）。
+// 配置了代理但节点都被占用或被 exclude 排除时返回错误，不回退直连。
+// release 归还节点，必须在运行结束后调用。
+func pickProxyEndpoints(want int, requireProxy bool, exclude []string, strategy ProxyStrategy) ([]proxy.Endpoint, func(), error) {
+	if len(exclude) > 0 {
+		fmt.Printf("🚫 本次运行排除节点：%s\n", strings.Join(exclude, ", "))
+	}
+	endpoints, release, err := sharedProxyPool.acquire(want, exclude, strategy)
+	switch {
+	case err != nil:
+		return nil, release, err
+	case len(endpoints) > 0:
+		fmt.Printf("🧭 使用 sing-box 代理，分配节点数：%d\n", len(endpoints))
+	case requireProxy:
+		fmt.Println("⛔ 没有可用代理节点，REQUIRE_PROXY 已开启，拒绝直连")
+	default:
+		fmt.Println("🧭 未配置或未启用代理，直连运行")
+	}
+	return endpoints, release, nil
+}
+
+// scenarioRun 保存一个浏览器上下文的运行状态，供各步骤共享日志、进度回调与节点冻结逻辑。
+// 持久页面模式下同一个 scenarioRun 依次承载多个场景，id 随当前场景切换。
+type scenarioRun struct {
+	ctx       context.Context
+	id        int
+	opts      RunOptions
+	proxyTag  string
+	penalized bool
+	crashes   int64 // 开始时 sing-box 的累计崩溃次数，用于判断运行期间是否崩溃过
+	page      playwright.Page
+	applied   []string // 页面上已设置成功的 AdvancedSettings
+}
+
+// freeze 让节点进入软冷却（出图成功、配额耗尽或未完成时）。
+func (s *scenarioRun) freeze(reason string) {
+	if s.penalized || s.proxyTag == "" {
+		return
+	}
+	if err := proxy.FreezeEndpoint(s.proxyTag); err != nil {
+		fmt.Printf("⚠️ [%d] 记录节点冻结失败(%s): %v\n", s.id, reason, err)
+		return
+	}
+	s.penalized = true
+}
+
+// quotaFreeze 按配额类型冻结节点：soft 只短暂冷却，hard 直接硬冻结，unknown 按普通冷却处理。
+func (s *scenarioRun) quotaFreeze(kind steps.QuotaKind) {
+	if s.penalized || s.proxyTag == "" {
+		return
+	}
+	var err error
+	switch kind {
+	case steps.QuotaSoft:
+		err = proxy.FreezeEndpointFor(s.proxyTag, s.opts.QuotaSoftFreeze)
+	case steps.QuotaHard:
+		err = proxy.HardFreezeEndpoint(s.proxyTag, s.opts.QuotaHardFreeze)
+	default:
+		err = proxy.FreezeEndpoint(s.proxyTag)
+	}
+	if err != nil {
+		fmt.Printf("⚠️ [%d] 记录节点冻结失败(exhausted/%s): %v\n", s.id, kind, err)
+		return
+	}
+	s.penalized = true
+}
+
+// regionBlocked 硬冻结地区不受支持的节点，直连时无节点可冻结。
+func (s *scenarioRun) regionBlocked() {
+	if s.penalized || s.proxyTag == "" {
+		return
+	}
+	if err := proxy.HardFreezeEndpoint(s.proxyTag, s.opts.RegionFreeze); err != nil {
+		fmt.Printf("⚠️ [%d] 记录节点冻结失败(region): %v\n", s.id, err)
+		return
+	}
+	s.penalized = true
+}
+
+// penalize 记录一次节点失败，连续失败过多的节点会被硬冻结。
+func (s *scenarioRun) penalize(reason string) {
+	if s.penalized || s.proxyTag == "" {
+		return
+	}
+	if err := proxy.PenalizeEndpoint(s.proxyTag); err != nil {
+		fmt.Printf("⚠️ [%d] 记录节点失败(%s): %v\n", s.id, reason, err)
+		return
+	}
+	s.penalized = true
+}
+
+func (s *scenarioRun) fail(res ScenarioResult, reason string, err error) (ScenarioResult, error) {
+	if err == nil {
+		err = fmt.Errorf(reason)
+	}
+	if s.ctx.Err() != nil {
+		// 运行被取消不是节点的问题，只做冷却
+		res.ErrorCode = ErrorCodeCancelled
+		s.freeze(reason)
+	} else if s.proxyTag != "" && (proxy.SingBoxDead() || proxy.SingBoxCrashes() != s.crashes) {
+		// sing-box 进程崩溃导致的失败不是节点的问题，不冻结节点；崩溃后已自动重启的也算在内
+		fmt.Printf("⚠️ [%d] sing-box 进程已退出，%s 失败不计入节点 %s\n", s.id, reason, s.proxyTag)
+		res.ErrorCode = ErrorCodeProxyDown
+	} else {
+		s.penalize(reason)
+	}
+	if s.opts.KeepOpenOnFailure && !s.opts.Headless && s.page != nil {
+		pauseForInspection(s.ctx, s.id, reason, s.opts.KeepOpenTimeout)
+	}
+	return res, err
+}
+
+func (s *scenarioRun) report(name, status, msg string) {
+	if s.opts.OnProgress != nil {
+		s.opts.OnProgress(ProgressEvent{Scenario: s.id, Step: name, Status: status, Message: msg})
 	}
-	fmt.Println("🧭 未配置或未启用代理，直连运行")
-	return nil
+}
+
+// optionalStep 与 step 相同，但步骤在 SkipSteps 中时直接跳过。
+func (s *scenarioRun) optionalStep(key, name string, pause time.Duration, fn func() (bool, error)) error {
+	if s.skip(key, name) {
+		return nil
+	}
+	return s.step(name, pause, fn)
+}
+
+// skip 判断步骤是否在 SkipSteps 中，是则记录并推送跳过进度。
+func (s *scenarioRun) skip(key, name string) bool {
+	for _, k := range s.opts.SkipSteps {
+		if k == key {
+			fmt.Printf("⏭️ [%d] %s skipped (SkipSteps)\n", s.id, name)
+			s.report(name, progressSkipped, "SkipSteps")
+			return true
+		}
+	}
+	return false
+}
+
+func (s *scenarioRun) step(name string, pause time.Duration, fn func() (bool, error)) error {
+	id := s.id
+	// 取消后不再开始新步骤，避免 /cancel 要等到下一次 ctx 检查
+	if err := s.ctx.Err(); err != nil {
+		s.report(name, progressFailed, err.Error())
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	s.report(name, progressStarted, "")
+	ok, err := fn()
+	switch {
+	case err != nil:
+		fmt.Printf("⚠️ [%d] %s error: %v\n", id, name, err)
+		s.report(name, progressFailed, err.Error())
+		return fmt.Errorf("%s: %w", name, err)
+	case !ok:
+		fmt.Printf("⚠️ [%d] %s not completed\n", id, name)
+		s.report(name, progressFailed, "not completed")
+		return fmt.Errorf("%s not completed", name)
+	default:
+		fmt.Printf("✅ [%d] %s\n", id, name)
+		s.report(name, progressDone, "")
+		select {
+		case <-s.ctx.Done():
+		case <-time.After(pause):
+		}
+		return nil
+	}
+}
+
+func newScenarioResult(id int, proxyTag string, opts RunOptions) ScenarioResult {
+	return ScenarioResult{ID: id, Outcome: steps.DownloadOutcomeNone, ProxyTag: proxyTag, Proxied: proxyTag != "", OutputRes: opts.OutputRes, AspectRatio: opts.AspectRatio}
 }
 
 func runScenario(ctx context.Context, browser playwright.Browser, viewport playwright.Size, engineName, proxyURL, proxyTag string, id int, opts RunOptions, batchFolder string) (ScenarioResult, error) {
-	res := ScenarioResult{ID: id, Outcome: steps.DownloadOutcomeNone, ProxyTag: proxyTag, OutputRes: opts.OutputRes, AspectRatio: opts.AspectRatio}
+	if id <= len(opts.ScenarioOverrides) {
+		opts = opts.forScenario(id)
+		fmt.Printf("🎛️ [%d] 场景覆盖：res=%s aspect=%s temp=%.1f\n", id, opts.OutputRes, opts.AspectRatio, opts.Temperature)
+	}
+	res := newScenarioResult(id, proxyTag, opts)
 	if err := ctx.Err(); err != nil {
+		res.ErrorCode = ErrorCodeCancelled
 		return res, err
 	}
-	penalized := false
-	freeze := func(reason string) {
-		if penalized || res.ProxyTag == "" {
-			return
-		}
-		if err := proxy.FreezeEndpoint(res.ProxyTag); err != nil {
-			fmt.Printf("⚠️ [%d] 记录节点冻结失败(%s): %v\n", id, reason, err)
-			return
-		}
-		penalized = true
+	s := &scenarioRun{ctx: ctx, id: id, opts: opts, proxyTag: proxyTag, crashes: proxy.SingBoxCrashes()}
+	defer s.freeze("defer")
+
+	closePage, reason, err := s.openPage(browser, viewport, proxyURL)
+	if err != nil {
+		return s.fail(res, reason, err)
 	}
-	fail := func(reason string, err error) (ScenarioResult, error) {
-		if err == nil {
-			err = fmt.Errorf(reason)
-		}
-		freeze(reason)
+	defer closePage()
+
+	if res, err = s.preparePage(res, engineName, proxyURL); err != nil {
 		return res, err
 	}
-	defer freeze("defer")
+	res, err = s.generateWithSafety(res, batchFolder, 0)
+	if err == nil {
+		fmt.Printf("🛑 [%d] Flow done, closing context\n", id)
+	}
+	return res, err
+}
 
-	step := func(name string, pause time.Duration, fn func() (bool, error)) error {
-		ok, err := fn()
-		switch {
-		case err != nil:
-			fmt.Printf("⚠️ [%d] %s error: %v\n", id, name, err)
-			return fmt.Errorf("%s: %w", name, err)
-		case !ok:
-			fmt.Printf("⚠️ [%d] %s not completed\n", id, name)
-			return fmt.Errorf("%s not completed", name)
-		default:
-			fmt.Printf("✅ [%d] %s\n", id, name)
-			time.Sleep(pause)
-			return nil
+// runPersistentScenarios 只打开一次页面并完成导航与模型设置，随后在同一页面上
+// 依次为每个场景重新输入提示词、提交并下载，省去重复的导航与设置。
+// 任一场景失败后停止后续场景（页面状态已不可信）。
+func runPersistentScenarios(ctx context.Context, browser playwright.Browser, viewport playwright.Size, engineName, proxyURL, proxyTag string, count int, opts RunOptions, batchFolder string) ([]ScenarioResult, error) {
+	s := &scenarioRun{ctx: ctx, id: 1, opts: opts, proxyTag: proxyTag, crashes: proxy.SingBoxCrashes()}
+	defer s.freeze("defer")
+
+	res := newScenarioResult(1, proxyTag, opts)
+	closePage, reason, err := s.openPage(browser, viewport, proxyURL)
+	if err != nil {
+		res, err = s.fail(res, reason, err)
+		res.Error = err.Error()
+		return []ScenarioResult{res}, err
+	}
+	defer closePage()
+
+	if res, err = s.preparePage(res, engineName, proxyURL); err != nil {
+		res.Error = err.Error()
+		return []ScenarioResult{res}, err
+	}
+
+	var results []ScenarioResult
+	for id := 1; id <= count; id++ {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		s.id = id
+		if id > 1 {
+			res = newScenarioResult(id, proxyTag, opts)
+			res.AppliedSettings = s.applied
+			fmt.Printf("🔁 [%d] 复用已打开的页面继续生成\n", id)
+		}
+		seen := steps.CountDownloadButtons(s.page)
+		res, err = s.generateWithSafety(res, batchFolder, seen)
+		if err != nil {
+			res.Error = err.Error()
+			results = append(results, res)
+			return results, fmt.Errorf("scenario %d: %w", id, err)
+		}
+		results = append(results, res)
+		if res.Outcome == steps.DownloadOutcomeExhausted {
+			fmt.Printf("⚠️ [%d] 配额耗尽，停止持久页面中的后续场景\n", id)
+			break
 		}
 	}
+	fmt.Printf("🛑 [%d] Persistent flow done, closing context\n", s.id)
+	return results, nil
+}
 
+// openPage 创建浏览器上下文（含代理与追踪）并打开页面，返回的清理函数负责保存追踪并关闭上下文。
+// 出错时额外返回失败原因，供 fail 记录。
+func (s *scenarioRun) openPage(browser playwright.Browser, viewport playwright.Size, proxyURL string) (func(), string, error) {
+	id := s.id
 	ctxOpts := playwright.BrowserNewContextOptions{
 		Viewport: &viewport,
 	}
 	if proxyURL != "" {
 		ctxOpts.Proxy = proxyOptions(proxyURL)
 	}
+	applyBrowserIdentity(&ctxOpts, s.opts)
 	browserCtx, err := browser.NewContext(ctxOpts)
 	if err != nil {
-		return fail("new context", fmt.Errorf("new context: %w", err))
+		return nil, "new context", fmt.Errorf("new context: %w", err)
 	}
 
-	traceDir := filepath.Join(opts.DownloadDir, "traces")
-	if err := os.MkdirAll(traceDir, 0o755); err != nil {
-		return fail("create trace dir", fmt.Errorf("create trace dir: %w", err))
+	traceDir := filepath.Join(s.opts.DownloadDir, traceDirName)
+	// 文件名带时间戳，避免各次运行的同号场景互相覆盖；旧文件由 pruneTraces 清理
+	traceName := fmt.Sprintf("trace_%s_%d.zip", time.Now().Format("20060102_150405"), id)
+	if err := os.MkdirAll(traceDir, fsperm.Dir()); err != nil {
+		_ = browserCtx.Close()
+		return nil, "create trace dir", fmt.Errorf("create trace dir: %w", err)
 	}
 
 	// Start tracing
 	if err := browserCtx.Tracing().Start(playwright.TracingStartOptions{
-		Name:        playwright.String(fmt.Sprintf("trace_%d.zip", id)),
+		Name:        playwright.String(traceName),
 		Screenshots: playwright.Bool(true),
 		Snapshots:   playwright.Bool(true),
 		Sources:     playwright.Bool(true),
 	}); err != nil {
-		return fail("start tracing", fmt.Errorf("start tracing: %w", err))
+		_ = browserCtx.Close()
+		return nil, "start tracing", fmt.Errorf("start tracing: %w", err)
 	}
 
-	defer func() {
+	closeCtx := func() {
 		// Stop tracing and save the trace file.
-		traceFilePath := filepath.Join(traceDir, fmt.Sprintf("trace_%d.zip", id))
+		traceFilePath := filepath.Join(traceDir, traceName)
 		if err := browserCtx.Tracing().Stop(traceFilePath); err != nil {
 			fmt.Printf("⚠️ [%d] failed to stop tracing: %v\n", id, err)
 		} else {
@@ -304,31 +1301,76 @@ func runScenario(ctx context.Context, browser playwright.Browser, viewport playw
 		if err := browserCtx.Close(); err != nil {
 			fmt.Printf("⚠️ [%d] failed to close context: %v\n", id, err)
 		}
-	}()
+	}
 
 	page, err := browserCtx.NewPage()
 	if err != nil {
-		return fail("new page", fmt.Errorf("new page: %w", err))
+		closeCtx()
+		return nil, "new page", fmt.Errorf("new page: %w", err)
 	}
+	s.page = page
+	return closeCtx, "", nil
+}
 
-	proxyInfo := proxyTag
+// preparePage 导航到目标页并完成条款、Cookie 与模型参数设置。
+func (s *scenarioRun) preparePage(res ScenarioResult, engineName, proxyURL string) (ScenarioResult, error) {
+	ctx, id, opts, page := s.ctx, s.id, s.opts, s.page
+	proxyInfo := s.proxyTag
 	if proxyInfo == "" && proxyURL != "" {
 		proxyInfo = proxyURL
 	}
 	fmt.Printf("\n🚀 [%d] Starting (engine=%s headless=%v proxy=%s)\n", id, engineName, opts.Headless, proxyInfo)
 	fmt.Printf("🔎 [%d] Navigating to %s\n", id, opts.TargetURL)
+	s.report("Navigate", progressStarted, opts.TargetURL)
 
-	_, err = page.Goto(opts.TargetURL, playwright.PageGotoOptions{
-		WaitUntil: playwright.WaitUntilStateDomcontentloaded,
-		Timeout:   playwright.Float(30_000),
-	})
+	// 慢代理首次导航经常超时，重试往往能成功；多次失败后冻结节点
+	var err error
+	for attempt := 1; attempt <= opts.GotoAttempts; attempt++ {
+		_, err = page.Goto(opts.TargetURL, playwright.PageGotoOptions{
+			WaitUntil: playwright.WaitUntilStateDomcontentloaded,
+			Timeout:   playwright.Float(float64(opts.GotoTimeout.Milliseconds())),
+		})
+		if err == nil {
+			break
+		}
+		fmt.Printf("⚠️ [%d] goto attempt %d/%d error: %v\n", id, attempt, opts.GotoAttempts, err)
+		if attempt < opts.GotoAttempts {
+			select {
+			case <-ctx.Done():
+				return s.fail(res, "goto", ctx.Err())
+			case <-time.After(time.Duration(attempt) * 2 * time.Second):
+			}
+		}
+	}
 	if err != nil {
-		fmt.Printf("⚠️ [%d] goto error: %v\n", id, err)
-		return fail("goto", err)
+		s.report("Navigate", progressFailed, err.Error())
+		if s.proxyTag != "" {
+			res.ErrorCode = ErrorCodeProxy
+		}
+		return s.fail(res, "goto", fmt.Errorf("goto failed after %d attempts: %w", opts.GotoAttempts, err))
 	}
+	s.report("Navigate", progressDone, "")
 	fmt.Printf("✅ [%d] URL after goto: %s\n", id, page.URL())
 	_ = page.WaitForLoadState(playwright.PageWaitForLoadStateOptions{State: playwright.LoadStateDomcontentloaded})
-	_ = page.WaitForLoadState(playwright.PageWaitForLoadStateOptions{State: playwright.LoadStateNetworkidle})
+	if opts.WaitNetworkIdle {
+		start := time.Now()
+		err := page.WaitForLoadState(playwright.PageWaitForLoadStateOptions{
+			State:   playwright.LoadStateNetworkidle,
+			Timeout: playwright.Float(float64(opts.NetworkIdleTimeout.Milliseconds())),
+		})
+		if err != nil {
+			fmt.Printf("⏱️ [%d] networkidle 未在 %s 内触发，继续执行\n", id, opts.NetworkIdleTimeout)
+		} else {
+			fmt.Printf("⏱️ [%d] networkidle 等待耗时 %s\n", id, time.Since(start).Round(time.Millisecond))
+		}
+	}
+
+	if blocked, msg := steps.DetectRegionBlock(page); blocked {
+		s.report("Navigate", progressFailed, msg)
+		res.ErrorCode = ErrorCodeRegion
+		s.regionBlocked()
+		return s.fail(res, "region", fmt.Errorf("当前出口地区不支持 Vertex Studio: %q", msg))
+	}
 
 	_ = page.BringToFront()
 	fmt.Printf("ℹ️ [%d] Brought page to front\n", id)
@@ -336,79 +1378,121 @@ func runScenario(ctx context.Context, browser playwright.Browser, viewport playw
 	_ = page.Keyboard().Press("Escape")
 	time.Sleep(opts.SubStepPause)
 
-	if err := step("Accept terms dialog", opts.StepPause, func() (bool, error) {
-		return steps.AcceptTermsBlocking(page, 45*time.Second)
+	if err := s.optionalStep(StepTerms, "Accept terms dialog", opts.StepPause, func() (bool, error) {
+		timeout := opts.TermsTimeout
+		if timeout <= 0 {
+			timeout = 45 * time.Second
+		}
+		outcome, err := steps.AcceptTermsWithOptions(s.ctx, page, steps.TermsOptions{
+			Timeout:    timeout,
+			AppearWait: opts.TermsAppearWait,
+			Optional:   opts.TermsOptional,
+		})
+		if outcome == steps.TermsAbsent {
+			fmt.Printf("ℹ️ [%d] 未出现使用条款弹窗，视为已接受\n", s.id)
+		}
+		return err == nil, err
 	}); err != nil {
-		return fail("accept terms", err)
+		return s.fail(res, "accept terms", err)
 	}
 
-	if ok, err := steps.AcceptCookieBar(page); err != nil {
-		return fail("accept cookies bar", err)
-	} else if ok {
-		fmt.Printf("✅ [%d] Accept cookies bar\n", id)
-		time.Sleep(opts.StepPause)
-	} else {
-		fmt.Printf("ℹ️ [%d] Cookies bar not present, skipping\n", id)
+	if !s.skip(StepCookies, "Accept cookies bar") {
+		if ok, err := steps.AcceptCookieBar(page); err != nil {
+			return s.fail(res, "accept cookies bar", err)
+		} else if ok {
+			fmt.Printf("✅ [%d] Accept cookies bar\n", id)
+			s.report("Accept cookies bar", progressDone, "")
+			time.Sleep(opts.StepPause)
+		} else {
+			fmt.Printf("ℹ️ [%d] Cookies bar not present, skipping\n", id)
+			s.report("Accept cookies bar", progressSkipped, "")
+		}
 	}
 
-	if err := step("Open model settings", opts.StepPause, func() (bool, error) { return steps.OpenModelSettings(page) }); err != nil {
-		return fail("open model settings", err)
+	if err := s.optionalStep(StepModelSettings, "Open model settings", opts.StepPause, func() (bool, error) { return steps.OpenModelSettings(page) }); err != nil {
+		return s.fail(res, "open model settings", err)
 	}
 
-	if err := step(fmt.Sprintf("Set output resolution to %s", opts.OutputRes), opts.StepPause, func() (bool, error) {
+	if err := s.optionalStep(StepResolution, fmt.Sprintf("Set output resolution to %s", opts.OutputRes), opts.StepPause, func() (bool, error) {
 		return steps.SetOutputResolution(page, opts.OutputRes)
 	}); err != nil {
-		return fail("set output resolution", err)
+		return s.fail(res, "set output resolution", err)
 	}
 
-	if err := step(fmt.Sprintf("Set aspect ratio to %s", opts.AspectRatio), opts.StepPause, func() (bool, error) {
+	if err := s.optionalStep(StepAspectRatio, fmt.Sprintf("Set aspect ratio to %s", opts.AspectRatio), opts.StepPause, func() (bool, error) {
 		return steps.SetAspectRatio(page, opts.AspectRatio)
 	}); err != nil {
-		return fail("set aspect ratio", err)
+		return s.fail(res, "set aspect ratio", err)
 	}
 
-	if opts.Temperature > 0 {
-		if err := step(fmt.Sprintf("Set temperature to %.1f", opts.Temperature), opts.StepPause, func() (bool, error) {
+	if opts.setsTemperature() {
+		if err := s.optionalStep(StepTemperature, fmt.Sprintf("Set temperature to %.1f", opts.Temperature), opts.StepPause, func() (bool, error) {
 			return steps.SetTemperature(page, opts.Temperature)
 		}); err != nil {
-			return fail("set temperature", err)
+			return s.fail(res, "set temperature", err)
 		}
 	} else {
 		fmt.Printf("ℹ️ [%d] Skipping temperature setting (not provided)\n", id)
 	}
 
-	if err := step("Enter prompt text", opts.StepPause, func() (bool, error) {
+	if len(opts.AdvancedSettings) > 0 && !s.skip(StepAdvancedSettings, "Apply advanced settings") {
+		s.report("Apply advanced settings", progressStarted, "")
+		s.applied = steps.ApplyAdvancedSettings(page, opts.AdvancedSettings)
+		res.AppliedSettings = s.applied
+		s.report("Apply advanced settings", progressDone, fmt.Sprintf("%d/%d", len(s.applied), len(opts.AdvancedSettings)))
+		time.Sleep(opts.StepPause)
+	}
+	return res, nil
+}
+
+// generate 在已准备好的页面上输入提示词、上传图片、提交并下载结果。
+// seenDownloads 是提交前页面上已有的下载按钮数量，持久页面模式下用于跳过之前场景的结果。
+func (s *scenarioRun) generate(res ScenarioResult, batchFolder string, seenDownloads int) (ScenarioResult, error) {
+	ctx, id, opts, page := s.ctx, s.id, s.opts, s.page
+	if err := s.step("Enter prompt text", opts.StepPause, func() (bool, error) {
 		return steps.EnterPrompt(page, opts.PromptText)
 	}); err != nil {
-		return fail("prompt input failed", err)
+		return s.fail(res, "prompt input failed", err)
 	}
 	length := promptLength(page)
 	fmt.Printf("ℹ️ [%d] Prompt length after entry: %d chars\n", id, length)
 	if length == 0 {
-		return fail("prompt is empty after entry", fmt.Errorf("prompt is empty after entry"))
+		return s.fail(res, "prompt is empty after entry", fmt.Errorf("prompt is empty after entry"))
 	}
 
 	// 只有当ImagePath不为空时才上传图片
 	if opts.ImagePath != "" {
-		if err := step("Upload local image", opts.StepPause, func() (bool, error) {
+		if err := s.step("Upload local image", opts.StepPause, func() (bool, error) {
 			return steps.UploadLocalFile(page, opts.ImagePath)
 		}); err != nil {
-			return fail("upload failed", err)
+			return s.fail(res, "upload failed", err)
+		}
+		if info, err := os.Stat(opts.ImagePath); err == nil {
+			res.UploadBytes = info.Size()
 		}
 	} else {
 		fmt.Printf("ℹ️ [%d] No image provided, skipping upload\n", id)
 		time.Sleep(opts.StepPause)
 	}
 
-	if err := step("Submit prompt", opts.StepPause, func() (bool, error) { return steps.SubmitPrompt(page) }); err != nil {
-		return fail("submit prompt failed", err)
+	if err := s.step("Submit prompt", opts.StepPause, func() (bool, error) { return steps.SubmitPrompt(page) }); err != nil {
+		return s.fail(res, "submit prompt failed", err)
 	}
 
 	if err := ctx.Err(); err != nil {
-		return fail("context done", err)
+		return s.fail(res, "context done", err)
 	}
 
 	outDir := filepath.Join(opts.DownloadDir, batchFolder)
+	nameSuffix := ""
+	if s.proxyTag != "" {
+		switch opts.ProxyTagOutput {
+		case ProxyTagOutputFolder:
+			outDir = filepath.Join(outDir, proxyTagSegment(s.proxyTag))
+		case ProxyTagOutputFilename:
+			nameSuffix = "_" + proxyTagSegment(s.proxyTag)
+		}
+	}
 
 	// 为图片下载步骤创建一个独立的超时上下文。
 	// 这可以防止在点击提交后，因后端长时间无响应而导致进程无限期卡住。
@@ -416,30 +1500,174 @@ func runScenario(ctx context.Context, browser playwright.Browser, viewport playw
 	downloadCtx, cancel := context.WithTimeout(ctx, 90*time.Second)
 	defer cancel()
 
-	outcome, path, err := steps.DownloadImage(downloadCtx, page, outDir, 720*time.Second)
+	s.report("Download image", progressStarted, "")
+	lastReport := time.Time{}
+	waitOpts := steps.DownloadWaitOptions{
+		MaxWait:      720 * time.Second,
+		PollInterval: opts.DownloadPollInterval,
+		Seen:         seenDownloads,
+		NameSuffix:   nameSuffix,
+		OnProgress: func(p steps.DownloadProgress) {
+			// 生成中每 5 秒推送一次，避免刷屏
+			if p.State == steps.DownloadStateGenerating && time.Since(lastReport) < 5*time.Second {
+				return
+			}
+			lastReport = time.Now()
+			s.report("Download image", progressRunning, fmt.Sprintf("%s %ds", p.State, int(p.Elapsed.Seconds())))
+		},
+	}
+	var (
+		download steps.DownloadResult
+		err      error
+	)
+	// 只重试下载阶段（不重新提交提示词），用于点击下载偶发失败等瞬时错误
+	for attempt := 0; ; attempt++ {
+		download, err = steps.DownloadImageDetailed(downloadCtx, page, outDir, waitOpts)
+		if err == nil || downloadCtx.Err() != nil || attempt >= opts.DownloadRetries {
+			break
+		}
+		fmt.Printf("⚠️ [%d] 下载失败，重试下载 (%d/%d): %v\n", id, attempt+1, opts.DownloadRetries, err)
+		time.Sleep(opts.SubStepPause)
+	}
+	outcome, path := download.Outcome, download.Path
 	res.Outcome = outcome
 	res.Path = path
+	res.Timeout = download.Timeout
 	if path != "" {
-		res.URL = "/" + filepath.ToSlash(path)
+		if rel, err := filepath.Rel(opts.DownloadDir, path); err == nil {
+			res.URL = galleryURL(rel)
+		}
 	}
 	if err != nil {
-		return fail("download", fmt.Errorf("download: %w", err))
+		s.report("Download image", progressFailed, err.Error())
+		return s.fail(res, "download", fmt.Errorf("download: %w", err))
 	}
+	s.report("Download image", progressDone, string(outcome))
 	switch outcome {
 	case steps.DownloadOutcomeDownloaded:
 		fmt.Printf("✅ [%d] Downloaded image\n", id)
-		freeze("downloaded")
+		// 先缩小再校验与写元数据：重新编码会丢弃已写入的文本块
+		if opts.MaxSaveDimension > 0 {
+			downscaleDownloadedImage(&res, opts.MaxSaveDimension)
+		}
+		if opts.VerifyImage {
+			verifyDownloadedImage(&res, opts.ImagePath)
+		}
+		if opts.EmbedMetadata {
+			embedRunMetadata(res, opts)
+		}
+		if info, err := os.Stat(path); err == nil {
+			res.Bytes = info.Size()
+		}
+		s.freeze("downloaded")
+	case steps.DownloadOutcomeBlocked:
+		// 安全拦截与节点无关，只做普通冷却
+		res.SafetyReason = download.BlockReason
+		res.ErrorCode = ErrorCodeSafety
+		s.freeze("blocked")
+		fmt.Printf("⛔ [%d] 提示词被安全过滤拦截: %s\n", id, download.BlockReason)
+		if download.BlockReason != "" {
+			return res, fmt.Errorf("%w: %s", errSafetyBlocked, download.BlockReason)
+		}
+		return res, errSafetyBlocked
 	case steps.DownloadOutcomeExhausted:
-		fmt.Printf("⚠️ [%d] Resource exhausted (429/quota)\n", id)
-		freeze("exhausted")
+		res.QuotaKind = steps.DetectQuotaKind(page)
+		fmt.Printf("⚠️ [%d] Resource exhausted (429/quota, %s)\n", id, res.QuotaKind)
+		s.quotaFreeze(res.QuotaKind)
 	default:
-		fmt.Printf("ℹ️ [%d] Download not completed\n", id)
+		switch res.Timeout {
+		case steps.DownloadTimeoutGenerating:
+			fmt.Printf("ℹ️ [%d] Download not completed: 超时时仍在生成，后端较慢，可延长等待\n", id)
+		case steps.DownloadTimeoutNotStarted:
+			fmt.Printf("ℹ️ [%d] Download not completed: 始终未开始生成，提交可能未成功\n", id)
+		default:
+			fmt.Printf("ℹ️ [%d] Download not completed\n", id)
+		}
 	}
-
-	fmt.Printf("🛑 [%d] Flow done, closing context\n", id)
 	return res, nil
 }
 
+// PNG 内嵌文本块使用的关键字
+const (
+	metaKeyPrompt   = "prompt"
+	metaKeySettings = "vertex-settings"
+	metaKeySoftware = "Software"
+)
+
+// embedRunMetadata 将提示词与生成参数写入下载图片，使图片自描述。
+// 写入失败只记录日志，不影响场景结果。
+func embedRunMetadata(res ScenarioResult, opts RunOptions) {
+	settings, _ := json.Marshal(map[string]any{
+		"outputRes":   opts.OutputRes,
+		"aspectRatio": opts.AspectRatio,
+		"temperature": opts.Temperature,
+		"proxyTag":    res.ProxyTag,
+		"createdAt":   time.Now().Format(time.RFC3339),
+	})
+	fields := map[string]string{
+		metaKeyPrompt:   opts.PromptText,
+		metaKeySettings: string(settings),
+		metaKeySoftware: "vertex-nano-banana-unlimited",
+	}
+	if err := imageprocessing.EmbedPNGText(res.Path, fields); err != nil {
+		fmt.Printf("⚠️ [%d] 写入图片元数据失败: %v\n", res.ID, err)
+	}
+}
+
+// downscaleDownloadedImage 将下载图片的最长边限制在 maxSide 以内并记录前后尺寸。
+// 失败只记录日志，保留原图，不影响场景结果。
+func downscaleDownloadedImage(res *ScenarioResult, maxSide int) {
+	orig, saved, err := imageprocessing.CapLongestSide(res.Path, maxSide)
+	if err != nil {
+		fmt.Printf("⚠️ [%d] 缩小图片失败，保留原图: %v\n", res.ID, err)
+		return
+	}
+	res.OriginalSize, res.SavedSize = &orig, &saved
+	if saved != orig {
+		fmt.Printf("📐 [%d] 图片已缩小 %dx%d → %dx%d\n", res.ID, orig.Width, orig.Height, saved.Width, saved.Height)
+	}
+}
+
+// verifyDownloadedImage 计算下载图片的平均哈希，近乎空白或与参考图相同时将结果标记为可疑。
+func verifyDownloadedImage(res *ScenarioResult, referencePath string) {
+	fp, err := imageprocessing.FingerprintFile(res.Path)
+	if err != nil {
+		fmt.Printf("⚠️ [%d] 计算图片哈希失败: %v\n", res.ID, err)
+		return
+	}
+	res.ImageHash = fp.HexHash()
+	switch {
+	case fp.StdDev < blankStdDevThreshold:
+		res.Suspicious = "blank"
+	case referencePath != "":
+		ref, err := imageprocessing.FingerprintFile(referencePath)
+		if err != nil {
+			fmt.Printf("⚠️ [%d] 计算参考图哈希失败: %v\n", res.ID, err)
+			return
+		}
+		if imageprocessing.HashDistance(fp.Hash, ref.Hash) <= duplicateHashThreshold {
+			res.Suspicious = "same-as-reference"
+		}
+	}
+	if res.Suspicious != "" {
+		res.Outcome = OutcomeSuspicious
+		fmt.Printf("⚠️ [%d] 下载的图片疑似生成失败(%s)，hash=%s\n", res.ID, res.Suspicious, res.ImageHash)
+	}
+}
+
+// pauseForInspection 在失败后保持浏览器打开，直到运行被取消（如 POST /cancel）或超时。
+func pauseForInspection(ctx context.Context, id int, reason string, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = 10 * time.Minute
+	}
+	fmt.Printf("⏸️ [%d] 步骤失败(%s)，浏览器保持打开 %s 以便调试；调用 /cancel 可提前关闭\n", id, reason, timeout)
+	select {
+	case <-ctx.Done():
+	case <-time.After(timeout):
+	}
+	fmt.Printf("▶️ [%d] 调试暂停结束，关闭浏览器上下文\n", id)
+}
+
 func promptLength(page playwright.Page) int {
 	loc := page.Locator("ai-llm-prompt-input-box textarea, ai-llm-prompt-input-box [role=\"textbox\"], ai-llm-prompt-input-box [contenteditable=\"true\"]").First()
 	val, _ := loc.InputValue()
@@ -449,6 +1677,60 @@ func promptLength(page playwright.Page) int {
 	return len(val)
 }
 
+// batchNameFromSource 从原始文件名、本地路径或图片 URL 的最后一段提取不含扩展名的名称。
+func batchNameFromSource(src string) string {
+	src = strings.TrimSpace(src)
+	if src == "" {
+		return ""
+	}
+	base := ""
+	if u, err := url.Parse(src); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		base = path.Base(u.Path)
+	} else {
+		base = filepath.Base(strings.ReplaceAll(src, `\`, "/"))
+	}
+	if base == "." || base == "/" {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimSuffix(base, filepath.Ext(base)))
+}
+
+// batchFolderName 选择批次文件夹名：优先用原始文件名，其次用本地图片文件名，
+// 都不可用（为空或只剩点号，如 "..png"）时生成 text-only-/batch- 加时间戳的名称。
+func batchFolderName(opts RunOptions, now time.Time) string {
+	candidates := []string{batchNameFromSource(opts.SourceName)}
+	if opts.ImagePath != "" {
+		candidates = append(candidates, strings.TrimSuffix(filepath.Base(opts.ImagePath), filepath.Ext(opts.ImagePath)))
+	}
+	for _, name := range candidates {
+		if name == "" {
+			continue
+		}
+		// 只由点号组成的名称（"." 或 ".."）拼接后会指向下载目录本身或其上级
+		if seg := sanitizeSegment(name); strings.Trim(seg, ".") != "" {
+			return seg
+		}
+	}
+	if opts.ImagePath == "" {
+		return fmt.Sprintf("text-only-%d", now.Unix())
+	}
+	return fmt.Sprintf("batch-%d", now.Unix())
+}
+
+// withinDir 判断 path 是否位于 dir 之内（两者都按绝对路径比较，path 等于 dir 时也不算在内）。
+func withinDir(dir, path string) bool {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(absDir, absPath)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
 func sanitizeSegment(name string) string {
 	if name == "" {
 		return "output"
@@ -464,7 +1746,28 @@ func sanitizeSegment(name string) string {
 	return name
 }
 
+// ProxyTagOutput 的可选值
+const (
+	ProxyTagOutputFolder   = "folder"
+	ProxyTagOutputFilename = "filename"
+)
+
+// proxyTagSegment 将节点 tag 转为可用于路径的片段，空白替换为下划线。
+func proxyTagSegment(tag string) string {
+	seg := strings.Join(strings.Fields(sanitizeSegment(tag)), "_")
+	if strings.Trim(seg, ".") == "" {
+		return "proxy"
+	}
+	return seg
+}
+
 var (
+	// allowedTargetHostPrefixes 允许作为 TargetURL 的主机前缀（需同时属于 google.com）
+	allowedTargetHostPrefixes = []string{
+		"console.",
+		"console-",
+	}
+
 	chromiumArgs = []string{
 		"--start-maximized",
 		"--window-size=1920,1080",
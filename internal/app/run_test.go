@@ -0,0 +1,120 @@
+package app
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"vertex-nano-banana-unlimited/internal/proxy"
+	"vertex-nano-banana-unlimited/internal/steps"
+)
+
+func TestAssignProxies(t *testing.T) {
+	a := proxy.Endpoint{Tag: "a", URL: "http://127.0.0.1:1"}
+	b := proxy.Endpoint{Tag: "b", URL: "http://127.0.0.1:2"}
+	c := proxy.Endpoint{Tag: "c", URL: "http://127.0.0.1:3"}
+	// duplicating 总是返回第一个节点，模拟有缺陷的自定义策略
+	duplicating := func(endpoints []proxy.Endpoint, count int) []proxy.Endpoint {
+		out := make([]proxy.Endpoint, count)
+		for i := range out {
+			out[i] = endpoints[0]
+		}
+		return out
+	}
+
+	tests := []struct {
+		name       string
+		endpoints  []proxy.Endpoint
+		count      int
+		strategy   ProxyStrategy
+		allowReuse bool
+		want       []string
+	}{
+		{name: "no endpoints", endpoints: nil, count: 3, want: nil},
+		{name: "ordered fewer scenarios", endpoints: []proxy.Endpoint{a, b, c}, count: 2, want: []string{"a", "b"}},
+		{name: "ordered truncates without reuse", endpoints: []proxy.Endpoint{a, b}, count: 4, want: []string{"a", "b"}},
+		{name: "duplicates deduped without reuse", endpoints: []proxy.Endpoint{a, b, c}, count: 3, strategy: duplicating, want: []string{"a"}},
+		{name: "reuse fills round robin", endpoints: []proxy.Endpoint{a, b}, count: 5, allowReuse: true, want: []string{"a", "b", "a", "b", "a"}},
+		{name: "reuse keeps enough nodes", endpoints: []proxy.Endpoint{a, b, c}, count: 2, allowReuse: true, want: []string{"a", "b"}},
+		{name: "reuse keeps strategy duplicates", endpoints: []proxy.Endpoint{a, b}, count: 2, strategy: duplicating, allowReuse: true, want: []string{"a", "a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, ep := range assignProxies(tt.endpoints, tt.count, tt.strategy, tt.allowReuse) {
+				got = append(got, ep.Tag)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("assignProxies() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSeededProxyStrategyIsReproducible(t *testing.T) {
+	endpoints := []proxy.Endpoint{{Tag: "a"}, {Tag: "b"}, {Tag: "c"}, {Tag: "d"}}
+	first := assignProxies(endpoints, 3, SeededProxyStrategy(42), false)
+	second := assignProxies(endpoints, 3, SeededProxyStrategy(42), false)
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("same seed gave %v and %v", first, second)
+	}
+	if len(first) != 3 {
+		t.Errorf("got %d endpoints, want 3", len(first))
+	}
+}
+
+func TestBatchFolderNameRejectsDotNames(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	downloadDir := t.TempDir()
+	tests := []struct {
+		source    string
+		imagePath string
+		want      string
+	}{
+		{source: "cat.png", want: "cat"},
+		{source: "..png", want: "text-only-1700000000"},
+		{source: "...png", want: "text-only-1700000000"},
+		{source: ".png", want: "text-only-1700000000"},
+		{source: "https://example.com/img/...png", imagePath: "/tmp/upload-1.png", want: "upload-1"},
+		{source: "..png", imagePath: "/tmp/...png", want: "batch-1700000000"},
+	}
+	for _, tt := range tests {
+		got := batchFolderName(RunOptions{SourceName: tt.source, ImagePath: tt.imagePath}, now)
+		if got != tt.want {
+			t.Errorf("batchFolderName(%q, %q) = %q, want %q", tt.source, tt.imagePath, got, tt.want)
+		}
+		if !withinDir(downloadDir, filepath.Join(downloadDir, got)) {
+			t.Errorf("batch folder %q escapes the download dir", got)
+		}
+	}
+	for _, bad := range []string{".", "..", "../x", ""} {
+		if withinDir(downloadDir, filepath.Join(downloadDir, bad)) {
+			t.Errorf("withinDir accepted %q", bad)
+		}
+	}
+}
+
+func TestShouldRetryRun(t *testing.T) {
+	tests := []struct {
+		name     string
+		outcomes []steps.DownloadOutcome
+		want     bool
+	}{
+		{name: "no results", want: false},
+		{name: "all timed out", outcomes: []steps.DownloadOutcome{steps.DownloadOutcomeNone, steps.DownloadOutcomeNone}, want: true},
+		{name: "one downloaded", outcomes: []steps.DownloadOutcome{steps.DownloadOutcomeNone, steps.DownloadOutcomeDownloaded}, want: false},
+		{name: "one suspicious keeps saved images", outcomes: []steps.DownloadOutcome{steps.DownloadOutcomeNone, OutcomeSuspicious}, want: false},
+		{name: "all exhausted or blocked", outcomes: []steps.DownloadOutcome{steps.DownloadOutcomeExhausted, steps.DownloadOutcomeBlocked}, want: false},
+	}
+	for _, tt := range tests {
+		var results []ScenarioResult
+		for _, o := range tt.outcomes {
+			results = append(results, ScenarioResult{Outcome: o})
+		}
+		if got := shouldRetryRun(context.Background(), results); got != tt.want {
+			t.Errorf("%s: shouldRetryRun() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
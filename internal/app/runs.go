@@ -0,0 +1,350 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"vertex-nano-banana-unlimited/internal/steps"
+)
+
+// activeRun 记录一个正在进行的运行，每个运行有独立的浏览器与取消函数。
+type activeRun struct {
+	Token         int64     `json:"token"`
+	StartedAt     time.Time `json:"startedAt"`
+	ScenarioCount int       `json:"scenarioCount"`
+	cancel        context.CancelFunc
+	done          chan struct{} // 运行返回（代理节点已归还）后关闭
+}
+
+// runManager 封装运行的登记、取消与查询，自带互斥锁，按 token 索引正在进行的运行。
+type runManager struct {
+	mu         sync.Mutex
+	runs       map[int64]*activeRun
+	stopping   map[int64]*activeRun // 已取消但尚未返回的运行，仍可能占用代理节点
+	seq        int64
+	quotaUntil time.Time   // 账号额度冷却截止时间
+	pause      *pauseState // 非 nil 时处于维护暂停，拒绝新运行
+}
+
+// pauseState 描述维护暂停：暂停期间拒绝新运行，正在进行的运行不受影响。
+type pauseState struct {
+	Since      time.Time     `json:"since"`
+	Reason     string        `json:"reason,omitempty"`
+	RetryAfter time.Duration `json:"-"`
+}
+
+func newRunManager() *runManager {
+	return &runManager{runs: map[int64]*activeRun{}, stopping: map[int64]*activeRun{}}
+}
+
+// preemptWaitTimeout 是独占模式下等待被取消的运行归还代理节点的最长时间，
+// 超时后照常启动，节点仍被占用时由代理池返回 errProxiesBusy。
+const preemptWaitTimeout = 30 * time.Second
+
+// runs 是服务使用的全局运行管理器
+var runs = newRunManager()
+
+// errTooManyRuns 表示同时运行的任务数已达 MAX_ACTIVE_RUNS 上限。
+var errTooManyRuns = errors.New("同时运行的任务数已达上限")
+
+// errQuotaCooldown 表示上一次运行全部额度耗尽，账号仍在冷却中。
+var errQuotaCooldown = errors.New("账号额度冷却中")
+
+// quotaCooldownError 携带冷却剩余时长，用于设置 Retry-After。
+type quotaCooldownError struct {
+	RetryAfter time.Duration
+}
+
+func (e *quotaCooldownError) Error() string {
+	return fmt.Sprintf("%v，请 %d 秒后重试", errQuotaCooldown, retryAfterSeconds(e.RetryAfter))
+}
+
+func (e *quotaCooldownError) Unwrap() error { return errQuotaCooldown }
+
+// errRunsPaused 表示服务处于维护暂停，暂不接受新运行。
+var errRunsPaused = errors.New("服务维护中，暂停接受新任务")
+
+// runsPausedError 携带建议的重试间隔，用于设置 Retry-After。
+type runsPausedError struct {
+	RetryAfter time.Duration
+	Reason     string
+}
+
+func (e *runsPausedError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("%v（%s），请 %d 秒后重试", errRunsPaused, e.Reason, retryAfterSeconds(e.RetryAfter))
+	}
+	return fmt.Sprintf("%v，请 %d 秒后重试", errRunsPaused, retryAfterSeconds(e.RetryAfter))
+}
+
+func (e *runsPausedError) Unwrap() error { return errRunsPaused }
+
+// retryAfterHint 返回错误携带的建议重试间隔（额度冷却或维护暂停）。
+func retryAfterHint(err error) (time.Duration, bool) {
+	var cooldown *quotaCooldownError
+	if errors.As(err, &cooldown) {
+		return cooldown.RetryAfter, true
+	}
+	var paused *runsPausedError
+	if errors.As(err, &paused) {
+		return paused.RetryAfter, true
+	}
+	return 0, false
+}
+
+// retryAfterSeconds 将时长向上取整为 Retry-After 使用的秒数。
+func retryAfterSeconds(d time.Duration) int {
+	secs := int((d + time.Second - 1) / time.Second)
+	if secs < 1 {
+		return 1
+	}
+	return secs
+}
+
+// updateQuotaCooldownLocked 根据运行结果更新账号冷却：全部 exhausted 时进入冷却，
+// 任一场景下载成功即解除。冷却时长按配额类型取最长的一个：soft 用 QUOTA_SOFT_COOLDOWN，
+// hard 用 QUOTA_HARD_COOLDOWN，其他用 QUOTA_COOLDOWN。需在持有 m.mu 时调用。
+func (m *runManager) updateQuotaCooldownLocked(results []ScenarioResult) {
+	if len(results) == 0 {
+		return
+	}
+	exhausted := 0
+	cooldown := time.Duration(-1)
+	for _, r := range results {
+		switch r.Outcome {
+		case steps.DownloadOutcomeDownloaded:
+			if !m.quotaUntil.IsZero() {
+				fmt.Println("✅ 运行成功，解除账号额度冷却")
+			}
+			m.quotaUntil = time.Time{}
+			return
+		case steps.DownloadOutcomeExhausted:
+			exhausted++
+			if d := quotaCooldownFor(r.QuotaKind); d > cooldown {
+				cooldown = d
+			}
+		}
+	}
+	if exhausted < len(results) || cooldown <= 0 {
+		return
+	}
+	m.quotaUntil = time.Now().Add(cooldown)
+	fmt.Printf("🧊 全部 %d 个场景额度耗尽，账号冷却 %s（至 %s）\n", len(results), cooldown, m.quotaUntil.Format("15:04:05"))
+}
+
+// quotaCooldownFor 返回某种配额提示对应的账号冷却时长，0 表示不冷却。
+func quotaCooldownFor(kind steps.QuotaKind) time.Duration {
+	switch kind {
+	case steps.QuotaSoft:
+		return envDuration("QUOTA_SOFT_COOLDOWN", time.Minute)
+	case steps.QuotaHard:
+		return envDuration("QUOTA_HARD_COOLDOWN", time.Hour)
+	default:
+		return envDuration("QUOTA_COOLDOWN", 5*time.Minute)
+	}
+}
+
+// maxActiveRuns 读取 MAX_ACTIVE_RUNS，默认 1：新运行会取消正在进行的运行。
+func maxActiveRuns() int {
+	n := envInt("MAX_ACTIVE_RUNS", 1)
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// preemptForNewRun 在独占模式（MAX_ACTIVE_RUNS=1）下提前取消正在进行的运行，
+// 让旧运行在新请求解析图片期间就开始收尾。暂停期间新请求会被拒绝，不取消已有运行。
+func (m *runManager) preemptForNewRun() {
+	if maxActiveRuns() == 1 && m.pausedErr() == nil {
+		m.cancelAll()
+	}
+}
+
+// setPaused 进入维护暂停；已暂停时更新原因与重试间隔，保留开始时间。
+func (m *runManager) setPaused(reason string, retryAfter time.Duration) pauseState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	since := time.Now()
+	if m.pause != nil {
+		since = m.pause.Since
+	}
+	m.pause = &pauseState{Since: since, Reason: reason, RetryAfter: retryAfter}
+	return *m.pause
+}
+
+// resume 解除维护暂停，返回之前是否处于暂停。
+func (m *runManager) resume() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	was := m.pause != nil
+	m.pause = nil
+	return was
+}
+
+// pausedErr 在维护暂停时返回 runsPausedError，否则返回 nil。
+func (m *runManager) pausedErr() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pausedErrLocked()
+}
+
+func (m *runManager) pausedErrLocked() error {
+	if m.pause == nil {
+		return nil
+	}
+	return &runsPausedError{RetryAfter: m.pause.RetryAfter, Reason: m.pause.Reason}
+}
+
+// pauseStatus 返回当前的暂停状态，未暂停时 ok 为 false。
+func (m *runManager) pauseStatus() (pauseState, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pause == nil {
+		return pauseState{}, false
+	}
+	return *m.pause, true
+}
+
+// cancelAll 取消所有正在进行的运行，返回是否有运行被取消。
+func (m *runManager) cancelAll() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cancelAllLocked()
+}
+
+// cancelAllLocked 需在持有 m.mu 时调用。被取消的运行移入 stopping，直到其返回。
+func (m *runManager) cancelAllLocked() bool {
+	cancelled := len(m.runs) > 0
+	for token, run := range m.runs {
+		run.cancel()
+		delete(m.runs, token)
+		m.stopping[token] = run
+	}
+	return cancelled
+}
+
+// stoppingLocked 返回已取消但尚未返回的运行的结束信号，需在持有 m.mu 时调用。
+func (m *runManager) stoppingLocked() []chan struct{} {
+	out := make([]chan struct{}, 0, len(m.stopping))
+	for _, run := range m.stopping {
+		out = append(out, run.done)
+	}
+	return out
+}
+
+// waitStopped 等待被取消的运行全部返回、归还代理节点，ctx 结束或超时后放弃等待。
+func waitStopped(ctx context.Context, done []chan struct{}) error {
+	if len(done) == 0 {
+		return nil
+	}
+	fmt.Printf("⏳ 等待 %d 个被取消的运行归还代理节点\n", len(done))
+	timer := time.NewTimer(preemptWaitTimeout)
+	defer timer.Stop()
+	for _, ch := range done {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			fmt.Printf("⚠️ 等待被取消的运行超过 %s，继续启动\n", preemptWaitTimeout)
+			return nil
+		}
+	}
+	return nil
+}
+
+// cancel 取消指定 token 的运行，运行不存在时返回 false。
+func (m *runManager) cancel(token int64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	run, ok := m.runs[token]
+	if !ok {
+		return false
+	}
+	run.cancel()
+	delete(m.runs, token)
+	m.stopping[token] = run
+	return true
+}
+
+// status 返回指定 token 的运行，运行不存在或已结束时 ok 为 false。
+func (m *runManager) status(token int64) (activeRun, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	run, ok := m.runs[token]
+	if !ok {
+		return activeRun{}, false
+	}
+	return *run, true
+}
+
+// list 按 token 顺序返回正在进行的运行。
+func (m *runManager) list() []activeRun {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]activeRun, 0, len(m.runs))
+	for _, run := range m.runs {
+		out = append(out, *run)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Token < out[j].Token })
+	return out
+}
+
+// run 登记并执行一次运行。独占模式下会取消已有运行，并等待它们归还代理节点后再开始；
+// 多运行模式下超过 MAX_ACTIVE_RUNS 时返回 errTooManyRuns。
+// onStart 可选，在分配 token 后回调，便于流式接口告知客户端。
+func (m *runManager) run(ctx context.Context, opts RunOptions, onStart func(token int64)) ([]ScenarioResult, error) {
+	limit := maxActiveRuns()
+	m.mu.Lock()
+	if err := m.pausedErrLocked(); err != nil {
+		m.mu.Unlock()
+		return nil, err
+	}
+	if wait := time.Until(m.quotaUntil); wait > 0 {
+		m.mu.Unlock()
+		return nil, &quotaCooldownError{RetryAfter: wait}
+	}
+	var stopping []chan struct{}
+	if limit == 1 {
+		m.cancelAllLocked()
+		stopping = m.stoppingLocked()
+	}
+	if len(m.runs) >= limit {
+		m.mu.Unlock()
+		return nil, fmt.Errorf("%w（%d）", errTooManyRuns, limit)
+	}
+	m.seq++
+	token := m.seq
+	cctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	m.runs[token] = &activeRun{Token: token, StartedAt: time.Now(), ScenarioCount: opts.ScenarioCount, cancel: cancel, done: done}
+	running := len(m.runs)
+	m.mu.Unlock()
+
+	var results []ScenarioResult
+	defer func() {
+		cancel()
+		m.mu.Lock()
+		delete(m.runs, token)
+		delete(m.stopping, token)
+		m.updateQuotaCooldownLocked(results)
+		m.mu.Unlock()
+		close(done)
+	}()
+
+	if err := waitStopped(cctx, stopping); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("🏃 运行 %d 开始（当前 %d/%d）\n", token, running, limit)
+	if onStart != nil {
+		onStart(token)
+	}
+	results, err := RunWithOptions(cctx, opts)
+	return results, err
+}
@@ -0,0 +1,95 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"vertex-nano-banana-unlimited/internal/steps"
+)
+
+// ErrorCodeSafety 表示提示词或生成结果被安全过滤拦截，换节点重试没有意义。
+const ErrorCodeSafety = "SAFETY"
+
+// 提示词被安全拦截时的处理策略（SAFETY_POLICY）
+const (
+	SafetyPolicyFail  = "fail"  // 立即以 SAFETY 失败（默认）
+	SafetyPolicyRetry = "retry" // 用 SafetySanitizer 改写提示词后在同一页面重试一次
+)
+
+// errSafetyBlocked 表示提示词被安全过滤拦截。
+var errSafetyBlocked = errors.New("提示词被安全过滤拦截")
+
+// safetySanitizerTimeout 是外部提示词改写命令的超时
+const safetySanitizerTimeout = 30 * time.Second
+
+// SafetySanitizer 改写被安全拦截的提示词，返回用于重试的新提示词。
+type SafetySanitizer func(ctx context.Context, prompt string) (string, error)
+
+// validateSafetyPolicy 拒绝未知的安全拦截策略，空值视为 fail。
+func validateSafetyPolicy(policy string) error {
+	switch policy {
+	case "", SafetyPolicyFail, SafetyPolicyRetry:
+		return nil
+	default:
+		return fmt.Errorf("未知的 SafetyPolicy %q，可选：%s, %s", policy, SafetyPolicyFail, SafetyPolicyRetry)
+	}
+}
+
+// commandSanitizer 返回调用外部命令改写提示词的 SafetySanitizer：提示词从 stdin 传入，
+// stdout 去除首尾空白后作为新提示词。cmdline 按空白切分，不经过 shell。
+func commandSanitizer(cmdline string) SafetySanitizer {
+	args := strings.Fields(cmdline)
+	if len(args) == 0 {
+		return nil
+	}
+	return func(ctx context.Context, prompt string) (string, error) {
+		ctx, cancel := context.WithTimeout(ctx, safetySanitizerTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stdin = strings.NewReader(prompt)
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := cmd.Run(); err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return "", fmt.Errorf("%w: %s", err, msg)
+			}
+			return "", err
+		}
+		return strings.TrimSpace(stdout.String()), nil
+	}
+}
+
+// generateWithSafety 在 generate 的基础上处理安全拦截：SafetyPolicy 为 retry 且配置了
+// SafetySanitizer 时，用改写后的提示词在同一页面重试一次；否则直接返回 SAFETY 失败。
+// 改写后的提示词会沿用到持久页面中的后续场景，避免同一提示词反复被拦截。
+func (s *scenarioRun) generateWithSafety(res ScenarioResult, batchFolder string, seenDownloads int) (ScenarioResult, error) {
+	res, err := s.generate(res, batchFolder, seenDownloads)
+	if !errors.Is(err, errSafetyBlocked) || s.opts.SafetyPolicy != SafetyPolicyRetry {
+		return res, err
+	}
+	if s.opts.SafetySanitizer == nil {
+		fmt.Printf("⚠️ [%d] SAFETY_POLICY=retry 但未配置提示词改写（SAFETY_SANITIZER_CMD），不重试\n", s.id)
+		return res, err
+	}
+	sanitized, serr := s.opts.SafetySanitizer(s.ctx, s.opts.PromptText)
+	switch {
+	case serr != nil:
+		fmt.Printf("⚠️ [%d] 改写提示词失败，不重试: %v\n", s.id, serr)
+		return res, err
+	case sanitized == "" || sanitized == s.opts.PromptText:
+		fmt.Printf("⚠️ [%d] 改写后的提示词为空或未变化，不重试\n", s.id)
+		return res, err
+	}
+	fmt.Printf("🧼 [%d] 提示词被安全拦截，改写后重试：%d → %d 字符\n", s.id, len(s.opts.PromptText), len(sanitized))
+	s.opts.PromptText = sanitized
+	retry := res
+	retry.Outcome = steps.DownloadOutcomeNone
+	retry.Error, retry.ErrorCode = "", ""
+	retry.SafetyRetried = true
+	return s.generate(retry, batchFolder, steps.CountDownloadButtons(s.page))
+}
@@ -2,29 +2,26 @@ package app
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
-	"mime/multipart"
+	"mime"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
+	"unicode/utf8"
 
 	"vertex-nano-banana-unlimited/internal/imageprocessing"
 	"vertex-nano-banana-unlimited/internal/proxy"
-)
-
-var (
-	activeRunCancel   context.CancelFunc
-	activeRunToken    int64
-	activeRunCancelMu sync.Mutex
+	"vertex-nano-banana-unlimited/internal/steps"
 )
 
 const maxUploadBytes int64 = 7 * 1024 * 1024
@@ -34,8 +31,8 @@ func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// 设置CORS头部，允许所有来源
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With, Idempotency-Key")
 		w.Header().Set("Access-Control-Max-Age", "86400") // 24小时
 
 		// 处理预检请求
@@ -53,58 +50,184 @@ func corsMiddlewareForFunc(handler func(http.ResponseWriter, *http.Request)) htt
 	return corsMiddleware(http.HandlerFunc(handler))
 }
 
+// headRecorder 丢弃响应体，只记录状态码与长度，用于 HEAD 请求。
+type headRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (h *headRecorder) WriteHeader(status int) { h.status = status }
+
+func (h *headRecorder) Write(p []byte) (int, error) {
+	h.size += len(p)
+	return len(p), nil
+}
+
+// serveGetOrHead 允许 GET 与 HEAD：HEAD 完整执行一次处理函数，返回与 GET 相同的响应头
+// （含 Content-Length）但不带响应体。
+func serveGetOrHead(w http.ResponseWriter, r *http.Request, handle func(http.ResponseWriter, *http.Request)) {
+	switch r.Method {
+	case http.MethodGet:
+		handle(w, r)
+	case http.MethodHead:
+		rec := &headRecorder{ResponseWriter: w, status: http.StatusOK}
+		handle(rec, r)
+		w.Header().Set("Content-Length", strconv.Itoa(rec.size))
+		w.WriteHeader(rec.status)
+	default:
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, "only GET/HEAD allowed")
+	}
+}
+
 func StartHTTPServer(ctx context.Context, addr string) error {
+	pruneTraces(DefaultRunOptions().DownloadDir)
+	go watchDiskUsage(ctx, DefaultRunOptions().DownloadDir)
 	mux := http.NewServeMux()
 
 	// API 路由
 	mux.Handle("/healthz", corsMiddlewareForFunc(func(w http.ResponseWriter, r *http.Request) {
-		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+		resp := map[string]any{"status": "ok"}
+		if usage, ok := cachedDiskUsage(); ok {
+			resp["downloadDir"] = usage
+		}
+		resp["paused"] = false
+		if p, paused := runs.pauseStatus(); paused {
+			resp["paused"] = true
+			resp["pause"] = p
+		}
+		writeOK(w, http.StatusOK, resp)
 	}))
 	mux.Handle("/cancel", corsMiddlewareForFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
-			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "only POST allowed"})
+			writeError(w, http.StatusMethodNotAllowed, "only POST allowed")
 			return
 		}
-		if cancelled := cancelActiveRun(); cancelled {
-			writeJSON(w, http.StatusOK, map[string]string{"status": "cancelled"})
+		// 带 token 时只取消指定运行，否则取消全部运行
+		if raw := strings.TrimSpace(r.URL.Query().Get("token")); raw != "" {
+			token, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("token 无效: %s", raw))
+				return
+			}
+			if !runs.cancel(token) {
+				writeError(w, http.StatusNotFound, fmt.Sprintf("运行 %d 不存在或已结束", token))
+				return
+			}
+			writeOK(w, http.StatusOK, map[string]any{"status": "cancelled", "token": token})
+			return
+		}
+		if cancelled := runs.cancelAll(); cancelled {
+			writeOK(w, http.StatusOK, map[string]string{"status": "cancelled"})
 		} else {
-			writeJSON(w, http.StatusOK, map[string]string{"status": "idle"})
+			writeOK(w, http.StatusOK, map[string]string{"status": "idle"})
+		}
+	}))
+	mux.Handle("/runs", corsMiddlewareForFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "only GET allowed")
+			return
+		}
+		active := runs.list()
+		writeOK(w, http.StatusOK, map[string]any{
+			"count": len(active),
+			"max":   maxActiveRuns(),
+			"runs":  active,
+		})
+	}))
+	mux.Handle("/run/status", corsMiddlewareForFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "only GET allowed")
+			return
+		}
+		raw := strings.TrimSpace(r.URL.Query().Get("token"))
+		token, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("token 无效: %s", raw))
+			return
 		}
+		run, ok := runs.status(token)
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("运行 %d 不存在或已结束", token))
+			return
+		}
+		writeOK(w, http.StatusOK, map[string]any{"status": "running", "run": run})
 	}))
 	mux.Handle("/run", corsMiddlewareForFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
-			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "only POST allowed"})
+			writeError(w, http.StatusMethodNotAllowed, "only POST allowed")
+			return
+		}
+		// ?explain=1 只返回步骤计划，不受暂停影响，也不参与幂等重放
+		if explainRequested(r) {
+			if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+				handleMultipartRun(w, r)
+			} else {
+				handleJSONRun(w, r)
+			}
+			return
+		}
+		// 暂停期间在读取请求体之前直接拒绝，避免白白上传图片
+		if err := runs.pausedErr(); err != nil {
+			wait, _ := retryAfterHint(err)
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+			status, code, msg := runErrorInfo(err)
+			writeErrorData(w, status, code, msg, map[string]any{"retryAfter": retryAfterSeconds(wait)})
 			return
 		}
 		ct := r.Header.Get("Content-Type")
 		if strings.HasPrefix(ct, "multipart/form-data") {
-			handleMultipartRun(w, r)
+			withIdempotency(w, r, handleMultipartRun)
 		} else {
-			handleJSONRun(w, r)
+			withIdempotency(w, r, handleJSONRun)
 		}
 	}))
 	mux.Handle("/gallery", corsMiddlewareForFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "only GET allowed"})
+		serveGetOrHead(w, r, handleGallery)
+	}))
+	mux.Handle("/gallery/files", corsMiddlewareForFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveGetOrHead(w, r, handleGalleryFiles)
+	}))
+	mux.Handle("/gallery/prune", corsMiddlewareForFunc(requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "only POST allowed")
 			return
 		}
-		handleGallery(w, r)
+		handleGalleryPrune(w, r)
+	})))
+	mux.Handle("/options", corsMiddlewareForFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveGetOrHead(w, r, handleOptions)
 	}))
-	mux.Handle("/gallery/files", corsMiddlewareForFunc(func(w http.ResponseWriter, r *http.Request) {
+	mux.Handle("/image/process", corsMiddlewareForFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "only POST allowed")
+			return
+		}
+		handleImageProcess(w, r)
+	}))
+	mux.Handle("/gallery/export", corsMiddlewareForFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
-			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "only GET allowed"})
+			writeError(w, http.StatusMethodNotAllowed, "only GET allowed")
 			return
 		}
-		handleGalleryFiles(w, r)
+		handleGalleryExport(w, r)
 	}))
 	mux.Handle("/proxy/subscriptions", corsMiddlewareForFunc(handleProxySubscriptions))
+	mux.Handle("/proxy/logs", corsMiddlewareForFunc(requireAdmin(handleProxyLogs)))
+	mux.Handle("/proxy/refresh", corsMiddlewareForFunc(handleProxyRefresh))
+	mux.Handle("/proxy/healthcheck", corsMiddlewareForFunc(handleProxyHealthcheck))
+	mux.Handle("/proxy/config", corsMiddlewareForFunc(requireAdmin(handleProxyConfig)))
+	mux.Handle("/ws", corsMiddlewareForFunc(handleWebSocket))
+	mux.Handle("/admin/pause", corsMiddlewareForFunc(requireAdmin(handleAdminPause)))
+	mux.Handle("/admin/resume", corsMiddlewareForFunc(requireAdmin(handleAdminResume)))
 
 	// 静态文件服务 (SPA)
 	const staticDir = "./frontend/dist"
 	spaHandler := http.FileServer(http.Dir(staticDir))
 
-	// 临时文件服务
-	tmpFileServer := http.StripPrefix("/tmp/", http.FileServer(http.Dir("./tmp")))
+	// 下载目录文件服务，挂载在 downloadURLPrefix 下，URL 由 galleryURL 生成
+	tmpFileServer := http.StripPrefix(downloadURLPrefix, galleryFileHandler(DefaultRunOptions().DownloadDir))
 
 	// 根处理器，用于区分 API 和静态文件
 	rootHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -113,13 +236,18 @@ func StartHTTPServer(ctx context.Context, addr string) error {
 			strings.HasPrefix(r.URL.Path, "/gallery") ||
 			strings.HasPrefix(r.URL.Path, "/proxy") ||
 			strings.HasPrefix(r.URL.Path, "/cancel") ||
-			strings.HasPrefix(r.URL.Path, "/healthz") {
+			strings.HasPrefix(r.URL.Path, "/ws") ||
+			strings.HasPrefix(r.URL.Path, "/healthz") ||
+			strings.HasPrefix(r.URL.Path, "/options") ||
+			strings.HasPrefix(r.URL.Path, "/admin/") ||
+			// /image/process 等图片处理接口
+			strings.HasPrefix(r.URL.Path, "/image/") {
 			mux.ServeHTTP(w, r)
 			return
 		}
 
 		// 临时文件路由
-		if strings.HasPrefix(r.URL.Path, "/tmp/") {
+		if strings.HasPrefix(r.URL.Path, downloadURLPrefix) {
 			tmpFileServer.ServeHTTP(w, r)
 			return
 		}
@@ -135,9 +263,16 @@ func StartHTTPServer(ctx context.Context, addr string) error {
 		spaHandler.ServeHTTP(w, r)
 	})
 
+	// /run 会同步等待生成完成（可能长达数分钟），因此写超时默认关闭；
+	// 读请求头/请求体与空闲连接的超时用于防止慢速客户端长期占用连接。
+	// WebSocket 升级时 gorilla/websocket 会清除这些截止时间。
 	srv := &http.Server{
-		Addr:    addr,
-		Handler: rootHandler,
+		Addr:              addr,
+		Handler:           rootHandler,
+		ReadHeaderTimeout: envDuration("HTTP_READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       envDuration("HTTP_READ_TIMEOUT", 5*time.Minute),
+		WriteTimeout:      envDuration("HTTP_WRITE_TIMEOUT", 0),
+		IdleTimeout:       envDuration("HTTP_IDLE_TIMEOUT", 2*time.Minute),
 	}
 
 	go func() {
@@ -151,51 +286,72 @@ func StartHTTPServer(ctx context.Context, addr string) error {
 	return nil
 }
 
-func cancelActiveRun() bool {
-	activeRunCancelMu.Lock()
-	defer activeRunCancelMu.Unlock()
-	if activeRunCancel != nil {
-		activeRunCancel()
-		activeRunCancel = nil
-		return true
+// errUnsupportedImage 表示上传的图片格式无法处理，应在运行前直接拒绝。
+var errUnsupportedImage = errors.New("unsupported image format")
+
+// newRunTempDir 为一次运行创建独立的临时目录，上传与预处理的图片都放在其中，
+// 运行结束后由 removeRunTempDir 整体删除，避免并发运行之间互相干扰。
+func newRunTempDir() (string, error) {
+	dir, err := os.MkdirTemp("", "vnb-run-*")
+	if err != nil {
+		return "", fmt.Errorf("create run temp dir: %w", err)
 	}
-	return false
+	return dir, nil
 }
 
-func runWithExclusive(ctx context.Context, opts RunOptions) ([]ScenarioResult, error) {
-	activeRunCancelMu.Lock()
-	if activeRunCancel != nil {
-		activeRunCancel()
+// removeRunTempDir 删除运行的临时目录，dir 为空时不做任何事。
+func removeRunTempDir(dir string) {
+	if dir == "" {
+		return
 	}
-	activeRunToken++
-	token := activeRunToken
-	cctx, cancel := context.WithCancel(ctx)
-	activeRunCancel = cancel
-	activeRunCancelMu.Unlock()
-
-	results, err := RunWithOptions(cctx, opts)
-
-	activeRunCancelMu.Lock()
-	if activeRunToken == token {
-		activeRunCancel = nil
+	if err := os.RemoveAll(dir); err != nil {
+		fmt.Printf("⚠️ 清理运行临时目录失败 %s: %v\n", dir, err)
 	}
-	activeRunCancelMu.Unlock()
-	return results, err
 }
 
-func prepareImageForRun(srcPath string) (string, error) {
+// prepareImageForRun 校验图片格式，必要时重新编码为 PNG 并写入 tempDir，
+// 同时返回重新编码的原因（空表示使用原图）。无需处理时直接返回原路径，只读取文件头用于识别格式。
+func prepareImageForRun(srcPath, tempDir string) (string, string, error) {
 	info, err := os.Stat(srcPath)
 	if err != nil {
-		return "", err
+		return "", "", err
+	}
+	format, err := imageprocessing.DetectFileFormat(srcPath)
+	if err != nil {
+		return "", "", err
+	}
+	if err := checkDecodableFormat(format); err != nil {
+		return "", "", err
 	}
 	ext := strings.ToLower(filepath.Ext(srcPath))
-	if !shouldProcessImage(info, ext) {
-		return srcPath, nil
+	reason := imageProcessReason(info.Size(), ext, format)
+	if reason == "" {
+		return srcPath, "", nil
 	}
-
 	data, err := os.ReadFile(srcPath)
 	if err != nil {
-		return "", fmt.Errorf("read image: %w", err)
+		return "", "", fmt.Errorf("read image: %w", err)
+	}
+	path, err := processImageForRun(data, ext, format, tempDir)
+	return path, reason, err
+}
+
+// checkDecodableFormat 拒绝无法解码的图片格式。
+func checkDecodableFormat(format string) error {
+	if imageprocessing.IsDecodableFormat(format) {
+		return nil
+	}
+	name := format
+	if name == imageprocessing.FormatUnknown {
+		name = "unknown"
+	}
+	return fmt.Errorf("%w: %s（支持 png/jpeg/gif/bmp/tiff）", errUnsupportedImage, name)
+}
+
+// processImageForRun 将图片重新编码为不超过 maxUploadBytes 的 PNG 并写入 tempDir。
+func processImageForRun(data []byte, ext, format, tempDir string) (string, error) {
+	if !imageprocessing.ExtMatchesFormat(ext, format) {
+		fmt.Printf("ℹ️ 图片扩展名 %s 与实际格式 %s 不符，强制重新编码\n", ext, format)
 	}
 
 	opts := imageprocessing.DefaultProcessImageOptions()
@@ -206,73 +362,180 @@ func prepareImageForRun(srcPath string) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("process image: %w", err)
 	}
+	return writeRunTempFile(tempDir, "upload-processed-*"+outExt, processed)
+}
 
-	tmpFile, err := os.CreateTemp("", "upload-processed-*"+outExt)
+// writeRunTempFile 在运行临时目录中创建文件并写入 data，返回文件路径。
+func writeRunTempFile(tempDir, pattern string, data []byte) (string, error) {
+	tmpFile, err := os.CreateTemp(tempDir, pattern)
 	if err != nil {
-		return "", fmt.Errorf("create processed temp: %w", err)
+		return "", fmt.Errorf("create temp: %w", err)
 	}
-	if err := os.WriteFile(tmpFile.Name(), processed, 0o644); err != nil {
-		return "", fmt.Errorf("write processed: %w", err)
+	defer tmpFile.Close()
+	if _, err := tmpFile.Write(data); err != nil {
+		return "", fmt.Errorf("write temp: %w", err)
 	}
 	return tmpFile.Name(), nil
 }
 
-func shouldProcessImage(info fs.FileInfo, ext string) bool {
-	if info == nil {
-		return true
+// 图片重新编码的原因，随 /run 响应的 processReason 返回
+const (
+	processReasonFormatMismatch = "format-mismatch" // 扩展名与真实格式不符
+	processReasonNonPNG         = "non-png"         // 不是 PNG
+	processReasonOversized      = "oversized"       // 超出 maxUploadBytes
+)
+
+// imageProcessReason 判断是否需要重新编码并返回原因：扩展名与真实格式不符、非 PNG
+// 或超出大小限制时处理；返回空字符串表示直接使用原图。
+func imageProcessReason(size int64, ext, format string) string {
+	if !imageprocessing.ExtMatchesFormat(ext, format) {
+		return processReasonFormatMismatch
 	}
-	if strings.ToLower(ext) != ".png" {
-		return true
+	if format != imageprocessing.FormatPNG {
+		return processReasonNonPNG
 	}
-	return info.Size() > maxUploadBytes
+	if size > maxUploadBytes {
+		return processReasonOversized
+	}
+	return ""
 }
 
-func handleJSONRun(w http.ResponseWriter, r *http.Request) {
-	cancelActiveRun()
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("read body: %v", err)})
-		return
-	}
-	var req struct {
-		Image         string  `json:"image"`
-		Prompt        string  `json:"prompt"`
-		ScenarioCount int     `json:"scenarioCount"`
-		Resolution    string  `json:"resolution"`
-		Temperature   float64 `json:"temperature"`
-		AspectRatio   string  `json:"aspectRatio"`
+// runRequest 是 JSON 形式的运行请求，/run 与 /ws 共用。
+type runRequest struct {
+	Image         string           `json:"image"`
+	Prompt        string           `json:"prompt"`
+	PromptFile    string           `json:"promptFile"` // 服务器上的提示词文本文件，优先于 prompt
+	ScenarioCount int              `json:"scenarioCount"`
+	Resolution    string           `json:"resolution"`
+	Temperature   temperatureInput `json:"temperature"`
+	AspectRatio   string           `json:"aspectRatio"`
+	TargetURL     string           `json:"targetUrl"`
+	Headless      *bool            `json:"headless"`
+	// PersistentPage 有头模式下复用同一页面依次生成各场景
+	PersistentPage *bool `json:"persistentPage"`
+	// AllowDirectFill 代理不足时多出的场景直连运行
+	AllowDirectFill *bool `json:"allowDirectFill"`
+	// AdvancedSettings 按控件名称设置的其他模型参数
+	AdvancedSettings map[string]string `json:"advancedSettings"`
+	// SkipSteps 跳过的可选步骤名称，如 ["cookies","temperature"]
+	SkipSteps []string `json:"skipSteps"`
+	// PromptPostprocess 提示词后处理器名称，如 "append-quality"
+	PromptPostprocess string `json:"promptPostprocess"`
+	// ExcludeProxyTags 本次运行不使用的代理节点 tag
+	ExcludeProxyTags []string `json:"excludeProxyTags"`
+	// Resolutions / AspectRatios / Temperatures 按场景顺序覆盖顶层设置，空值（温度为 null 或 ""）沿用顶层；
+	// 未指定 scenarioCount 时场景数取最长数组的长度
+	Resolutions  []string           `json:"resolutions"`
+	AspectRatios []string           `json:"aspectRatios"`
+	Temperatures []temperatureInput `json:"temperatures"`
+}
+
+// temperatureInput 接受数字或预设名称（见 steps.TemperaturePresets），如 1.2、"1.2" 或 "creative"。
+type temperatureInput struct {
+	Value  float64
+	Preset string
+	Set    bool // 提供了数字或预设；null 与 "" 为 false，用于区分未设置与显式的 0
+}
+
+func (t *temperatureInput) UnmarshalJSON(data []byte) error {
+	var raw any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
 	}
-	if err := json.Unmarshal(body, &req); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid json: %v", err)})
-		return
+	switch v := raw.(type) {
+	case nil:
+		*t = temperatureInput{}
+	case float64:
+		*t = temperatureInput{Value: v, Set: true}
+	case string:
+		if strings.TrimSpace(v) == "" {
+			*t = temperatureInput{}
+			return nil
+		}
+		value, preset, err := steps.ResolveTemperature(v)
+		if err != nil {
+			return err
+		}
+		*t = temperatureInput{Value: value, Preset: preset, Set: true}
+	default:
+		return fmt.Errorf("temperature 应为数字或预设名称: %s", data)
 	}
+	return nil
+}
+
+// toRunOptions 校验请求并转换为运行选项（含图片预处理），失败时返回应答用的 HTTP 状态码。
+func (req *runRequest) toRunOptions() (RunOptions, int, error) {
 	req.Prompt = strings.TrimSpace(req.Prompt)
 	req.Image = strings.TrimSpace(req.Image)
 	req.Resolution = strings.TrimSpace(req.Resolution)
+	req.TargetURL = strings.TrimSpace(req.TargetURL)
+	opts := DefaultRunOptions()
+	prompt, err := resolvePrompt(opts.DownloadDir, req.Prompt, req.PromptFile)
+	if err != nil {
+		return opts, http.StatusBadRequest, err
+	}
+	req.Prompt = prompt
 	if req.Prompt == "" {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "prompt 不能为空"})
-		return
+		return opts, http.StatusBadRequest, errors.New("prompt 不能为空")
 	}
-	// 只有当image不为空时才检查文件存在性
-	if req.Image != "" {
-		if _, err := os.Stat(req.Image); err != nil {
-			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("image 不可用: %v", err)})
-			return
+	if err := checkPromptLength(req.Prompt); err != nil {
+		return opts, http.StatusBadRequest, err
+	}
+	if req.TargetURL != "" {
+		if err := validateTargetURL(req.TargetURL); err != nil {
+			return opts, http.StatusBadRequest, err
 		}
 	}
-
-	opts := DefaultRunOptions()
-	var processedPath string
+	if err := validateTemperature(req.Temperature.Value); err != nil {
+		return opts, http.StatusBadRequest, err
+	}
+	// prepare 将图片校验并写入运行临时目录，image 为空时保持 nil
+	var prepare func(tempDir string) (string, string, error)
+	if strings.HasPrefix(req.Image, dataURIPrefix) {
+		img, err := decodeDataURIImage(req.Image)
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, errUploadTooLarge) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			return opts, status, err
+		}
+		req.Image = img.Filename // 日志与响应中不回显整段 base64
+		prepare = func(tempDir string) (string, string, error) { return prepareUploadForRun(img, tempDir) }
+	} else if req.Image != "" {
+		imagePath := req.Image
+		if strings.HasPrefix(imagePath, galleryRefScheme) {
+			resolved, err := resolveGalleryRef(opts.DownloadDir, imagePath)
+			if err != nil {
+				return opts, http.StatusBadRequest, err
+			}
+			imagePath = resolved
+		}
+		if _, err := os.Stat(imagePath); err != nil {
+			return opts, http.StatusBadRequest, fmt.Errorf("image 不可用: %v", err)
+		}
+		prepare = func(tempDir string) (string, string, error) { return prepareImageForRun(imagePath, tempDir) }
+	}
 
 	// 只有当image不为空时才处理图片
-	if req.Image != "" {
-		var err error
-		processedPath, err = prepareImageForRun(req.Image)
+	if prepare != nil {
+		tempDir, err := newRunTempDir()
 		if err != nil {
-			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("处理图片失败: %v", err)})
-			return
+			return opts, http.StatusInternalServerError, err
+		}
+		processedPath, reason, err := prepare(tempDir)
+		if err != nil {
+			removeRunTempDir(tempDir)
+			status := http.StatusInternalServerError
+			if errors.Is(err, errUnsupportedImage) {
+				status = http.StatusBadRequest
+			}
+			return opts, status, fmt.Errorf("处理图片失败: %v", err)
 		}
+		opts.TempDir = tempDir
 		opts.ImagePath = processedPath
+		opts.ImageProcessReason = reason
+		opts.SourceName = req.Image
 	} else {
 		// image为空时，ImagePath保持为空字符串
 		opts.ImagePath = ""
@@ -281,54 +544,160 @@ func handleJSONRun(w http.ResponseWriter, r *http.Request) {
 	if req.Resolution != "" {
 		opts.OutputRes = req.Resolution
 	}
+	temps := make([]*float64, len(req.Temperatures))
+	for i, t := range req.Temperatures {
+		if t.Set {
+			temps[i] = &t.Value
+		}
+	}
+	overrides := buildScenarioOverrides(req.Resolutions, req.AspectRatios, temps)
 	if req.ScenarioCount > 0 {
 		opts.ScenarioCount = req.ScenarioCount
+	} else if len(overrides) > 0 {
+		opts.ScenarioCount = len(overrides)
 	} else {
 		opts.ScenarioCount = 1
 	}
 
 	// 设置温度，如果前端没有传递则使用默认值
-	if req.Temperature > 0 {
-		opts.Temperature = req.Temperature
+	if req.Temperature.Value > 0 {
+		opts.Temperature = req.Temperature.Value
+		opts.TemperaturePreset = req.Temperature.Preset
 	}
 	if req.AspectRatio != "" {
 		opts.AspectRatio = req.AspectRatio
 	}
+	opts.ScenarioOverrides = overrides
+	if err := normalizeAspectRatios(&opts); err != nil {
+		removeRunTempDir(opts.TempDir)
+		return opts, http.StatusBadRequest, err
+	}
+	if err := validateResolutionAspect(opts.OutputRes, opts.AspectRatio); err != nil {
+		removeRunTempDir(opts.TempDir)
+		return opts, http.StatusBadRequest, err
+	}
+	if err := validateScenarioOverrides(opts); err != nil {
+		removeRunTempDir(opts.TempDir)
+		return opts, http.StatusBadRequest, err
+	}
+	if req.TargetURL != "" {
+		opts.TargetURL = req.TargetURL
+	}
+	if req.Headless != nil {
+		opts.Headless = *req.Headless
+	}
+	if req.PersistentPage != nil {
+		opts.PersistentPage = *req.PersistentPage
+	}
+	if req.AllowDirectFill != nil {
+		opts.AllowDirectFill = *req.AllowDirectFill
+	}
+	if len(req.AdvancedSettings) > 0 {
+		opts.AdvancedSettings = req.AdvancedSettings
+	}
+	if req.SkipSteps != nil {
+		if err := validateSkipSteps(req.SkipSteps); err != nil {
+			removeRunTempDir(opts.TempDir)
+			return opts, http.StatusBadRequest, err
+		}
+		opts.SkipSteps = req.SkipSteps
+	}
+	if req.PromptPostprocess != "" {
+		if _, err := postprocessPrompt(req.PromptPostprocess, ""); err != nil {
+			removeRunTempDir(opts.TempDir)
+			return opts, http.StatusBadRequest, err
+		}
+		opts.PromptPostprocess = req.PromptPostprocess
+	}
+	if len(req.ExcludeProxyTags) > 0 {
+		if err := validateExcludeProxyTags(req.ExcludeProxyTags); err != nil {
+			removeRunTempDir(opts.TempDir)
+			return opts, http.StatusBadRequest, err
+		}
+		opts.ExcludeProxyTags = req.ExcludeProxyTags
+	}
+	return opts, http.StatusOK, nil
+}
 
-	fmt.Printf("▶️ /run (json) image=%s processed=%s scenario=%d res=%s aspect=%s temp=%.1f promptLen=%d\n", req.Image, processedPath, opts.ScenarioCount, opts.OutputRes, opts.AspectRatio, opts.Temperature, len(opts.PromptText))
-	results, runErr := runWithExclusive(r.Context(), opts)
-	if runErr != nil {
-		status := http.StatusInternalServerError
-		msg := runErr.Error()
-		if errors.Is(runErr, context.Canceled) {
-			status = http.StatusConflict
-			msg = "cancelled"
-		}
-		fmt.Printf("⚠️ /run (json) end err=%v\n", runErr)
-		writeJSON(w, status, map[string]any{
-			"error":   msg,
-			"results": results,
-		})
+// parseScenarioOverrides 解析 multipart 中按场景顺序的逗号列表，保留空项以对齐场景序号；
+// 温度的空项表示沿用顶层设置，"0" 表示显式设为 0。
+func parseScenarioOverrides(resolutions, aspects, temps string) ([]ScenarioOverride, error) {
+	positional := func(raw string) []string {
+		if strings.TrimSpace(raw) == "" {
+			return nil
+		}
+		return strings.Split(raw, ",")
+	}
+	var temperatures []*float64
+	for i, item := range positional(temps) {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			temperatures = append(temperatures, nil)
+			continue
+		}
+		t, _, err := steps.ResolveTemperature(item)
+		if err != nil {
+			return nil, fmt.Errorf("temperatures 第 %d 项: %w", i+1, err)
+		}
+		temperatures = append(temperatures, &t)
+	}
+	return buildScenarioOverrides(positional(resolutions), positional(aspects), temperatures), nil
+}
+
+func handleJSONRun(w http.ResponseWriter, r *http.Request) {
+	if !explainRequested(r) {
+		runs.preemptForNewRun()
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("read body: %v", err))
 		return
 	}
-	fmt.Printf("✅ /run (json) done scenario=%d res=%s results=%d\n", opts.ScenarioCount, opts.OutputRes, len(results))
-	writeJSON(w, http.StatusOK, map[string]any{
-		"status":        "ok",
-		"imageUsed":     processedPath,
-		"imageOrig":     req.Image,
-		"scenarioCount": opts.ScenarioCount,
-		"results":       results,
-	})
+	var req runRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid json: %v", err))
+		return
+	}
+	opts, status, err := req.toRunOptions()
+	if err != nil {
+		writeError(w, status, err.Error())
+		return
+	}
+	defer removeRunTempDir(opts.TempDir)
+	processedPath := opts.ImagePath
+	if explainRequested(r) {
+		writeExplain(w, "json", opts)
+		return
+	}
+
+	fmt.Printf("▶️ /run (json) image=%s processed=%s scenario=%d res=%s aspect=%s temp=%.1f promptLen=%d\n", req.Image, processedPath, opts.ScenarioCount, opts.OutputRes, opts.AspectRatio, opts.Temperature, len(opts.PromptText))
+	var obs runObserver
+	obs.attach(&opts)
+	results, runErr := runs.run(r.Context(), opts, nil)
+	writeRunResponse(w, r, "json", opts, req.Image, &obs, results, runErr)
 }
 
 func handleMultipartRun(w http.ResponseWriter, r *http.Request) {
-	cancelActiveRun()
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("parse form: %v", err)})
+	if !explainRequested(r) {
+		runs.preemptForNewRun()
+	}
+	upload, err := readMultipartRun(w, r)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errUploadTooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		writeError(w, status, fmt.Sprintf("parse form: %v", err))
 		return
 	}
 	prompt := strings.TrimSpace(r.FormValue("prompt"))
-	scenarioCount := 1
+	// resolutions / aspectRatios / temperatures 为按场景顺序的逗号列表，空项沿用顶层设置，如 4K,,2K
+	overrides, err := parseScenarioOverrides(r.FormValue("resolutions"), r.FormValue("aspectRatios"), r.FormValue("temperatures"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	scenarioCount := max(1, len(overrides))
 	if scStr := strings.TrimSpace(r.FormValue("scenarioCount")); scStr != "" {
 		if n, err := strconv.Atoi(scStr); err == nil && n > 0 {
 			scenarioCount = n
@@ -336,61 +705,122 @@ func handleMultipartRun(w http.ResponseWriter, r *http.Request) {
 	}
 	resolution := strings.TrimSpace(r.FormValue("resolution"))
 	aspectRatio := strings.TrimSpace(r.FormValue("aspectRatio"))
-	temperature := 0.0
-	if tempStr := strings.TrimSpace(r.FormValue("temperature")); tempStr != "" {
-		if t, err := strconv.ParseFloat(tempStr, 64); err == nil && t >= 0 && t <= 2 {
-			temperature = t
+	targetURL := strings.TrimSpace(r.FormValue("targetUrl"))
+	if targetURL != "" {
+		if err := validateTargetURL(targetURL); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
 		}
 	}
-	var tmpFile *os.File
-	var header *multipart.FileHeader
-	var processedPath string
-
-	file, header, err := r.FormFile("image")
-	if err != nil {
-		if err != http.ErrMissingFile {
-			// 真正的错误，不是文件缺失
-			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("读取 image 文件字段失败: %v", err)})
+	var headless *bool
+	if raw := strings.TrimSpace(r.FormValue("headless")); raw != "" {
+		v, err := strconv.ParseBool(raw)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("headless 无效: %s", raw))
 			return
 		}
-		// 没有上传文件是允许的
-		processedPath = ""
-	} else {
-		defer file.Close()
-
-		tmpFile, err = os.CreateTemp("", "upload-*"+filepath.Ext(header.Filename))
+		headless = &v
+	}
+	var persistentPage *bool
+	if raw := strings.TrimSpace(r.FormValue("persistentPage")); raw != "" {
+		v, err := strconv.ParseBool(raw)
 		if err != nil {
-			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("create temp: %v", err)})
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("persistentPage 无效: %s", raw))
 			return
 		}
-		defer os.Remove(tmpFile.Name())
-		if _, err := io.Copy(tmpFile, file); err != nil {
-			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("save temp: %v", err)})
+		persistentPage = &v
+	}
+	var allowDirectFill *bool
+	if raw := strings.TrimSpace(r.FormValue("allowDirectFill")); raw != "" {
+		v, err := strconv.ParseBool(raw)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("allowDirectFill 无效: %s", raw))
 			return
 		}
-		processedPath = tmpFile.Name()
+		allowDirectFill = &v
 	}
-
-	if prompt == "" {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "prompt 不能为空"})
+	// advancedSettings 为 JSON 对象字符串，如 {"Top-P":"0.9"}
+	var advancedSettings map[string]string
+	if raw := strings.TrimSpace(r.FormValue("advancedSettings")); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &advancedSettings); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("advancedSettings 无效: %v", err))
+			return
+		}
+	}
+	// skipSteps 为逗号分隔的步骤名称，如 cookies,temperature
+	var skipSteps []string
+	if raw := strings.TrimSpace(r.FormValue("skipSteps")); raw != "" {
+		skipSteps = splitList(raw)
+		if err := validateSkipSteps(skipSteps); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	// excludeProxyTags 为逗号分隔的节点 tag
+	excludeProxyTags := splitList(r.FormValue("excludeProxyTags"))
+	if err := validateExcludeProxyTags(excludeProxyTags); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	promptPostprocess := strings.TrimSpace(r.FormValue("promptPostprocess"))
+	if _, err := postprocessPrompt(promptPostprocess, ""); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// temperature 可为数字或预设名称（precise/balanced/creative）
+	temperature, temperaturePreset := 0.0, ""
+	if tempStr := strings.TrimSpace(r.FormValue("temperature")); tempStr != "" {
+		t, preset, err := steps.ResolveTemperature(tempStr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		temperature, temperaturePreset = t, preset
+	}
+	if err := validateTemperature(temperature); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	tempDir, err := newRunTempDir()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer removeRunTempDir(tempDir)
 
 	opts := DefaultRunOptions()
-	var finalProcessPath string
+	prompt, err = resolvePrompt(opts.DownloadDir, prompt, r.FormValue("promptFile"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if prompt == "" {
+		writeError(w, http.StatusBadRequest, "prompt 不能为空")
+		return
+	}
+	if err := checkPromptLength(prompt); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	// 只有当有上传文件时才处理图片
-	if processedPath != "" {
-		var err error
-		finalProcessPath, err = prepareImageForRun(processedPath)
+	if upload != nil {
+		finalProcessPath, reason, err := prepareUploadForRun(upload, tempDir)
 		if err != nil {
-			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("处理图片失败: %v", err)})
+			status := http.StatusInternalServerError
+			if errors.Is(err, errUnsupportedImage) {
+				status = http.StatusBadRequest
+			}
+			writeError(w, status, fmt.Sprintf("处理图片失败: %v", err))
 			return
 		}
 		opts.ImagePath = finalProcessPath
+		opts.ImageProcessReason = reason
+		opts.SourceName = upload.Filename
 	} else {
 		opts.ImagePath = ""
 	}
+	opts.TempDir = tempDir
 	opts.PromptText = prompt
 	opts.ScenarioCount = scenarioCount
 	if resolution != "" {
@@ -399,39 +829,268 @@ func handleMultipartRun(w http.ResponseWriter, r *http.Request) {
 	if aspectRatio != "" {
 		opts.AspectRatio = aspectRatio
 	}
+	opts.ScenarioOverrides = overrides
+	if err := normalizeAspectRatios(&opts); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateResolutionAspect(opts.OutputRes, opts.AspectRatio); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if targetURL != "" {
+		opts.TargetURL = targetURL
+	}
+	if headless != nil {
+		opts.Headless = *headless
+	}
+	if persistentPage != nil {
+		opts.PersistentPage = *persistentPage
+	}
+	if allowDirectFill != nil {
+		opts.AllowDirectFill = *allowDirectFill
+	}
+	if len(advancedSettings) > 0 {
+		opts.AdvancedSettings = advancedSettings
+	}
+	if skipSteps != nil {
+		opts.SkipSteps = skipSteps
+	}
+	if promptPostprocess != "" {
+		opts.PromptPostprocess = promptPostprocess
+	}
+	if len(excludeProxyTags) > 0 {
+		opts.ExcludeProxyTags = excludeProxyTags
+	}
 	// 设置温度，如果前端没有传递则使用默认值
 	if temperature > 0 {
 		opts.Temperature = temperature
+		opts.TemperaturePreset = temperaturePreset
+	}
+	if err := validateScenarioOverrides(opts); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if explainRequested(r) {
+		writeExplain(w, "multipart", opts)
+		return
 	}
 
 	var filename string
-	if header != nil {
-		filename = header.Filename
+	if upload != nil {
+		filename = upload.Filename
+	}
+	fmt.Printf("▶️ /run (multipart) file=%s processed=%s scenario=%d res=%s aspect=%s temp=%.1f promptLen=%d\n", filename, opts.ImagePath, opts.ScenarioCount, opts.OutputRes, opts.AspectRatio, opts.Temperature, len(opts.PromptText))
+	var obs runObserver
+	obs.attach(&opts)
+	results, runErr := runs.run(r.Context(), opts, nil)
+	writeRunResponse(w, r, "multipart", opts, filename, &obs, results, runErr)
+}
+
+// runObserver 收集 RunWithOptions 回调的运行计划与汇总；
+// 字段为 nil 表示运行在对应阶段之前就已结束（如参数校验失败）。
+type runObserver struct {
+	plan    *RunPlan
+	summary *RunSummary
+}
+
+func (o *runObserver) attach(opts *RunOptions) {
+	opts.OnPlan = func(p RunPlan) { o.plan = &p }
+	opts.OnSummary = func(s RunSummary) { o.summary = &s }
+}
+
+// addImageProcessing 有参考图时在响应中说明它是否被重新编码及原因，便于理解上传图与原图的差异。
+func addImageProcessing(resp map[string]any, opts RunOptions) {
+	if opts.ImagePath == "" {
+		return
+	}
+	resp["imageProcessed"] = opts.ImageProcessReason != ""
+	if opts.ImageProcessReason != "" {
+		resp["processReason"] = opts.ImageProcessReason
+	}
+}
+
+// writeRunResponse 输出 /run 的响应，json 与 multipart 共用。
+// 带 ?inline=1 时在结果中附带 base64 图片，适用于无法访问画廊地址的客户端。
+func writeRunResponse(w http.ResponseWriter, r *http.Request, mode string, opts RunOptions, imageOrig string, obs *runObserver, results []ScenarioResult, runErr error) {
+	recordIdempotentRun(r, mode, opts, imageOrig, obs, results, runErr)
+	resp := map[string]any{
+		"results": results,
+	}
+	if obs.summary != nil {
+		resp["summary"] = obs.summary
+	}
+	if plan := obs.plan; plan != nil {
+		resp["requestedScenarioCount"] = plan.RequestedScenarioCount
+		resp["effectiveScenarioCount"] = plan.EffectiveScenarioCount
+		resp["availableProxies"] = plan.AvailableProxies
+		if plan.DirectScenarioCount > 0 {
+			resp["directScenarioCount"] = plan.DirectScenarioCount
+		}
+		if plan.Note != "" {
+			resp["note"] = plan.Note
+		}
+		if plan.AspectWarning != "" {
+			resp["aspectWarning"] = plan.AspectWarning
+		}
+	}
+	addImageProcessing(resp, opts)
+	if r.URL.Query().Get("inline") == "1" {
+		if truncated := attachInlineImages(results, envInt64("INLINE_MAX_BYTES", defaultInlineMaxBytes)); truncated {
+			resp["inlineTruncated"] = true
+		}
 	}
-	fmt.Printf("▶️ /run (multipart) file=%s processed=%s scenario=%d res=%s aspect=%s temp=%.1f promptLen=%d\n", filename, finalProcessPath, opts.ScenarioCount, opts.OutputRes, opts.AspectRatio, opts.Temperature, len(opts.PromptText))
-	results, runErr := runWithExclusive(r.Context(), opts)
 	if runErr != nil {
-		status := http.StatusInternalServerError
-		msg := runErr.Error()
-		if errors.Is(runErr, context.Canceled) {
-			status = http.StatusConflict
-			msg = "cancelled"
-		}
-		fmt.Printf("⚠️ /run (multipart) end err=%v\n", runErr)
-		writeJSON(w, status, map[string]any{
-			"error":   msg,
-			"results": results,
-		})
+		status, code, msg := runErrorInfo(runErr)
+		if wait, ok := retryAfterHint(runErr); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+			resp["retryAfter"] = retryAfterSeconds(wait)
+		}
+		fmt.Printf("⚠️ /run (%s) end err=%v\n", mode, runErr)
+		writeErrorData(w, status, code, msg, resp)
 		return
 	}
-	fmt.Printf("✅ /run (multipart) done scenario=%d res=%s results=%d\n", opts.ScenarioCount, opts.OutputRes, len(results))
-	writeJSON(w, http.StatusOK, map[string]any{
-		"status":        "ok",
-		"imageUsed":     finalProcessPath,
-		"imageOrig":     filename,
-		"scenarioCount": opts.ScenarioCount,
-		"results":       results,
-	})
+	fmt.Printf("✅ /run (%s) done scenario=%d res=%s results=%d\n", mode, opts.ScenarioCount, opts.OutputRes, len(results))
+	if partial, failed := partialOutcome(results); partial {
+		fmt.Printf("⚠️ /run (%s) 部分成功：%d/%d 个场景未下载成功\n", mode, failed, len(results))
+		resp["partial"] = true
+		resp["failedCount"] = failed
+	}
+	resp["imageUsed"] = opts.ImagePath
+	resp["imageOrig"] = imageOrig
+	resp["scenarioCount"] = opts.ScenarioCount
+	resp["temperature"] = opts.Temperature
+	if opts.TemperaturePreset != "" {
+		resp["temperaturePreset"] = opts.TemperaturePreset
+	}
+	writeOK(w, http.StatusOK, resp)
+}
+
+// partialOutcome 判断是否部分成功（既有场景下载成功、也有场景未成功），返回未成功的场景数。
+func partialOutcome(results []ScenarioResult) (bool, int) {
+	failed := 0
+	for _, r := range results {
+		if r.Outcome != steps.DownloadOutcomeDownloaded {
+			failed++
+		}
+	}
+	return failed > 0 && failed < len(results), failed
+}
+
+// defaultInlineMaxBytes 是 inline 模式下所有图片原始字节的总上限
+const defaultInlineMaxBytes int64 = 64 * 1024 * 1024
+
+// attachInlineImages 读取已下载的图片并以 base64 写入结果，超过总上限后停止附带，返回是否被截断。
+func attachInlineImages(results []ScenarioResult, limit int64) bool {
+	var total int64
+	truncated := false
+	for i := range results {
+		if results[i].Path == "" {
+			continue
+		}
+		info, err := os.Stat(results[i].Path)
+		if err != nil {
+			continue
+		}
+		if limit > 0 && total+info.Size() > limit {
+			truncated = true
+			continue
+		}
+		data, err := os.ReadFile(results[i].Path)
+		if err != nil {
+			continue
+		}
+		total += int64(len(data))
+		results[i].ImageBase64 = base64.StdEncoding.EncodeToString(data)
+	}
+	return truncated
+}
+
+// runErrorInfo 将运行错误映射为 HTTP 状态码、错误码和返回给客户端的消息。
+func runErrorInfo(err error) (int, string, string) {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return http.StatusConflict, ErrorCodeCancelled, "cancelled"
+	case errors.Is(err, ErrNoProxyAvailable):
+		return http.StatusServiceUnavailable, "NO_PROXY", err.Error()
+	case errors.Is(err, errProxiesExcluded):
+		return http.StatusBadRequest, "NO_PROXY", err.Error()
+	case errors.Is(err, errProxiesBusy):
+		return http.StatusServiceUnavailable, "PROXY_BUSY", err.Error()
+	case errors.Is(err, errQuotaCooldown):
+		return http.StatusTooManyRequests, "QUOTA_COOLDOWN", err.Error()
+	case errors.Is(err, errRunsPaused):
+		return http.StatusServiceUnavailable, "PAUSED", err.Error()
+	case errors.Is(err, errTooManyRuns):
+		return http.StatusTooManyRequests, errorCodeForStatus(http.StatusTooManyRequests), err.Error()
+	case errors.Is(err, ErrDownloadDirFull):
+		return http.StatusInsufficientStorage, "DISK_FULL", err.Error()
+	case errors.Is(err, errSafetyBlocked):
+		return http.StatusUnprocessableEntity, ErrorCodeSafety, err.Error()
+	case errors.Is(err, ErrBrowserNotInstalled):
+		return http.StatusServiceUnavailable, "BROWSER_NOT_INSTALLED", err.Error()
+	default:
+		return http.StatusInternalServerError, errorCodeForStatus(http.StatusInternalServerError), err.Error()
+	}
+}
+
+// apiError 是统一响应中的错误信息。
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// apiResponse 是所有 HTTP 接口统一的响应结构，客户端只需一种解析方式。
+type apiResponse struct {
+	OK    bool      `json:"ok"`
+	Error *apiError `json:"error,omitempty"`
+	Data  any       `json:"data,omitempty"`
+}
+
+func writeOK(w http.ResponseWriter, status int, data any) {
+	writeJSON(w, status, apiResponse{OK: true, Data: data})
+}
+
+// writeError 输出错误响应，错误码由状态码推导。
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeErrorData(w, status, errorCodeForStatus(status), message, nil)
+}
+
+// writeErrorData 输出带错误码的错误响应，data 可携带部分结果。
+func writeErrorData(w http.ResponseWriter, status int, code, message string, data any) {
+	writeJSON(w, status, apiResponse{OK: false, Error: &apiError{Code: code, Message: message}, Data: data})
+}
+
+func errorCodeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "BAD_REQUEST"
+	case http.StatusUnauthorized:
+		return "UNAUTHORIZED"
+	case http.StatusForbidden:
+		return "FORBIDDEN"
+	case http.StatusNotFound:
+		return "NOT_FOUND"
+	case http.StatusMethodNotAllowed:
+		return "METHOD_NOT_ALLOWED"
+	case http.StatusConflict:
+		return "CONFLICT"
+	case http.StatusRequestEntityTooLarge:
+		return "TOO_LARGE"
+	case http.StatusUnsupportedMediaType:
+		return "UNSUPPORTED_MEDIA_TYPE"
+	case http.StatusTooManyRequests:
+		return "TOO_MANY_REQUESTS"
+	case http.StatusBadGateway:
+		return "UPSTREAM"
+	case http.StatusServiceUnavailable:
+		return "UNAVAILABLE"
+	case http.StatusInsufficientStorage:
+		return "INSUFFICIENT_STORAGE"
+	default:
+		return "INTERNAL"
+	}
 }
 
 func writeJSON(w http.ResponseWriter, status int, v any) {
@@ -442,13 +1101,13 @@ func writeJSON(w http.ResponseWriter, status int, v any) {
 
 func handleGallery(w http.ResponseWriter, r *http.Request) {
 	dir := DefaultRunOptions().DownloadDir
-	folders, total, err := listGalleryFolders(dir)
+	folders, total, err := listGalleryFolders(os.DirFS(dir), dir)
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("list gallery: %v", err)})
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("list gallery: %v", err))
 		return
 	}
 	fmt.Printf("ℹ️ /gallery folders=%d files=%d dir=%s\n", len(folders), total, dir)
-	writeJSON(w, http.StatusOK, map[string]any{
+	writeOK(w, http.StatusOK, map[string]any{
 		"dir":     dir,
 		"count":   total,
 		"folders": folders,
@@ -469,19 +1128,16 @@ type galleryGroup struct {
 	Latest time.Time     `json:"latest"`
 }
 
-func listGalleryFolders(dir string) ([]galleryGroup, int, error) {
+// listGalleryFolders 列出 fsys（以下载目录 dir 为根）中包含图片的批次文件夹，dir 仅用于拼接访问地址。
+func listGalleryFolders(fsys fs.FS, dir string) ([]galleryGroup, int, error) {
 	dir = filepath.Clean(dir)
-	entries, err := os.ReadDir(dir)
-	if err != nil {
+	if _, err := fs.ReadDir(fsys, "."); err != nil {
 		return nil, 0, err
 	}
 	var groups []galleryGroup
 	total := 0
-	for _, e := range entries {
-		if !e.IsDir() {
-			continue
-		}
-		files, err := listFolderFiles(dir, e.Name())
+	for _, folder := range galleryBatchFolders(fsys) {
+		files, err := listFolderFiles(fsys, folder)
 		if err != nil || len(files) == 0 {
 			continue
 		}
@@ -489,7 +1145,7 @@ func listGalleryFolders(dir string) ([]galleryGroup, int, error) {
 			return files[i].ModTime.After(files[j].ModTime)
 		})
 		groups = append(groups, galleryGroup{
-			Name:   e.Name(),
+			Name:   folder,
 			Count:  len(files),
 			Files:  nil,
 			Latest: files[0].ModTime,
@@ -502,81 +1158,558 @@ func listGalleryFolders(dir string) ([]galleryGroup, int, error) {
 	return groups, total, nil
 }
 
+// datePartitionLayout 是 OUTPUT_DATE_PARTITION 开启时日期分区文件夹的命名格式
+const datePartitionLayout = "2006-01-02"
+
+// isDatePartition 判断下载目录下的一级文件夹是否为日期分区（如 2024-06-01）。
+func isDatePartition(name string) bool {
+	_, err := time.Parse(datePartitionLayout, name)
+	return err == nil
+}
+
+// galleryBatchFolders 返回 fsys 中的批次文件夹（斜杠分隔）：日期分区文件夹向下多走一层，
+// 返回 "2024-06-01/batch"；其他一级文件夹原样返回，开关切换前的批次仍然可见。
+// 批次下的节点子文件夹不单独列出，其中的图片由 galleryImages 归入所属批次。
+func galleryBatchFolders(fsys fs.FS) []string {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil
+	}
+	var folders []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if !isDatePartition(e.Name()) {
+			folders = append(folders, e.Name())
+			continue
+		}
+		sub, err := fs.ReadDir(fsys, e.Name())
+		if err != nil {
+			continue
+		}
+		for _, s := range sub {
+			if s.IsDir() {
+				folders = append(folders, e.Name()+"/"+s.Name())
+			}
+		}
+	}
+	return folders
+}
+
+// galleryFolderParts 去掉可选的日期分区前缀，返回批次及其下的节点子文件夹（OUTPUT_PROXY_TAG=folder）。
+func galleryFolderParts(folder string) []string {
+	parts := strings.Split(folder, "/")
+	if len(parts) > 1 && isDatePartition(parts[0]) {
+		parts = parts[1:]
+	}
+	return parts
+}
+
+// validGalleryFolder 判断 folder 是否为批次文件夹名：可选的日期分区、批次，以及可选的节点子文件夹，
+// 如 "batch"、"2024-06-01/batch"、"batch/tag"、"2024-06-01/batch/tag"。
+func validGalleryFolder(folder string) bool {
+	if folder == "" || strings.Contains(folder, "..") || strings.Contains(folder, `\`) {
+		return false
+	}
+	parts := galleryFolderParts(folder)
+	if len(parts) > 2 {
+		return false
+	}
+	for _, part := range parts {
+		if part == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// galleryImage 是批次文件夹中的一张图片，rel 为相对下载目录的斜杠路径。
+type galleryImage struct {
+	rel  string
+	info fs.FileInfo
+}
+
+// galleryImages 返回 fsys 中 folder 下的图片（folder 为 "." 表示下载目录本身）。
+// nested 为 true 时向下多走一层：OUTPUT_PROXY_TAG=folder 会在批次下按节点建子文件夹，
+// 其中的图片仍归属该批次。隐藏文件夹不展开。
+func galleryImages(fsys fs.FS, folder string, formats []string, nested bool) []galleryImage {
+	entries, err := fs.ReadDir(fsys, folder)
+	if err != nil {
+		return nil
+	}
+	var out []galleryImage
+	for _, e := range entries {
+		rel := path.Join(folder, e.Name())
+		if e.IsDir() {
+			if nested && !strings.HasPrefix(e.Name(), ".") {
+				out = append(out, galleryImages(fsys, rel, formats, false)...)
+			}
+			continue
+		}
+		if !isGalleryImage(e.Name(), formats) {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		out = append(out, galleryImage{rel: rel, info: fi})
+	}
+	return out
+}
+
+// galleryRefScheme 前缀用于在 /run 中引用画廊里已生成的图片，例如 gallery://folder/name.png
+const galleryRefScheme = "gallery://"
+
+// resolveGalleryRef 将 gallery://folder/name.png 解析为下载目录下的真实路径，并校验其为可处理的图片。
+func resolveGalleryRef(baseDir, ref string) (string, error) {
+	rel := strings.TrimPrefix(strings.TrimSpace(ref), galleryRefScheme)
+	i := strings.LastIndex(rel, "/")
+	if i < 0 {
+		return "", fmt.Errorf("gallery 引用格式应为 gallery://folder/name.png: %s", ref)
+	}
+	folder, name := rel[:i], rel[i+1:]
+	if name == "" || !validGalleryFolder(folder) {
+		return "", fmt.Errorf("gallery 引用格式应为 gallery://folder/name.png: %s", ref)
+	}
+	if strings.Contains(rel, "..") || strings.Contains(rel, `\`) {
+		return "", fmt.Errorf("invalid gallery reference: %s", ref)
+	}
+	target := filepath.Join(baseDir, filepath.FromSlash(folder), name)
+	info, err := os.Stat(target)
+	if err != nil {
+		return "", fmt.Errorf("gallery 图片不存在: %s", ref)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("gallery 引用不是文件: %s", ref)
+	}
+	format, err := imageprocessing.DetectFileFormat(target)
+	if err != nil {
+		return "", fmt.Errorf("读取 gallery 图片失败: %w", err)
+	}
+	if !imageprocessing.IsDecodableFormat(format) {
+		return "", fmt.Errorf("gallery 引用不是图片: %s", ref)
+	}
+	return target, nil
+}
+
+// 提示词长度限制：超长会被控制台截断，过短通常是误操作
+const (
+	defaultMaxPromptChars = 10000
+	minPromptCharsWarning = 5
+)
+
+// checkPromptLength 按 MAX_PROMPT_CHARS（字符数）拒绝超长提示词，过短时只打印警告。
+func checkPromptLength(prompt string) error {
+	n := utf8.RuneCountInString(prompt)
+	if limit := envInt("MAX_PROMPT_CHARS", defaultMaxPromptChars); limit > 0 && n > limit {
+		return fmt.Errorf("prompt 过长：%d 字符，上限 %d（MAX_PROMPT_CHARS）", n, limit)
+	}
+	if n < minPromptCharsWarning {
+		fmt.Printf("⚠️ prompt 只有 %d 个字符，生成结果可能不理想\n", n)
+	}
+	return nil
+}
+
+// maxPromptFileBytes 是 promptFile 的大小上限
+const maxPromptFileBytes = 256 * 1024
+
+// promptGalleryPrefix 表示复用画廊图片中内嵌的提示词（EMBED_METADATA 写入），如 @gallery://folder/name.png
+const promptGalleryPrefix = "@" + galleryRefScheme
+
+// resolvePrompt 返回最终的提示词：promptFile 优先，其次是 @gallery:// 引用，否则原样返回 prompt。
+func resolvePrompt(baseDir, prompt, promptFile string) (string, error) {
+	if promptFile = strings.TrimSpace(promptFile); promptFile != "" {
+		return readPromptFile(promptFile)
+	}
+	if strings.HasPrefix(prompt, promptGalleryPrefix) {
+		return readGalleryPrompt(baseDir, strings.TrimPrefix(prompt, "@"))
+	}
+	return prompt, nil
+}
+
+// readPromptFile 读取服务器上的文本文件作为提示词。文件必须位于 PROMPT_FILE_DIR 内；
+// 未配置 PROMPT_FILE_DIR 时拒绝 promptFile，避免通过 /run 读取服务器上的任意文件。
+func readPromptFile(path string) (string, error) {
+	clean := filepath.Clean(path)
+	dir := strings.TrimSpace(os.Getenv("PROMPT_FILE_DIR"))
+	if dir == "" {
+		return "", errors.New("未配置 PROMPT_FILE_DIR，不支持 promptFile")
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("PROMPT_FILE_DIR 无效: %w", err)
+	}
+	absPath, err := filepath.Abs(clean)
+	if err != nil {
+		return "", fmt.Errorf("promptFile 无效: %w", err)
+	}
+	if rel, err := filepath.Rel(absDir, absPath); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("promptFile 必须位于 %s 内: %s", dir, path)
+	}
+	info, err := os.Stat(clean)
+	if err != nil {
+		return "", fmt.Errorf("promptFile 不可用: %v", err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("promptFile 不是文件: %s", path)
+	}
+	if info.Size() > maxPromptFileBytes {
+		return "", fmt.Errorf("promptFile 超过 %d 字节上限", maxPromptFileBytes)
+	}
+	data, err := os.ReadFile(clean)
+	if err != nil {
+		return "", fmt.Errorf("读取 promptFile 失败: %v", err)
+	}
+	if !utf8.Valid(data) {
+		return "", fmt.Errorf("promptFile 不是 UTF-8 文本: %s", path)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// readGalleryPrompt 读取 gallery:// 引用的画廊图片中内嵌的提示词。
+func readGalleryPrompt(baseDir, ref string) (string, error) {
+	imagePath, err := resolveGalleryRef(baseDir, ref)
+	if err != nil {
+		return "", err
+	}
+	prompt, err := embeddedPrompt(imagePath)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", ref, err)
+	}
+	return prompt, nil
+}
+
+// embeddedPrompt 读取 PNG 内嵌的 prompt 文本块（EMBED_METADATA 写入）。
+func embeddedPrompt(imagePath string) (string, error) {
+	fields, err := imageprocessing.ReadPNGText(imagePath)
+	if err != nil || strings.TrimSpace(fields[metaKeyPrompt]) == "" {
+		return "", errors.New("图片中没有保存提示词（需开启 EMBED_METADATA）")
+	}
+	return strings.TrimSpace(fields[metaKeyPrompt]), nil
+}
+
 func handleGalleryFiles(w http.ResponseWriter, r *http.Request) {
 	folder := strings.TrimSpace(r.URL.Query().Get("folder"))
 	dir := DefaultRunOptions().DownloadDir
-	files, err := listFolderFiles(dir, folder)
+	files, err := listFolderFiles(os.DirFS(dir), folder)
 	if err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("list folder: %v", err)})
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("list folder: %v", err))
 		return
 	}
 	sort.Slice(files, func(i, j int) bool {
 		return files[i].ModTime.After(files[j].ModTime)
 	})
-	writeJSON(w, http.StatusOK, map[string]any{
+	writeOK(w, http.StatusOK, map[string]any{
 		"folder": folder,
 		"count":  len(files),
 		"files":  files,
 	})
 }
 
-func listFolderFiles(baseDir, folder string) ([]galleryFile, error) {
-	if strings.Contains(folder, "..") || strings.Contains(folder, string(filepath.Separator)) {
+// minPruneOlderThan 是 /gallery/prune 中 olderThan 的下限，避免误删刚生成的图片
+const minPruneOlderThan = time.Hour
+
+// handleGalleryPrune 按 {keepPerFolder:N} 和/或 {olderThan:"72h"} 清理画廊，返回删除的图片数。
+// 只接受 application/json 请求体（由 requireAdmin 保护），避免跨站表单提交触发删除。
+func handleGalleryPrune(w http.ResponseWriter, r *http.Request) {
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+		writeError(w, http.StatusUnsupportedMediaType, "Content-Type 必须为 application/json")
+		return
+	}
+	var body struct {
+		KeepPerFolder *int   `json:"keepPerFolder"`
+		OlderThan     string `json:"olderThan"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("decode body: %v", err))
+		return
+	}
+	keep := 0
+	if body.KeepPerFolder != nil {
+		// 0 会清空整个画廊，视为误操作
+		if *body.KeepPerFolder < 1 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("keepPerFolder 必须 >= 1: %d", *body.KeepPerFolder))
+			return
+		}
+		keep = *body.KeepPerFolder
+	}
+	var olderThan time.Duration
+	if raw := strings.TrimSpace(body.OlderThan); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("olderThan 无效: %s", raw))
+			return
+		}
+		if d < minPruneOlderThan {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("olderThan 不能小于 %s: %s", minPruneOlderThan, raw))
+			return
+		}
+		olderThan = d
+	}
+	if keep == 0 && olderThan == 0 {
+		writeError(w, http.StatusBadRequest, "需要指定 keepPerFolder 或 olderThan")
+		return
+	}
+	dir := DefaultRunOptions().DownloadDir
+	res, err := pruneGalleryFiles(dir, keep, olderThan)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("prune gallery: %v", err))
+		return
+	}
+	fmt.Printf("🧹 /gallery/prune 完成：删除 %d 张图片（%d 个批次），释放 %d 字节\n", res.Removed, res.Folders, res.Freed)
+	writeOK(w, http.StatusOK, res)
+}
+
+// listFolderFiles 列出 fsys（下载目录）中 folder 下的图片文件，包括批次下节点子文件夹中的图片。
+func listFolderFiles(fsys fs.FS, folder string) ([]galleryFile, error) {
+	if folder != "" && !validGalleryFolder(folder) {
 		return nil, fmt.Errorf("invalid folder")
 	}
-	target := filepath.Join(baseDir, folder)
-	info, err := os.Stat(target)
+	fsFolder := folder
+	if fsFolder == "" {
+		fsFolder = "."
+	}
+	if !fs.ValidPath(fsFolder) {
+		return nil, fmt.Errorf("invalid folder")
+	}
+	info, err := fs.Stat(fsys, fsFolder)
 	if err != nil {
 		return nil, err
 	}
 	if !info.IsDir() {
 		return nil, fmt.Errorf("not a folder")
 	}
-	entries, err := os.ReadDir(target)
-	if err != nil {
+	if _, err := fs.ReadDir(fsys, fsFolder); err != nil {
 		return nil, err
 	}
+	// 下载目录本身与节点子文件夹不再向下展开
+	nested := folder != "" && len(galleryFolderParts(folder)) == 1
 	var files []galleryFile
-	for _, e := range entries {
-		if e.IsDir() {
-			continue
-		}
-		if strings.ToLower(filepath.Ext(e.Name())) != ".png" {
-			continue
-		}
-		fi, err := e.Info()
-		if err != nil {
-			continue
-		}
-		rel := filepath.Join(folder, e.Name())
+	for _, img := range galleryImages(fsys, fsFolder, galleryFormats(), nested) {
+		rel := filepath.FromSlash(img.rel)
 		files = append(files, galleryFile{
 			Name:    rel,
-			URL:     "/" + filepath.ToSlash(filepath.Join(baseDir, rel)),
-			Size:    fi.Size(),
-			ModTime: fi.ModTime(),
+			URL:     galleryURL(rel),
+			Size:    img.info.Size(),
+			ModTime: img.info.ModTime(),
 		})
 	}
 	return files, nil
 }
 
+// downloadURLPrefix 是下载目录对外暴露的 URL 前缀，与磁盘上的目录名无关。
+const downloadURLPrefix = "/tmp/"
+
+// galleryURL 将相对下载目录的文件路径转换为文件服务下的根相对 URL。
+func galleryURL(rel string) string {
+	return downloadURLPrefix + strings.TrimPrefix(filepath.ToSlash(filepath.Clean(rel)), "/")
+}
+
+// nonGalleryDirs 是下载目录下不属于画廊的一级子目录：sing-box 配置（含节点凭据）与 Playwright 追踪文件（含 cookie）。
+var nonGalleryDirs = map[string]bool{
+	"singbox":    true,
+	traceDirName: true,
+}
+
+// servableGalleryFile 判断 rel（斜杠分隔、已清理）是否为可公开提供的画廊图片：
+// 位于合法的批次文件夹中、扩展名属于画廊格式、不是隐藏文件，且不在 nonGalleryDirs 下。
+func servableGalleryFile(rel string) bool {
+	if rel == "" || !fs.ValidPath(rel) {
+		return false
+	}
+	folder, name := path.Split(rel)
+	folder = strings.TrimSuffix(folder, "/")
+	if !validGalleryFolder(folder) || strings.HasPrefix(name, ".") || !isGalleryImage(name, galleryFormats()) {
+		return false
+	}
+	for _, part := range strings.Split(folder, "/") {
+		if strings.HasPrefix(part, ".") {
+			return false
+		}
+	}
+	return !nonGalleryDirs[strings.SplitN(folder, "/", 2)[0]]
+}
+
+// galleryFileHandler 提供下载目录中批次文件夹里的图片：基于 http.ServeContent，支持 HEAD、Range（断点续传/分段读取）
+// 与 If-Modified-Since 等条件请求，Content-Type 按扩展名确定；不列出目录，其他文件（sing-box 配置、追踪文件、
+// 隐藏文件与未完成的 .part 文件等）一律返回 404。
+func galleryFileHandler(dir string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "only GET/HEAD allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		rel := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		base := path.Base(rel)
+		if !servableGalleryFile(rel) {
+			http.NotFound(w, r)
+			return
+		}
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(rel)))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		http.ServeContent(w, r, base, info.ModTime(), f)
+	})
+}
+
+func handleProxyLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "only GET allowed")
+		return
+	}
+	tail := 200
+	if raw := strings.TrimSpace(r.URL.Query().Get("tail")); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "tail 必须是非负整数")
+			return
+		}
+		tail = n
+	}
+	lines := proxy.SingBoxLogs(tail)
+	writeOK(w, http.StatusOK, map[string]any{
+		"count": len(lines),
+		"lines": lines,
+	})
+}
+
+// handleProxyRefresh 强制重新拉取订阅（忽略 outbounds 缓存），返回新的节点数量；拉取失败时返回 502，原缓存保持不变。
+func handleProxyRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "only POST allowed")
+		return
+	}
+	stats, err := proxy.RefreshOutbounds(r.Context())
+	if err != nil {
+		writeError(w, http.StatusBadGateway, fmt.Sprintf("refresh subscriptions: %v", err))
+		return
+	}
+	fmt.Printf("🔄 /proxy/refresh 完成：%s\n", stats)
+	writeOK(w, http.StatusOK, map[string]any{
+		"nodeCount": stats.Usable,
+		"nodeStats": stats,
+	})
+}
+
+// handleProxyHealthcheck 经由每个节点请求探测地址，返回按节点顺序排列的结果。
+func handleProxyHealthcheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "only POST allowed")
+		return
+	}
+	endpoints, release := sharedProxyPool.borrowAll()
+	defer release()
+	if len(endpoints) == 0 {
+		writeError(w, http.StatusServiceUnavailable, "没有可用的代理节点")
+		return
+	}
+	start := time.Now()
+	results := proxy.ProbeEndpoints(r.Context(), endpoints)
+	healthy := 0
+	for _, res := range results {
+		if res.OK {
+			healthy++
+		}
+	}
+	fmt.Printf("🩺 /proxy/healthcheck 完成：%d/%d 个节点可用，耗时 %s\n", healthy, len(results), time.Since(start).Round(time.Millisecond))
+	writeOK(w, http.StatusOK, map[string]any{
+		"total":   len(results),
+		"healthy": healthy,
+		"results": results,
+	})
+}
+
+// handleProxyConfig 返回最近一次生成的 sing-box 配置与各节点端口，默认脱敏节点凭据，?redact=0 时返回原文。
+// 配置包含节点信息，因此需要管理令牌。
+func handleProxyConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "only GET allowed")
+		return
+	}
+	redact := r.URL.Query().Get("redact") != "0"
+	cfg, endpoints, err := proxy.CurrentConfig(redact)
+	if errors.Is(err, fs.ErrNotExist) {
+		writeError(w, http.StatusNotFound, "sing-box 配置尚未生成")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeOK(w, http.StatusOK, map[string]any{
+		"redacted":  redact,
+		"count":     len(endpoints),
+		"endpoints": endpoints,
+		"config":    cfg,
+	})
+}
+
+// subscriptionsView 区分环境变量订阅（已脱敏）与存储订阅，并给出 StartSingBox 实际使用的合并列表。
+func subscriptionsView(stored []string) map[string]any {
+	envSubs := proxy.EnvSubs()
+	isEnv := map[string]bool{}
+	maskedEnv := make([]string, 0, len(envSubs))
+	for _, u := range envSubs {
+		isEnv[u] = true
+		maskedEnv = append(maskedEnv, proxy.MaskSubURL(u))
+	}
+	effectiveSubs := proxy.EffectiveSubs()
+	effective := []string{}
+	for _, u := range effectiveSubs {
+		if isEnv[u] {
+			u = proxy.MaskSubURL(u)
+		}
+		effective = append(effective, u)
+	}
+	if stored == nil {
+		stored = []string{}
+	}
+	health, cached := proxy.SubscriptionsHealth(len(effectiveSubs))
+	return map[string]any{
+		"subscriptions":       stored,
+		"storedSubscriptions": stored,
+		"envSubscriptions":    maskedEnv,
+		"envCount":            len(envSubs),
+		"effective":           effective,
+		// health 与 effective 一一对应：每个订阅缓存的节点数与其中可分配/冷却/冻结的节点数
+		"health":       health,
+		"healthCached": cached,
+	}
+}
+
 func handleProxySubscriptions(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		writeJSON(w, http.StatusOK, map[string]any{
-			"storedSubscriptions": proxy.LoadStoredSubs(),
-			"effective":           proxy.LoadStoredSubs(), // 环境变量订阅不回传
-		})
+		resp := subscriptionsView(proxy.LoadStoredSubs())
+		resp["nodeStats"] = proxy.LastOutboundStats()
+		writeOK(w, http.StatusOK, resp)
 	case http.MethodPost:
 		var body struct {
 			URL string `json:"url"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("decode body: %v", err)})
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("decode body: %v", err))
 			return
 		}
 		url := strings.TrimSpace(body.URL)
 		if url == "" {
-			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "url 不能为空"})
+			writeError(w, http.StatusBadRequest, "url 不能为空")
+			return
+		}
+		if err := proxy.ValidateSubscription(url); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
 			return
 		}
 		subs := proxy.LoadStoredSubs()
@@ -588,21 +1721,17 @@ func handleProxySubscriptions(w http.ResponseWriter, r *http.Request) {
 			subs = append(subs, url)
 		}
 		if err := proxy.SaveSubs(subs); err != nil {
-			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("save subs: %v", err)})
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("save subs: %v", err))
 			return
 		}
 		go proxy.WarmupSingBox(context.Background())
-		writeJSON(w, http.StatusOK, map[string]any{
-			"subscriptions":       subs,
-			"storedSubscriptions": subs,
-			"effective":           subs,
-		})
+		writeOK(w, http.StatusOK, subscriptionsView(subs))
 	case http.MethodPut:
 		var body struct {
 			URLs []string `json:"urls"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("decode body: %v", err)})
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("decode body: %v", err))
 			return
 		}
 		var cleaned []string
@@ -612,20 +1741,41 @@ func handleProxySubscriptions(w http.ResponseWriter, r *http.Request) {
 			if u == "" || seen[u] {
 				continue
 			}
+			if err := proxy.ValidateSubscription(u); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
 			seen[u] = true
 			cleaned = append(cleaned, u)
 		}
 		if err := proxy.SaveSubs(cleaned); err != nil {
-			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("save subs: %v", err)})
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("save subs: %v", err))
 			return
 		}
 		go proxy.WarmupSingBox(context.Background())
-		writeJSON(w, http.StatusOK, map[string]any{
-			"subscriptions":       cleaned,
-			"storedSubscriptions": cleaned,
-			"effective":           cleaned,
-		})
+		writeOK(w, http.StatusOK, subscriptionsView(cleaned))
 	case http.MethodDelete:
+		// ?index=N 按存储列表中的位置删除，便于界面中截断显示的长地址
+		if raw := strings.TrimSpace(r.URL.Query().Get("index")); raw != "" {
+			idx, err := strconv.Atoi(raw)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("index 无效: %s", raw))
+				return
+			}
+			subs := proxy.LoadStoredSubs()
+			if idx < 0 || idx >= len(subs) {
+				writeError(w, http.StatusNotFound, fmt.Sprintf("index 越界: %d（共 %d 个订阅）", idx, len(subs)))
+				return
+			}
+			filtered := append(append([]string{}, subs[:idx]...), subs[idx+1:]...)
+			if err := proxy.SaveSubs(filtered); err != nil {
+				writeError(w, http.StatusInternalServerError, fmt.Sprintf("save subs: %v", err))
+				return
+			}
+			go proxy.WarmupSingBox(context.Background())
+			writeOK(w, http.StatusOK, subscriptionsView(filtered))
+			return
+		}
 		url := strings.TrimSpace(r.URL.Query().Get("url"))
 		if url == "" {
 			var body struct {
@@ -635,7 +1785,7 @@ func handleProxySubscriptions(w http.ResponseWriter, r *http.Request) {
 			url = strings.TrimSpace(body.URL)
 		}
 		if url == "" {
-			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "url 不能为空"})
+			writeError(w, http.StatusBadRequest, "url 不能为空")
 			return
 		}
 		subs := proxy.LoadStoredSubs()
@@ -646,16 +1796,12 @@ func handleProxySubscriptions(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		if err := proxy.SaveSubs(filtered); err != nil {
-			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("save subs: %v", err)})
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("save subs: %v", err))
 			return
 		}
 		go proxy.WarmupSingBox(context.Background())
-		writeJSON(w, http.StatusOK, map[string]any{
-			"subscriptions":       filtered,
-			"storedSubscriptions": filtered,
-			"effective":           filtered,
-		})
+		writeOK(w, http.StatusOK, subscriptionsView(filtered))
 	default:
-		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "only GET/POST/PUT/DELETE allowed"})
+		writeError(w, http.StatusMethodNotAllowed, "only GET/POST/PUT/DELETE allowed")
 	}
 }
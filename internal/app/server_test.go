@@ -0,0 +1,38 @@
+package app
+
+import (
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestListGalleryFoldersFromFS(t *testing.T) {
+	older := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+	fsys := fstest.MapFS{
+		"a/1.png":       {Data: []byte("1"), ModTime: older},
+		"b/2.png":       {Data: []byte("2"), ModTime: older},
+		"b/3.png":       {Data: []byte("3"), ModTime: newer},
+		"b/notes.txt":   {Data: []byte("x"), ModTime: newer},
+		"empty/x.txt":   {Data: []byte("x"), ModTime: newer},
+		"loose.png":     {Data: []byte("x"), ModTime: newer},
+		"c/nested/4.md": {Data: []byte("x"), ModTime: newer},
+	}
+	groups, total, err := listGalleryFolders(fsys, "tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 3 {
+		t.Errorf("total = %d, want 3", total)
+	}
+	if len(groups) != 2 {
+		t.Fatalf("groups = %+v, want a and b", groups)
+	}
+	// 按最新图片的修改时间倒序
+	if groups[0].Name != "b" || groups[0].Count != 2 || !groups[0].Latest.Equal(newer) {
+		t.Errorf("groups[0] = %+v, want b with 2 files, latest %s", groups[0], newer)
+	}
+	if groups[1].Name != "a" || groups[1].Count != 1 {
+		t.Errorf("groups[1] = %+v, want a with 1 file", groups[1])
+	}
+}
@@ -0,0 +1,237 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"vertex-nano-banana-unlimited/internal/imageprocessing"
+)
+
+const (
+	// maxUploadInputBytes 是上传原图（处理前）的大小上限，超过时在读取过程中即中止
+	maxUploadInputBytes int64 = 32 << 20
+	// maxFormFieldBytes 是 multipart 中单个文本字段的大小上限
+	maxFormFieldBytes int64 = 1 << 20
+	// maxFormFieldsTotalBytes 是 multipart 中所有文本字段合计的大小上限
+	maxFormFieldsTotalBytes int64 = 4 << 20
+	// maxFormParts 是 multipart 中字段数（含被忽略的字段）的上限
+	maxFormParts = 200
+	// maxMultipartRunBytes 是 /run multipart 请求体的总上限：图片、文本字段，再留 1MB 给分隔符与字段头
+	maxMultipartRunBytes = maxUploadInputBytes + maxFormFieldsTotalBytes + 1<<20
+)
+
+// errUploadTooLarge 表示上传内容超过大小上限
+var errUploadTooLarge = errors.New("上传内容过大")
+
+// uploadedImage 是以流方式读入内存的上传图片
+type uploadedImage struct {
+	Filename    string
+	ContentType string // 客户端声明的 MIME 类型，可能为空或与真实格式不符
+	Data        []byte
+}
+
+// readMultipartRun 以流方式读取 /run 的 multipart 请求：图片字段直接读入内存（读取中即检查上限），
+// 不再经过 ParseMultipartForm 的临时文件；文本字段写回 r.Form，原有的 r.FormValue 调用保持可用。
+// 请求体总大小、字段数与文本字段合计大小都有上限，超过时返回 errUploadTooLarge。
+// 没有上传图片时返回的 *uploadedImage 为 nil。
+func readMultipartRun(w http.ResponseWriter, r *http.Request) (*uploadedImage, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxMultipartRunBytes)
+	// 预读请求体开头，用于识别“声明 multipart 实为 JSON”的请求
+	br := bufio.NewReader(r.Body)
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{br, r.Body}
+	head, _ := br.Peek(64)
+	if looksLikeJSON(head) {
+		return nil, fmt.Errorf("%w：Content-Type 为 multipart/form-data，但请求体看起来是 JSON；发送 JSON 时请使用 Content-Type: application/json", errMalformedMultipart)
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, describeMultipartError(err, 0)
+	}
+	form := url.Values{}
+	var img *uploadedImage
+	parts := 0
+	var fieldBytes int64
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, describeMultipartError(err, parts)
+		}
+		parts++
+		if parts > maxFormParts {
+			part.Close()
+			return nil, fmt.Errorf("%w（字段数超过 %d）", errUploadTooLarge, maxFormParts)
+		}
+		name := part.FormName()
+		if name == "" {
+			part.Close()
+			continue
+		}
+		if part.FileName() != "" {
+			if name != "image" {
+				part.Close()
+				continue
+			}
+			data, err := readLimited(part, maxUploadInputBytes)
+			part.Close()
+			if err != nil {
+				return nil, fmt.Errorf("image: %w", describeMultipartError(err, parts))
+			}
+			img = &uploadedImage{Filename: part.FileName(), ContentType: part.Header.Get("Content-Type"), Data: data}
+			continue
+		}
+		value, err := readLimited(part, min(maxFormFieldBytes, maxFormFieldsTotalBytes-fieldBytes))
+		part.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, describeMultipartError(err, parts))
+		}
+		fieldBytes += int64(len(value))
+		form.Add(name, string(value))
+	}
+	for k, vs := range r.URL.Query() {
+		for _, v := range vs {
+			form.Add(k, v)
+		}
+	}
+	r.Form = form
+	r.PostForm = form
+	return img, nil
+}
+
+// errMalformedMultipart 表示 multipart 请求体或其 Content-Type 格式错误
+var errMalformedMultipart = errors.New("multipart 请求格式错误")
+
+// looksLikeJSON 判断请求体开头是否像 JSON 对象或数组。
+func looksLikeJSON(head []byte) bool {
+	head = bytes.TrimLeft(head, " \t\r\n")
+	return len(head) > 0 && (head[0] == '{' || head[0] == '[')
+}
+
+// describeMultipartError 将 mime/multipart 的简短错误转换为指导客户端修正的说明；parts 为已读到的字段数。
+// 上传超限等其他错误原样返回。
+func describeMultipartError(err error, parts int) error {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return fmt.Errorf("%w（请求体上限 %d 字节）", errUploadTooLarge, tooLarge.Limit)
+	case errors.Is(err, http.ErrMissingBoundary):
+		return fmt.Errorf("%w：Content-Type 缺少 boundary 参数。使用 FormData 时不要手动设置 Content-Type，由客户端自动生成（含 boundary）", errMalformedMultipart)
+	case errors.Is(err, http.ErrNotMultipart):
+		return fmt.Errorf("%w：Content-Type 不是 multipart/form-data", errMalformedMultipart)
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF) && parts > 0:
+		return fmt.Errorf("%w：请求体被截断（缺少结束分隔符 --boundary--），请检查上传是否完整或是否超过代理的请求体限制", errMalformedMultipart)
+	case errors.Is(err, io.EOF):
+		return fmt.Errorf("%w：请求体中没有找到任何字段，可能为空或 boundary 与 Content-Type 中声明的不一致", errMalformedMultipart)
+	default:
+		return err
+	}
+}
+
+// readLimited 读取至多 limit 字节，超过时返回 errUploadTooLarge。
+func readLimited(rd io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(rd, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%w（上限 %d 字节）", errUploadTooLarge, limit)
+	}
+	return data, nil
+}
+
+// prepareUploadForRun 直接在内存中识别并（必要时）处理上传图片，最终只写一次运行临时目录。
+// 第二个返回值为重新编码的原因，空表示使用原图。
+func prepareUploadForRun(img *uploadedImage, tempDir string) (string, string, error) {
+	format := imageprocessing.DetectFormat(img.Data)
+	if err := checkDecodableFormat(format); err != nil {
+		return "", "", err
+	}
+	ext := uploadExt(img, format)
+	if reason := imageProcessReason(int64(len(img.Data)), ext, format); reason != "" {
+		path, err := processImageForRun(img.Data, ext, format, tempDir)
+		return path, reason, err
+	}
+	path, err := writeRunTempFile(tempDir, "upload-*"+ext, img.Data)
+	return path, "", err
+}
+
+// extForContentType 返回 MIME 类型对应的标准扩展名，无法识别时返回空字符串。
+func extForContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	switch mediaType {
+	case "image/png":
+		return imageprocessing.ExtForFormat(imageprocessing.FormatPNG)
+	case "image/jpeg", "image/jpg", "image/pjpeg":
+		return imageprocessing.ExtForFormat(imageprocessing.FormatJPEG)
+	case "image/gif":
+		return imageprocessing.ExtForFormat(imageprocessing.FormatGIF)
+	case "image/bmp", "image/x-ms-bmp":
+		return imageprocessing.ExtForFormat(imageprocessing.FormatBMP)
+	case "image/tiff":
+		return imageprocessing.ExtForFormat(imageprocessing.FormatTIFF)
+	case "image/webp":
+		return imageprocessing.ExtForFormat(imageprocessing.FormatWEBP)
+	case "image/svg+xml":
+		return imageprocessing.ExtForFormat(imageprocessing.FormatSVG)
+	default:
+		return ""
+	}
+}
+
+// uploadExt 为上传图片选择扩展名：依次采用与真实格式一致的文件名扩展名、声明的 MIME 类型，
+// 都不一致时使用嗅探到的格式。这样 "blob" 之类没有扩展名的 PNG 不会被无谓地重新编码。
+func uploadExt(img *uploadedImage, format string) string {
+	for _, ext := range []string{strings.ToLower(filepath.Ext(img.Filename)), extForContentType(img.ContentType)} {
+		if imageprocessing.ExtMatchesFormat(ext, format) {
+			return ext
+		}
+	}
+	return imageprocessing.ExtForFormat(format)
+}
+
+// dataURIPrefix 标识 JSON /run 中以 data URI 内联的图片，如 data:image/png;base64,...
+const dataURIPrefix = "data:"
+
+// decodeDataURIImage 解码 base64 data URI 形式的图片，大小上限与 multipart 上传相同。
+// 文件名按声明的类型生成（inline-<时间戳>.<ext>），用作批次名称。
+func decodeDataURIImage(raw string) (*uploadedImage, error) {
+	meta, payload, ok := strings.Cut(strings.TrimPrefix(raw, dataURIPrefix), ",")
+	if !ok || !strings.HasSuffix(meta, ";base64") {
+		return nil, errors.New("image data URI 须为 data:<mime>;base64,<数据>")
+	}
+	contentType := strings.TrimSuffix(meta, ";base64")
+	if int64(base64.StdEncoding.DecodedLen(len(payload))) > maxUploadInputBytes+2 {
+		return nil, fmt.Errorf("image: %w（上限 %d 字节）", errUploadTooLarge, maxUploadInputBytes)
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(payload))
+	if err != nil {
+		return nil, fmt.Errorf("image data URI 解码失败: %w", err)
+	}
+	ext := extForContentType(contentType)
+	if ext == "" {
+		ext = imageprocessing.ExtForFormat(imageprocessing.DetectFormat(data))
+	}
+	return &uploadedImage{
+		Filename:    fmt.Sprintf("inline-%d%s", time.Now().Unix(), ext),
+		ContentType: contentType,
+		Data:        data,
+	}, nil
+}
@@ -0,0 +1,53 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadMultipartRunLimits(t *testing.T) {
+	build := func(fields int, size int) *http.Request {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		value := strings.Repeat("x", size)
+		for i := 0; i < fields; i++ {
+			if err := mw.WriteField(fmt.Sprintf("f%d", i), value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := mw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/run", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		return req
+	}
+
+	tests := []struct {
+		name    string
+		fields  int
+		size    int
+		tooLong bool
+	}{
+		{name: "small form", fields: 3, size: 10},
+		{name: "too many parts", fields: maxFormParts + 1, size: 1, tooLong: true},
+		{name: "fields over combined cap", fields: 5, size: int(maxFormFieldBytes), tooLong: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readMultipartRun(httptest.NewRecorder(), build(tt.fields, tt.size))
+			if tt.tooLong != errors.Is(err, errUploadTooLarge) {
+				t.Fatalf("readMultipartRun() error = %v, want too large = %v", err, tt.tooLong)
+			}
+			if !tt.tooLong && err != nil {
+				t.Fatalf("readMultipartRun() error = %v", err)
+			}
+		})
+	}
+}
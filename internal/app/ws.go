@@ -0,0 +1,126 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsUpgrader 与 CORS 策略保持一致，允许所有来源。
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsClientMessage 是客户端发送的消息：{type:"run", ...runRequest} 或 {type:"cancel"}。
+type wsClientMessage struct {
+	Type string `json:"type"`
+	runRequest
+}
+
+// handleWebSocket 在同一连接上提交运行、接收进度/结果并支持取消。
+// 服务端消息：{type:"started",token}、{type:"plan",plan}、{type:"progress",...ProgressEvent}、{type:"result",results,summary,partial?,failedCount?} 与 {type:"error",error{code,message},status}。
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		fmt.Printf("⚠️ /ws upgrade failed: %v\n", err)
+		return
+	}
+	defer conn.Close()
+
+	var writeMu sync.Mutex
+	send := func(v map[string]any) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		_ = conn.WriteJSON(v)
+	}
+	sendError := func(status int, code, msg string, results []ScenarioResult) {
+		send(map[string]any{"type": "error", "status": status, "error": apiError{Code: code, Message: msg}, "results": results})
+	}
+
+	// 连接断开时取消正在进行的运行
+	ctx, cancelConn := context.WithCancel(r.Context())
+	defer cancelConn()
+
+	var (
+		runMu     sync.Mutex
+		runCancel context.CancelFunc
+	)
+	for {
+		var msg wsClientMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		switch msg.Type {
+		case "run":
+			runMu.Lock()
+			busy := runCancel != nil
+			runMu.Unlock()
+			if busy {
+				sendError(http.StatusConflict, errorCodeForStatus(http.StatusConflict), "当前连接已有运行中的任务", nil)
+				continue
+			}
+			req := msg.runRequest
+			opts, status, err := req.toRunOptions()
+			if err != nil {
+				sendError(status, errorCodeForStatus(status), err.Error(), nil)
+				continue
+			}
+			opts.OnProgress = func(ev ProgressEvent) {
+				send(map[string]any{
+					"type":     "progress",
+					"scenario": ev.Scenario,
+					"step":     ev.Step,
+					"status":   ev.Status,
+					"message":  ev.Message,
+				})
+			}
+			opts.OnPlan = func(p RunPlan) {
+				send(map[string]any{"type": "plan", "plan": p})
+			}
+			var summary *RunSummary
+			opts.OnSummary = func(s RunSummary) { summary = &s }
+			runCtx, cancel := context.WithCancel(ctx)
+			runMu.Lock()
+			runCancel = cancel
+			runMu.Unlock()
+
+			fmt.Printf("▶️ /ws run scenario=%d res=%s aspect=%s promptLen=%d\n", opts.ScenarioCount, opts.OutputRes, opts.AspectRatio, len(opts.PromptText))
+			go func() {
+				defer func() {
+					cancel()
+					removeRunTempDir(opts.TempDir)
+					runMu.Lock()
+					runCancel = nil
+					runMu.Unlock()
+				}()
+				results, runErr := runs.run(runCtx, opts, func(token int64) {
+					send(map[string]any{"type": "started", "token": token})
+				})
+				if runErr != nil {
+					status, code, msg := runErrorInfo(runErr)
+					fmt.Printf("⚠️ /ws run end err=%v\n", runErr)
+					sendError(status, code, msg, results)
+					return
+				}
+				msg := map[string]any{"type": "result", "results": results, "summary": summary}
+				addImageProcessing(msg, opts)
+				if partial, failed := partialOutcome(results); partial {
+					msg["partial"] = true
+					msg["failedCount"] = failed
+				}
+				send(msg)
+			}()
+		case "cancel":
+			runMu.Lock()
+			if runCancel != nil {
+				runCancel()
+			}
+			runMu.Unlock()
+		default:
+			sendError(http.StatusBadRequest, errorCodeForStatus(http.StatusBadRequest), fmt.Sprintf("unknown message type %q", msg.Type), nil)
+		}
+	}
+}
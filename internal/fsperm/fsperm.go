@@ -0,0 +1,52 @@
+// Package fsperm 提供统一的目录与文件权限，可通过 DIR_PERM / FILE_PERM（八进制）覆盖。
+package fsperm
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultDirPerm  os.FileMode = 0o755
+	defaultFilePerm os.FileMode = 0o644
+)
+
+var (
+	once     sync.Once
+	dirPerm  = defaultDirPerm
+	filePerm = defaultFilePerm
+)
+
+// Dir 返回创建目录使用的权限，默认 0755（仍受进程 umask 影响）。
+func Dir() os.FileMode {
+	once.Do(load)
+	return dirPerm
+}
+
+// File 返回写入文件使用的权限，默认 0644（仍受进程 umask 影响）。
+func File() os.FileMode {
+	once.Do(load)
+	return filePerm
+}
+
+func load() {
+	dirPerm = parsePerm("DIR_PERM", defaultDirPerm)
+	filePerm = parsePerm("FILE_PERM", defaultFilePerm)
+}
+
+// parsePerm 解析八进制权限（如 "750" 或 "0o750"），非法时使用默认值。
+func parsePerm(name string, def os.FileMode) os.FileMode {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return def
+	}
+	v, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(raw), "0o"), 8, 32)
+	if err != nil || v > 0o777 {
+		fmt.Printf("⚠️ %s=%q 不是有效的八进制权限，使用默认值 %#o\n", name, raw, def)
+		return def
+	}
+	return os.FileMode(v)
+}
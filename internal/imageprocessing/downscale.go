@@ -0,0 +1,69 @@
+package imageprocessing
+
+import (
+	"bytes"
+	"fmt"
+	"image/jpeg"
+	"image/png"
+	"os"
+
+	"github.com/disintegration/imaging"
+
+	"vertex-nano-banana-unlimited/internal/fsperm"
+)
+
+// Dimensions 图片的宽高（像素）
+type Dimensions struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// downscaleJPEGQuality 缩小 JPEG 时重新编码使用的质量
+const downscaleJPEGQuality = 92
+
+// CapLongestSide 将图片的最长边限制在 maxSide 以内，按比例缩小后原地覆盖，保持原格式（PNG/JPEG）。
+// 返回原始与保存后的尺寸；未超出或 maxSide<=0 时不改写文件，两者相同。
+// 写入采用临时文件 + 重命名，失败时不破坏原文件。
+func CapLongestSide(path string, maxSide int) (orig, saved Dimensions, err error) {
+	// 按字节解码：下载目录可能是绝对路径，decodeImage 的路径校验不允许
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return orig, saved, err
+	}
+	format := DetectFormat(data)
+	img, _, err := decodeImage(data)
+	if err != nil {
+		return orig, saved, err
+	}
+	b := img.Bounds()
+	orig = Dimensions{Width: b.Dx(), Height: b.Dy()}
+	if maxSide <= 0 || max(orig.Width, orig.Height) <= maxSide {
+		return orig, orig, nil
+	}
+
+	resized := imaging.Fit(img, maxSide, maxSide, imaging.Lanczos)
+	var buf bytes.Buffer
+	switch format {
+	case FormatPNG:
+		enc := png.Encoder{CompressionLevel: png.BestCompression}
+		err = enc.Encode(&buf, resized)
+	case FormatJPEG:
+		err = jpeg.Encode(&buf, resized, &jpeg.Options{Quality: downscaleJPEGQuality})
+	default:
+		return orig, orig, fmt.Errorf("不支持缩小该格式的图片: %q", format)
+	}
+	if err != nil {
+		return orig, orig, fmt.Errorf("encode downscaled image: %w", err)
+	}
+
+	tmp := path + ".scale.tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), fsperm.File()); err != nil {
+		return orig, orig, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return orig, orig, err
+	}
+	rb := resized.Bounds()
+	return orig, Dimensions{Width: rb.Dx(), Height: rb.Dy()}, nil
+}
@@ -0,0 +1,109 @@
+package imageprocessing
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// 图片格式常量（与 DetectFormat 的返回值对应）
+const (
+	FormatPNG     = "png"
+	FormatJPEG    = "jpeg"
+	FormatGIF     = "gif"
+	FormatBMP     = "bmp"
+	FormatTIFF    = "tiff"
+	FormatWEBP    = "webp"
+	FormatSVG     = "svg"
+	FormatUnknown = ""
+)
+
+// sniffLen 嗅探格式时读取的头部字节数
+const sniffLen = 512
+
+// DetectFormat 根据魔数判断图片的真实格式，无法识别时返回 FormatUnknown
+func DetectFormat(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1a\n")):
+		return FormatPNG
+	case bytes.HasPrefix(header, []byte{0xFF, 0xD8, 0xFF}):
+		return FormatJPEG
+	case bytes.HasPrefix(header, []byte("GIF87a")), bytes.HasPrefix(header, []byte("GIF89a")):
+		return FormatGIF
+	case bytes.HasPrefix(header, []byte("BM")):
+		return FormatBMP
+	case bytes.HasPrefix(header, []byte("II*\x00")), bytes.HasPrefix(header, []byte("MM\x00*")):
+		return FormatTIFF
+	case len(header) >= 12 && bytes.Equal(header[:4], []byte("RIFF")) && bytes.Equal(header[8:12], []byte("WEBP")):
+		return FormatWEBP
+	}
+	trimmed := bytes.TrimSpace(header)
+	if bytes.HasPrefix(trimmed, []byte("<?xml")) || bytes.HasPrefix(trimmed, []byte("<svg")) {
+		if bytes.Contains(bytes.ToLower(header), []byte("<svg")) {
+			return FormatSVG
+		}
+	}
+	return FormatUnknown
+}
+
+// DetectFileFormat 读取文件头部并判断图片格式
+func DetectFileFormat(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return FormatUnknown, err
+	}
+	defer f.Close()
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return FormatUnknown, fmt.Errorf("read image header: %w", err)
+	}
+	return DetectFormat(buf[:n]), nil
+}
+
+// IsDecodableFormat 判断 ProcessImage 能否解码该格式
+func IsDecodableFormat(format string) bool {
+	switch format {
+	case FormatPNG, FormatJPEG, FormatGIF, FormatBMP, FormatTIFF:
+		return true
+	default:
+		return false
+	}
+}
+
+// ExtForFormat 返回格式对应的标准扩展名
+func ExtForFormat(format string) string {
+	switch format {
+	case FormatPNG:
+		return ".png"
+	case FormatJPEG:
+		return ".jpg"
+	case FormatGIF:
+		return ".gif"
+	case FormatBMP:
+		return ".bmp"
+	case FormatTIFF:
+		return ".tiff"
+	case FormatWEBP:
+		return ".webp"
+	case FormatSVG:
+		return ".svg"
+	default:
+		return ""
+	}
+}
+
+// ExtMatchesFormat 判断扩展名是否与真实格式一致（兼容 .jpeg/.tif 等别名）
+func ExtMatchesFormat(ext, format string) bool {
+	ext = strings.ToLower(ext)
+	switch format {
+	case FormatJPEG:
+		return ext == ".jpg" || ext == ".jpeg"
+	case FormatTIFF:
+		return ext == ".tif" || ext == ".tiff"
+	default:
+		return ext != "" && ext == ExtForFormat(format)
+	}
+}
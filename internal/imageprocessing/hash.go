@@ -0,0 +1,59 @@
+package imageprocessing
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+
+	"github.com/disintegration/imaging"
+)
+
+// hashSize 是平均哈希使用的缩略图边长（8x8 = 64 位）
+const hashSize = 8
+
+// Fingerprint 是图片的平均哈希与亮度统计，用于识别空白图和重复图
+type Fingerprint struct {
+	Hash   uint64  // 平均哈希（aHash）
+	StdDev float64 // 缩略图灰度的标准差（0-255），接近 0 表示近乎纯色
+}
+
+// HexHash 以 16 位十六进制返回哈希
+func (f Fingerprint) HexHash() string {
+	return fmt.Sprintf("%016x", f.Hash)
+}
+
+// FingerprintFile 解码图片并计算平均哈希与亮度标准差
+func FingerprintFile(path string) (Fingerprint, error) {
+	img, _, err := decodeImage(path)
+	if err != nil {
+		return Fingerprint{}, err
+	}
+	thumb := imaging.Grayscale(imaging.Resize(img, hashSize, hashSize, imaging.Box))
+
+	var lum [hashSize * hashSize]float64
+	var sum float64
+	for y := 0; y < hashSize; y++ {
+		for x := 0; x < hashSize; x++ {
+			v := float64(thumb.Pix[y*thumb.Stride+x*4]) // 灰度图 R=G=B
+			lum[y*hashSize+x] = v
+			sum += v
+		}
+	}
+	mean := sum / float64(len(lum))
+
+	var fp Fingerprint
+	var variance float64
+	for i, v := range lum {
+		if v >= mean {
+			fp.Hash |= 1 << uint(i)
+		}
+		variance += (v - mean) * (v - mean)
+	}
+	fp.StdDev = math.Sqrt(variance / float64(len(lum)))
+	return fp, nil
+}
+
+// HashDistance 返回两个哈希的汉明距离，越小越相似
+func HashDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
@@ -6,6 +6,8 @@ import (
 	"os"
 
 	"github.com/disintegration/imaging"
+
+	"vertex-nano-banana-unlimited/internal/fsperm"
 )
 
 // ProcessImageOptions 通用图片优化选项
@@ -80,6 +82,18 @@ func ProcessImage(input interface{}, options ProcessImageOptions) ([]byte, strin
 		return nil, "", fmt.Errorf("failed to decode image: %w", err)
 	}
 
+	// 用户指定了最大尺寸时先按比例缩小到范围内（不放大）
+	if b := img.Bounds(); calculateUserScaleFactor(b.Dx(), b.Dy(), options.MaxWidth, options.MaxHeight) < 1.0 {
+		w, h := options.MaxWidth, options.MaxHeight
+		if w <= 0 {
+			w = b.Dx()
+		}
+		if h <= 0 {
+			h = b.Dy()
+		}
+		img = imaging.Fit(img, w, h, imaging.Lanczos)
+	}
+
 	// 获取原始尺寸
 	originalBounds := img.Bounds()
 	originalWidth := originalBounds.Dx()
@@ -157,7 +171,7 @@ func ProcessImageToFile(input interface{}, outputPath string, options ProcessIma
 		outputPath += ext
 	}
 
-	return os.WriteFile(outputPath, data, 0644)
+	return os.WriteFile(outputPath, data, fsperm.File())
 }
 
 // ProcessImageToTempFile 安全地处理图片并保存到临时文件
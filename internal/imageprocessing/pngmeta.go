@@ -0,0 +1,160 @@
+package imageprocessing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+
+	"vertex-nano-banana-unlimited/internal/fsperm"
+)
+
+// pngSignature 是 PNG 文件头的 8 字节签名
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// errNotPNG 表示文件不是有效的 PNG
+var errNotPNG = errors.New("不是有效的 PNG 文件")
+
+// EmbedPNGText 将键值对以 iTXt（UTF-8）块写入 PNG 文件，插入在 IEND 之前。
+// 同名关键字的旧文本块会被替换，写入采用临时文件 + 重命名，失败时不破坏原文件。
+func EmbedPNGText(path string, fields map[string]string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	chunks, err := splitPNGChunks(data)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		if k == "" || len(k) > 79 {
+			return fmt.Errorf("PNG 文本关键字长度需为 1-79: %q", k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var out bytes.Buffer
+	out.Write(pngSignature)
+	for _, c := range chunks {
+		if c.typ == "IEND" {
+			for _, k := range keys {
+				writePNGChunk(&out, "iTXt", iTXtPayload(k, fields[k]))
+			}
+		}
+		if (c.typ == "iTXt" || c.typ == "tEXt") && fields[textKeyword(c.data)] != "" {
+			continue
+		}
+		writePNGChunk(&out, c.typ, c.data)
+	}
+
+	tmp := path + ".meta.tmp"
+	if err := os.WriteFile(tmp, out.Bytes(), fsperm.File()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// ReadPNGText 读取 PNG 中 tEXt 与未压缩 iTXt 块的键值对。
+func ReadPNGText(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := splitPNGChunks(data)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]string{}
+	for _, c := range chunks {
+		switch c.typ {
+		case "tEXt":
+			if k, v, ok := bytes.Cut(c.data, []byte{0}); ok {
+				fields[string(k)] = string(v)
+			}
+		case "iTXt":
+			// keyword\0 compressionFlag compressionMethod languageTag\0 translatedKeyword\0 text
+			k, rest, ok := bytes.Cut(c.data, []byte{0})
+			if !ok || len(rest) < 2 || rest[0] != 0 {
+				continue // 忽略压缩的 iTXt
+			}
+			_, rest, ok = bytes.Cut(rest[2:], []byte{0})
+			if !ok {
+				continue
+			}
+			_, text, ok := bytes.Cut(rest, []byte{0})
+			if !ok {
+				continue
+			}
+			fields[string(k)] = string(text)
+		}
+	}
+	return fields, nil
+}
+
+type pngChunk struct {
+	typ  string
+	data []byte
+}
+
+// splitPNGChunks 按块拆分 PNG 数据，要求以 IEND 结尾。
+func splitPNGChunks(data []byte) ([]pngChunk, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errNotPNG
+	}
+	var chunks []pngChunk
+	rest := data[len(pngSignature):]
+	for len(rest) >= 12 {
+		n := binary.BigEndian.Uint32(rest[:4])
+		if uint64(n)+12 > uint64(len(rest)) {
+			return nil, fmt.Errorf("%w: 块长度越界", errNotPNG)
+		}
+		c := pngChunk{typ: string(rest[4:8]), data: rest[8 : 8+n]}
+		chunks = append(chunks, c)
+		rest = rest[12+n:]
+		if c.typ == "IEND" {
+			return chunks, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: 缺少 IEND", errNotPNG)
+}
+
+func writePNGChunk(w *bytes.Buffer, typ string, data []byte) {
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[:4], uint32(len(data)))
+	copy(hdr[4:], typ)
+	w.Write(hdr[:])
+	w.Write(data)
+	crc := crc32.NewIEEE()
+	crc.Write(hdr[4:])
+	crc.Write(data)
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc.Sum32())
+	w.Write(sum[:])
+}
+
+// iTXtPayload 构造未压缩、无语言标签的 iTXt 块内容。
+func iTXtPayload(key, value string) []byte {
+	var b bytes.Buffer
+	b.WriteString(key)
+	b.Write([]byte{0, 0, 0}) // 关键字结束、不压缩、压缩方式
+	b.WriteByte(0)           // 语言标签为空
+	b.WriteByte(0)           // 翻译关键字为空
+	b.WriteString(value)
+	return b.Bytes()
+}
+
+// textKeyword 返回 tEXt/iTXt 块的关键字。
+func textKeyword(data []byte) string {
+	k, _, _ := bytes.Cut(data, []byte{0})
+	return string(k)
+}
@@ -3,14 +3,18 @@ package proxy
 import (
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+
+	"vertex-nano-banana-unlimited/internal/fsperm"
 )
 
 const singboxSubsFile = "tmp/singbox/subscriptions.json"
 
-// loadSavedSubs returns subscription URLs stored on disk (editable by API).
+// LoadStoredSubs returns subscription URLs stored on disk (editable by API).
+// A missing or corrupt file yields an empty list.
 func LoadStoredSubs() []string {
 	data, err := os.ReadFile(singboxSubsFile)
 	if err != nil {
@@ -18,20 +22,21 @@ func LoadStoredSubs() []string {
 	}
 	var subs []string
 	if err := json.Unmarshal(data, &subs); err != nil {
+		fmt.Printf("⚠️ 订阅文件 %s 已损坏，按空列表处理: %v\n", singboxSubsFile, err)
 		return nil
 	}
 	return subs
 }
 
 func SaveSubs(subs []string) error {
-	if err := os.MkdirAll(filepath.Dir(singboxSubsFile), 0o755); err != nil {
+	if err := os.MkdirAll(filepath.Dir(singboxSubsFile), fsperm.Dir()); err != nil {
 		return fmt.Errorf("make subs dir: %w", err)
 	}
 	data, err := json.MarshalIndent(subs, "", "  ")
 	if err != nil {
 		return fmt.Errorf("marshal subs: %w", err)
 	}
-	if err := os.WriteFile(singboxSubsFile, data, 0o644); err != nil {
+	if err := writeFileAtomic(singboxSubsFile, data, fsperm.File()); err != nil {
 		return err
 	}
 	// 删除 outbounds 缓存，确保下次启动 sing-box 时重新拉取新订阅
@@ -52,6 +57,64 @@ func ParseEnvSubs(envVal string) []string {
 	return out
 }
 
+// EnvSubs returns subscription URLs provided via PROXY_SINGBOX_SUB_URLS.
+func EnvSubs() []string {
+	return ParseEnvSubs(os.Getenv(singboxSubEnv))
+}
+
+// EffectiveSubs returns the merged env + stored list actually used by StartSingBox.
+func EffectiveSubs() []string {
+	return MergeEnvAndSaved(os.Getenv(singboxSubEnv))
+}
+
+// localSubPrefix 是本地订阅文件的前缀，如 file:///etc/sing-box/nodes.json 或 file://nodes.json（相对工作目录）
+const localSubPrefix = "file://"
+
+// SubscriptionFilePath 对 file:// 订阅返回本地文件路径。
+func SubscriptionFilePath(raw string) (string, bool) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(raw), localSubPrefix)
+	if !ok || rest == "" {
+		return "", false
+	}
+	if p, err := url.PathUnescape(rest); err == nil {
+		rest = p
+	}
+	return filepath.FromSlash(rest), true
+}
+
+// ValidateSubscription 检查通过 API 保存的订阅：file:// 订阅会让服务读取本机任意文件，
+// 只能通过 PROXY_SINGBOX_SUB_URLS 配置；远程订阅的内容在拉取时校验，这里直接放行。
+func ValidateSubscription(raw string) error {
+	if strings.HasPrefix(strings.TrimSpace(raw), localSubPrefix) {
+		return fmt.Errorf("本地订阅（%s）只能通过 %s 配置", localSubPrefix, singboxSubEnv)
+	}
+	return nil
+}
+
+// localSubAllowed 判断 file:// 订阅是否来自 PROXY_SINGBOX_SUB_URLS；订阅文件中保存的 file:// 条目不会被读取。
+func localSubAllowed(raw string) bool {
+	raw = strings.TrimSpace(raw)
+	for _, sub := range EnvSubs() {
+		if sub == raw {
+			return true
+		}
+	}
+	return false
+}
+
+// MaskSubURL 隐藏订阅地址中的路径、查询参数与用户信息（通常包含 token），只保留协议和主机。
+// 本地订阅只保留文件名。
+func MaskSubURL(raw string) string {
+	if path, ok := SubscriptionFilePath(raw); ok {
+		return localSubPrefix + "***/" + filepath.Base(path)
+	}
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || u.Host == "" {
+		return "***"
+	}
+	return u.Scheme + "://" + u.Host + "/***"
+}
+
 // MergeEnvAndSaved combines env-provided URLs and saved URLs with de-duplication.
 func MergeEnvAndSaved(envVal string) []string {
 	seen := map[string]bool{}
@@ -72,3 +135,28 @@ func MergeEnvAndSaved(envVal string) []string {
 	}
 	return out
 }
+
+// writeFileAtomic 先写入同目录的临时文件再重命名，避免写入中途崩溃留下半截文件。
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // 重命名成功后为空操作
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, path)
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// chdirTemp 切换到临时目录，订阅文件使用相对工作目录的路径。
+func chdirTemp(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+}
+
+func TestSaveSubsSurvivesPartialWrite(t *testing.T) {
+	chdirTemp(t)
+	want := []string{"https://example.com/a.json", "https://example.com/b.json"}
+	if err := SaveSubs(want); err != nil {
+		t.Fatal(err)
+	}
+
+	// 写入中途崩溃只会留下截断的临时文件，已保存的订阅不受影响
+	leftover := filepath.Join(filepath.Dir(singboxSubsFile), filepath.Base(singboxSubsFile)+".tmp-crash")
+	if err := os.WriteFile(leftover, []byte(`["https://example.com/c.js`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got := LoadStoredSubs(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("LoadStoredSubs() after interrupted write = %v, want %v", got, want)
+	}
+
+	// 原地写入被截断的文件按空列表处理，之后可以重新保存
+	if err := os.WriteFile(singboxSubsFile, []byte(`["https://exa`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got := LoadStoredSubs(); got != nil {
+		t.Fatalf("LoadStoredSubs() on corrupt file = %v, want nil", got)
+	}
+	if err := SaveSubs(want[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if got := LoadStoredSubs(); !reflect.DeepEqual(got, want[:1]) {
+		t.Fatalf("LoadStoredSubs() after resave = %v, want %v", got, want[:1])
+	}
+}
+
+func TestLoadStoredSubsMissingFile(t *testing.T) {
+	chdirTemp(t)
+	if got := LoadStoredSubs(); got != nil {
+		t.Fatalf("LoadStoredSubs() without file = %v, want nil", got)
+	}
+}
+
+func TestParseSubscriptionRejectsGzipBomb(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(bytes.Repeat([]byte(" "), maxSubscriptionBytes+1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := parseSubscription(buf.Bytes()); err == nil || !strings.Contains(err.Error(), "上限") {
+		t.Fatalf("parseSubscription(gzip bomb) error = %v, want size limit error", err)
+	}
+}
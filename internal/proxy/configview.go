@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// redactedValue 替换脱敏字段的值
+const redactedValue = "***"
+
+// secretConfigKeys 是 outbound 中携带凭据的字段，脱敏时在任意层级替换其值。
+var secretConfigKeys = map[string]bool{
+	"password":       true,
+	"uuid":           true,
+	"private_key":    true,
+	"pre_shared_key": true,
+	"psk":            true,
+	"auth":           true,
+	"auth_str":       true,
+	"token":          true,
+}
+
+// ConfigEndpoint 是生成的配置中一个 socks 入站及其路由到的节点。
+type ConfigEndpoint struct {
+	Tag     string `json:"tag"`
+	Inbound string `json:"inbound"`
+	Port    int    `json:"port"`
+	URL     string `json:"url"`
+}
+
+// CurrentConfig 读取最近一次 StartSingBox 写出的 config.json，并按入站路由规则列出各节点的端口。
+// redact 为 true 时将节点凭据替换为 "***"。配置尚未生成时返回 os.ErrNotExist。
+func CurrentConfig(redact bool) (map[string]any, []ConfigEndpoint, error) {
+	data, err := os.ReadFile(singboxConfigFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	var cfg map[string]any
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, nil, fmt.Errorf("解析 %s 失败: %w", singboxConfigFile, err)
+	}
+	endpoints := configEndpoints(cfg)
+	if redact {
+		redactSecrets(cfg)
+	}
+	return cfg, endpoints, nil
+}
+
+// configEndpoints 将 route.rules 中 inbound → outbound 的映射与 socks 入站的监听端口对应起来。
+func configEndpoints(cfg map[string]any) []ConfigEndpoint {
+	outboundFor := map[string]string{}
+	route, _ := cfg["route"].(map[string]any)
+	rules, _ := route["rules"].([]any)
+	for _, r := range rules {
+		rule, _ := r.(map[string]any)
+		outbound, _ := rule["outbound"].(string)
+		inbounds, _ := rule["inbound"].([]any)
+		for _, in := range inbounds {
+			if tag, ok := in.(string); ok {
+				outboundFor[tag] = outbound
+			}
+		}
+	}
+	inbounds, _ := cfg["inbounds"].([]any)
+	endpoints := make([]ConfigEndpoint, 0, len(inbounds))
+	for _, raw := range inbounds {
+		in, _ := raw.(map[string]any)
+		inTag, _ := in["tag"].(string)
+		listen, _ := in["listen"].(string)
+		port, _ := in["listen_port"].(float64)
+		endpoints = append(endpoints, ConfigEndpoint{
+			Tag:     outboundFor[inTag],
+			Inbound: inTag,
+			Port:    int(port),
+			URL:     fmt.Sprintf("socks5://%s", net.JoinHostPort(listen, strconv.Itoa(int(port)))),
+		})
+	}
+	return endpoints
+}
+
+// redactSecrets 递归替换 secretConfigKeys 中字段的值。
+func redactSecrets(v any) {
+	switch node := v.(type) {
+	case map[string]any:
+		for k, child := range node {
+			if secretConfigKeys[k] {
+				if s, ok := child.(string); !ok || s != "" {
+					node[k] = redactedValue
+				}
+				continue
+			}
+			redactSecrets(child)
+		}
+	case []any:
+		for _, child := range node {
+			redactSecrets(child)
+		}
+	}
+}
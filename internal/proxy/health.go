@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SubscriptionHealth 是单个生效订阅当前贡献的节点情况，按节点 tag 的 subN- 前缀归属。
+type SubscriptionHealth struct {
+	Index     int `json:"index"`     // 在生效订阅列表中的位置（从 0 开始）
+	Cached    int `json:"cached"`    // 缓存中经关键字过滤后的节点数
+	Usable    int `json:"usable"`    // 节点池实际可分配的节点数：未超出 PROXY_MAX_NODES 且未硬冻结（含冷却中的节点）
+	Penalized int `json:"penalized"` // 冷却或硬冻结中的节点数
+	Frozen    int `json:"frozen"`    // 其中硬冻结的节点数
+}
+
+// SubscriptionsHealth 结合 outbounds 缓存与冷却记录，统计前 count 个生效订阅的节点情况。
+// Usable 与节点池的分配规则一致：按 PROXY_MAX_NODES 截断后，排除硬冻结的节点（见 OrderByCooldown）。
+// 没有缓存时 cached 为 false，各订阅的计数均为 0。
+func SubscriptionsHealth(count int) (health []SubscriptionHealth, cached bool) {
+	health = make([]SubscriptionHealth, count)
+	for i := range health {
+		health[i].Index = i
+	}
+
+	outbounds, err := readCachedOutbounds()
+	if err != nil {
+		return health, false
+	}
+
+	penaltyMu.Lock()
+	penalties, err := readPenaltiesFile(singboxPenalty)
+	penaltyMu.Unlock()
+	if err != nil {
+		penalties = map[string]penalty{}
+	}
+
+	now := time.Now()
+	limit := proxyMaxNodes()
+	for i, ob := range outbounds {
+		tag, _ := ob["tag"].(string)
+		idx, ok := subIndexFromTag(tag)
+		if !ok || idx >= count {
+			continue
+		}
+		h := &health[idx]
+		h.Cached++
+		p, penalized := penalties[tag]
+		penalized = penalized && now.Before(p.Until)
+		if penalized {
+			h.Penalized++
+			if p.hard() {
+				h.Frozen++
+			}
+		}
+		// 超出 PROXY_MAX_NODES 的节点不会创建入站
+		if (limit <= 0 || i < limit) && !(penalized && p.hard()) {
+			h.Usable++
+		}
+	}
+	return health, true
+}
+
+// CachedTags 返回 outbounds 缓存中的节点 tag（与 buildConfig 的命名规则一致），
+// 没有缓存时 cached 为 false。
+func CachedTags() (tags []string, cached bool) {
+	outbounds, err := readCachedOutbounds()
+	if err != nil {
+		return nil, false
+	}
+	for i, ob := range outbounds {
+		tag, _ := ob["tag"].(string)
+		if tag == "" {
+			tag = fmt.Sprintf("node-%d", i+1)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, true
+}
+
+// readCachedOutbounds 读取 outbounds 缓存文件。
+func readCachedOutbounds() ([]map[string]any, error) {
+	outboundsMu.Lock()
+	data, err := os.ReadFile(singboxCacheFile)
+	outboundsMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	var outbounds []map[string]any
+	if err := json.Unmarshal(data, &outbounds); err != nil {
+		return nil, err
+	}
+	return outbounds, nil
+}
+
+// subIndexFromTag 从 "sub3-xxx" 形式的节点 tag 中解析订阅下标（返回 2）。
+func subIndexFromTag(tag string) (int, bool) {
+	rest, ok := strings.CutPrefix(tag, "sub")
+	if !ok {
+		return 0, false
+	}
+	num, _, ok := strings.Cut(rest, "-")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(num)
+	if err != nil || n < 1 {
+		return 0, false
+	}
+	return n - 1, true
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	singboxDownloadTimeoutEnv     = "SINGBOX_DOWNLOAD_TIMEOUT"
+	defaultSingboxDownloadTimeout = 5 * time.Minute
+	// maxProxyRedirects 订阅与二进制下载允许的最大重定向次数（GitHub release 会跳转到对象存储）
+	maxProxyRedirects = 5
+)
+
+// proxyTransport 是 proxy 包拉取订阅与下载 sing-box 共用的连接池，与 http.DefaultClient 隔离。
+// 每个阶段都有超时，避免订阅主机或下载源挂起时连接永远不返回。
+var proxyTransport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	ForceAttemptHTTP2:     true,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 20 * time.Second,
+	ExpectContinueTimeout: time.Second,
+	MaxIdleConns:          8,
+	MaxIdleConnsPerHost:   2,
+	IdleConnTimeout:       90 * time.Second,
+}
+
+// newProxyHTTPClient 基于共享连接池创建带整体超时的客户端，timeout 包含读取响应体的时间。
+func newProxyHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport:     proxyTransport,
+		Timeout:       timeout,
+		CheckRedirect: limitRedirects,
+	}
+}
+
+// limitRedirects 限制重定向次数，并拒绝从 https 降级到 http。
+func limitRedirects(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxProxyRedirects {
+		return fmt.Errorf("重定向超过 %d 次", maxProxyRedirects)
+	}
+	if via[0].URL.Scheme == "https" && req.URL.Scheme != "https" {
+		return errors.New("拒绝从 https 重定向到 http")
+	}
+	return nil
+}
+
+// subscriptionClient 用于拉取订阅，超时由 PROXY_FETCH_TIMEOUT 控制。
+func subscriptionClient() *http.Client {
+	return newProxyHTTPClient(envDuration(singboxFetchTimeoutEnv, defaultSingboxFetchTimeout))
+}
+
+// binaryDownloadClient 用于下载 sing-box 压缩包，体积较大，超时由 SINGBOX_DOWNLOAD_TIMEOUT 控制。
+func binaryDownloadClient() *http.Client {
+	return newProxyHTTPClient(envDuration(singboxDownloadTimeoutEnv, defaultSingboxDownloadTimeout))
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"bytes"
+	"sync"
+)
+
+// singboxLogMaxLines 限制内存中保留的 sing-box 日志行数，避免无限增长。
+const singboxLogMaxLines = 2000
+
+// lineRing 是按行保存的环形日志缓冲区，实现 io.Writer。
+type lineRing struct {
+	mu      sync.Mutex
+	lines   []string
+	partial []byte
+	max     int
+}
+
+var singboxLogs = &lineRing{max: singboxLogMaxLines}
+
+func (r *lineRing) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data := append(r.partial, p...)
+	for {
+		idx := bytes.IndexByte(data, '\n')
+		if idx < 0 {
+			break
+		}
+		r.append(string(bytes.TrimRight(data[:idx], "\r")))
+		data = data[idx+1:]
+	}
+	r.partial = append([]byte(nil), data...)
+	return len(p), nil
+}
+
+func (r *lineRing) append(line string) {
+	r.lines = append(r.lines, line)
+	if over := len(r.lines) - r.max; over > 0 {
+		r.lines = append([]string(nil), r.lines[over:]...)
+	}
+}
+
+// Tail 返回最近 n 行日志，n<=0 时返回全部。
+func (r *lineRing) Tail(n int) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n <= 0 || n > len(r.lines) {
+		n = len(r.lines)
+	}
+	return append([]string(nil), r.lines[len(r.lines)-n:]...)
+}
+
+// SingBoxLogs 返回 sing-box 进程最近 n 行输出。
+func SingBoxLogs(n int) []string {
+	return singboxLogs.Tail(n)
+}
@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordFailureAfterHardFreezeExpires(t *testing.T) {
+	t.Setenv(proxyHardStrikesEnv, "2")
+	path := filepath.Join(t.TempDir(), "penalty.txt")
+	expired := time.Now().Add(-time.Minute)
+	if err := writePenaltiesFile(path, map[string]penalty{
+		"hard": {Until: expired, Strikes: 2},
+		"idle": {Until: expired},
+		"old":  {Until: time.Now().Add(-strikeMemory - time.Hour), Strikes: 1},
+		"soft": {Until: expired, Strikes: 1},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 写入时只保留仍有意义的记录：到期不久的软冷却要继续累计连续失败
+	got, err := readPenaltiesFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got["soft"].Strikes != 1 {
+		t.Fatalf("penalties after write = %v, want only soft with 1 strike", got)
+	}
+
+	p, err := recordFailure(path, "hard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Strikes != 1 || p.hard() {
+		t.Fatalf("first failure after hard freeze expired = %+v, want a soft cooldown with 1 strike", p)
+	}
+	p, err = recordFailure(path, "soft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Strikes != 2 || !p.hard() {
+		t.Fatalf("second consecutive failure = %+v, want a hard freeze", p)
+	}
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	healthcheckConcurrencyEnv     = "PROXY_HEALTHCHECK_CONCURRENCY"
+	defaultHealthcheckConcurrency = 8
+	healthcheckTimeoutEnv         = "PROXY_HEALTHCHECK_TIMEOUT"
+	defaultHealthcheckTimeout     = 10 * time.Second
+	healthcheckURLEnv             = "PROXY_HEALTHCHECK_URL"
+	defaultHealthcheckURL         = "https://www.gstatic.com/generate_204"
+)
+
+// ProbeResult 是单个节点的探测结果。
+type ProbeResult struct {
+	Tag       string `json:"tag"`
+	OK        bool   `json:"ok"`
+	Status    int    `json:"status,omitempty"`    // 目标地址返回的 HTTP 状态码
+	LatencyMs int64  `json:"latencyMs,omitempty"` // 请求耗时（毫秒）
+	Error     string `json:"error,omitempty"`
+}
+
+// healthcheckConcurrency 读取 PROXY_HEALTHCHECK_CONCURRENCY，限制同时进行的探测数。
+func healthcheckConcurrency() int {
+	raw := strings.TrimSpace(os.Getenv(healthcheckConcurrencyEnv))
+	if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+		return n
+	}
+	return defaultHealthcheckConcurrency
+}
+
+// ProbeEndpoints 通过每个节点的 socks 入站请求 PROXY_HEALTHCHECK_URL，
+// 最多 PROXY_HEALTHCHECK_CONCURRENCY 个探测同时进行，单个探测受 PROXY_HEALTHCHECK_TIMEOUT 限制。
+// 结果与 endpoints 顺序一致；ctx 取消后尚未开始的探测直接记为失败。
+func ProbeEndpoints(ctx context.Context, endpoints []Endpoint) []ProbeResult {
+	target := strings.TrimSpace(os.Getenv(healthcheckURLEnv))
+	if target == "" {
+		target = defaultHealthcheckURL
+	}
+	timeout := envDuration(healthcheckTimeoutEnv, defaultHealthcheckTimeout)
+	workers := healthcheckConcurrency()
+	if workers > len(endpoints) {
+		workers = len(endpoints)
+	}
+
+	results := make([]ProbeResult, len(endpoints))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = probeEndpoint(ctx, endpoints[i], target, timeout)
+			}
+		}()
+	}
+	for i := range endpoints {
+		if ctx.Err() != nil {
+			results[i] = ProbeResult{Tag: endpoints[i].Tag, Error: ctx.Err().Error()}
+			continue
+		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+// probeEndpoint 经由单个节点发起一次请求，2xx/3xx 视为可用。
+func probeEndpoint(ctx context.Context, ep Endpoint, target string, timeout time.Duration) ProbeResult {
+	res := ProbeResult{Tag: ep.Tag}
+	proxyURL, err := url.Parse(ep.URL)
+	if err != nil {
+		res.Error = fmt.Sprintf("invalid proxy url: %v", err)
+		return res
+	}
+	transport := &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableKeepAlives: true}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	resp.Body.Close()
+	res.LatencyMs = time.Since(start).Milliseconds()
+	res.Status = resp.StatusCode
+	res.OK = resp.StatusCode < 400
+	if !res.OK {
+		res.Error = resp.Status
+	}
+	return res
+}
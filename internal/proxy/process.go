@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	singboxAutoRestartEnv = "SINGBOX_AUTO_RESTART"
+	// singboxStartAttemptsEnv 启动后立即退出时的启动尝试次数
+	singboxStartAttemptsEnv     = "SINGBOX_START_ATTEMPTS"
+	defaultSingboxStartAttempts = 2
+	// singboxReadyTimeout 等待入站端口就绪的时长
+	singboxReadyTimeout = 15 * time.Second
+	// singboxStderrLines 启动失败时在错误中附带的 stderr 行数
+	singboxStderrLines = 20
+)
+
+// errSingBoxExited 表示 sing-box 在端口就绪前就退出了（通常是配置错误）
+var errSingBoxExited = errors.New("sing-box 启动后立即退出")
+
+// errSingBoxNotReady 表示进程仍在运行但采样的入站端口均未在超时内就绪
+var errSingBoxNotReady = errors.New("sing-box 入站端口未就绪")
+
+// errSingBoxStopped 表示进程已被主动停止，不再（重新）启动
+var errSingBoxStopped = errors.New("sing-box 已停止")
+
+// singboxProc 跟踪一个 sing-box 进程：监视其退出，区分主动停止与意外崩溃，
+// 意外退出时可自动重启一次（配置与端口不变，已分配的节点继续可用）。
+type singboxProc struct {
+	ctx        context.Context
+	bin        string
+	readyPorts []int // 采样检查的入站端口，任一可连接即视为就绪
+
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	exited   chan struct{} // 当前进程退出时关闭
+	stderr   *lineRing     // 当前进程的 stderr，启动失败时附在错误中
+	ready    bool          // 曾经就绪过；就绪前退出由启动流程处理，不自动重启
+	stopped  bool          // 已主动停止，退出不算崩溃
+	dead     bool          // 意外退出且尚未重启成功
+	restarts int
+}
+
+// currentSingBox 是最近一次启动的 sing-box 进程，供 SingBoxDead 查询
+var currentSingBox atomic.Pointer[singboxProc]
+
+// singboxCrashes 统计 sing-box 意外退出的次数，供 SingBoxCrashes 查询
+var singboxCrashes atomic.Int64
+
+// SingBoxCrashes 返回 sing-box 累计意外退出的次数。运行开始时记录该值，失败时与当前值比较，
+// 即使进程随后已自动重启（SingBoxDead 已恢复为 false），也能判断运行期间是否发生过崩溃。
+func SingBoxCrashes() int64 {
+	return singboxCrashes.Load()
+}
+
+// SingBoxDead 报告 sing-box 是否在运行中意外退出。
+// 为 true 时代理连接失败应归咎于进程而不是节点，不应冻结节点。
+func SingBoxDead() bool {
+	p := currentSingBox.Load()
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.dead
+}
+
+// startSingBoxProc 启动 sing-box 并等待入站端口就绪。进程在就绪前退出时附带 stderr 返回错误，
+// 并按 SINGBOX_START_ATTEMPTS 重新启动；进程存活但端口迟迟未就绪时只记录警告，沿用原进程。
+func startSingBoxProc(ctx context.Context, bin string, readyPorts []int) (*singboxProc, error) {
+	attempts := singboxStartAttempts()
+	for attempt := 1; ; attempt++ {
+		p := &singboxProc{ctx: ctx, bin: bin, readyPorts: readyPorts}
+		if err := p.spawn(); err != nil {
+			return nil, err
+		}
+		err := p.waitReady()
+		if err == nil || errors.Is(err, errSingBoxNotReady) {
+			if err != nil {
+				fmt.Printf("⚠️ %v，继续使用该进程\n", err)
+			}
+			currentSingBox.Store(p)
+			return p, nil
+		}
+		p.stop()
+		if !errors.Is(err, errSingBoxExited) || attempt >= attempts {
+			return nil, err
+		}
+		fmt.Printf("⚠️ %v，重新启动 (%d/%d)\n", err, attempt+1, attempts)
+	}
+}
+
+// singboxStartAttempts 读取 SINGBOX_START_ATTEMPTS，默认 2（失败后再试一次）。
+func singboxStartAttempts() int {
+	raw := strings.TrimSpace(os.Getenv(singboxStartAttemptsEnv))
+	if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+		return n
+	}
+	return defaultSingboxStartAttempts
+}
+
+// readyPortsFor 从节点中取首、中、尾三个端口用于就绪检查，避免单个节点配置有误时误判。
+func readyPortsFor(endpoints []Endpoint) []int {
+	if len(endpoints) == 0 {
+		return nil
+	}
+	var ports []int
+	for _, i := range []int{0, len(endpoints) / 2, len(endpoints) - 1} {
+		if port := extractPort(endpoints[i].URL); port > 0 && !slices.Contains(ports, port) {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// spawn 启动一个新进程。检查 stopped 与记录 cmd 在同一次加锁中完成，
+// 避免 stop 与自动重启交错时留下无人停止的进程；已停止时返回 errSingBoxStopped。
+func (p *singboxProc) spawn() error {
+	cmd := exec.CommandContext(p.ctx, p.bin, "run", "-c", singboxConfigFile, "--disable-color")
+	// 同时输出到终端和内存环形缓冲区，供 /proxy/logs 查询
+	logOut := io.MultiWriter(os.Stdout, singboxLogs)
+	stderr := &lineRing{max: singboxStderrLines}
+	cmd.Stdout = logOut
+	cmd.Stderr = io.MultiWriter(logOut, stderr)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return errSingBoxStopped
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start sing-box: %w", err)
+	}
+	exited := make(chan struct{})
+	p.cmd, p.exited, p.stderr = cmd, exited, stderr
+	go p.watch(cmd, exited)
+	return nil
+}
+
+// watch 等待进程退出；非主动停止时标记为崩溃，并按 SINGBOX_AUTO_RESTART 重启一次。
+// 就绪前的退出只关闭 exited，由启动流程报告错误。
+func (p *singboxProc) watch(cmd *exec.Cmd, exited chan struct{}) {
+	err := cmd.Wait()
+	close(exited)
+	p.mu.Lock()
+	if p.stopped || !p.ready {
+		p.mu.Unlock()
+		return
+	}
+	p.dead = true
+	singboxCrashes.Add(1)
+	restart := p.restarts < 1 && autoRestartEnabled()
+	if restart {
+		p.restarts++
+	}
+	p.mu.Unlock()
+
+	fmt.Printf("💥 sing-box 意外退出: %v\n", err)
+	if !restart {
+		fmt.Println("⚠️ sing-box 不再自动重启，后续代理场景将失败（节点不会因此被冻结）")
+		return
+	}
+	time.Sleep(time.Second)
+	fmt.Println("🔁 正在重启 sing-box ...")
+	if err := p.spawn(); err != nil {
+		if !errors.Is(err, errSingBoxStopped) {
+			fmt.Printf("⚠️ 重启 sing-box 失败: %v\n", err)
+		}
+		return
+	}
+	if err := p.waitReady(); err != nil && !errors.Is(err, errSingBoxNotReady) {
+		fmt.Printf("⚠️ 重启 sing-box 失败: %v\n", err)
+		return
+	}
+	p.mu.Lock()
+	p.dead = false
+	p.mu.Unlock()
+	fmt.Println("✅ sing-box 已重启")
+}
+
+// waitReady 等待采样的入站端口中任一个可连接；进程提前退出时返回附带 stderr 的 errSingBoxExited。
+func (p *singboxProc) waitReady() error {
+	p.mu.Lock()
+	exited, stderr := p.exited, p.stderr
+	p.mu.Unlock()
+	if len(p.readyPorts) == 0 {
+		p.markReady()
+		return nil
+	}
+	host := proxyListenAddr()
+	deadline := time.Now().Add(singboxReadyTimeout)
+	for time.Now().Before(deadline) {
+		for _, port := range p.readyPorts {
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), time.Second)
+			if err != nil {
+				continue
+			}
+			_ = conn.Close()
+			// 等待端口就绪后，额外增加一个短暂的延时，确保 sing-box 内部服务完全初始化。
+			// 这有助于避免 "connection aborted" 或 "timeout" 的竞态条件。
+			time.Sleep(500 * time.Millisecond)
+			p.markReady()
+			return nil
+		}
+		select {
+		case <-p.ctx.Done():
+			return p.ctx.Err()
+		case <-exited:
+			out := strings.Join(stderr.Tail(0), "\n")
+			if out == "" {
+				out = "(无 stderr 输出)"
+			}
+			return fmt.Errorf("%w:\n%s", errSingBoxExited, out)
+		case <-time.After(300 * time.Millisecond):
+		}
+	}
+	p.markReady()
+	return fmt.Errorf("%w：端口 %v 在 %s 内均不可连接", errSingBoxNotReady, p.readyPorts, singboxReadyTimeout)
+}
+
+func (p *singboxProc) markReady() {
+	p.mu.Lock()
+	p.ready = true
+	p.mu.Unlock()
+}
+
+// stop 主动停止进程，之后的退出不会被视为崩溃。
+func (p *singboxProc) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopped = true
+	p.dead = false
+	if p.cmd != nil && p.cmd.Process != nil {
+		_ = p.cmd.Process.Kill()
+	}
+}
+
+// autoRestartEnabled 读取 SINGBOX_AUTO_RESTART，默认开启。
+func autoRestartEnabled() bool {
+	switch strings.ToLower(strings.TrimSpace(os.Getenv(singboxAutoRestartEnv))) {
+	case "0", "false", "no", "off":
+		return false
+	}
+	return true
+}
@@ -11,17 +11,21 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"vertex-nano-banana-unlimited/internal/fsperm"
 )
 
 const (
@@ -33,9 +37,39 @@ const (
 	singboxBinName    = "sing-box"
 	singboxVersion    = "1.10.6"
 	singboxBasePort   = 17880
+
+	singboxFetchTimeoutEnv     = "PROXY_FETCH_TIMEOUT"
+	defaultSingboxFetchTimeout = 20 * time.Second
+
+	singboxListenAddrEnv     = "PROXY_LISTEN_ADDR"
+	defaultSingboxListenAddr = "127.0.0.1"
+
+	proxyCooldownEnv        = "PROXY_COOLDOWN"
+	defaultProxyCooldown    = 15 * time.Minute
+	proxyHardFreezeEnv      = "PROXY_HARD_FREEZE"
+	defaultProxyHardFreeze  = time.Hour
+	proxyHardStrikesEnv     = "PROXY_HARD_FREEZE_STRIKES"
+	defaultProxyHardStrikes = 3
+
+	// proxyMaxNodesEnv 限制生成 socks 入站的节点数，0 表示不限制
+	proxyMaxNodesEnv = "PROXY_MAX_NODES"
+
+	// maxSubscriptionBytes 是单个订阅内容的大小上限，gzip 订阅按解压后的大小计算
+	maxSubscriptionBytes = 32 << 20
+
+	// proxyDNSEnv 为 sing-box 指定 DNS 服务器（逗号分隔，如 https://1.1.1.1/dns-query），为空时使用 sing-box 默认解析
+	proxyDNSEnv = "PROXY_DNS"
 )
 
-var penaltyMu sync.Mutex
+var (
+	penaltyMu sync.Mutex
+	// outboundsMu 串行化订阅拉取与缓存写入，避免并发写坏 outbounds.json
+	outboundsMu sync.Mutex
+	// binaryMu 避免并发下载/解压 sing-box 二进制
+	binaryMu sync.Mutex
+	// warmupFlight 合并相同订阅列表的并发预热与拉取，调用方共享同一结果
+	warmupFlight flightGroup
+)
 
 // StartSingBox 启动 sing-box，多订阅合并缓存，按节点生成独立端口并返回可用代理列表。
 // 如未配置订阅，返回空列表并不报错。
@@ -45,7 +79,7 @@ func StartSingBox(ctx context.Context) ([]Endpoint, func(), error) {
 		return nil, func() {}, nil
 	}
 
-	if err := os.MkdirAll(singboxDir, 0o755); err != nil {
+	if err := os.MkdirAll(singboxDir, fsperm.Dir()); err != nil {
 		return nil, func() {}, fmt.Errorf("make sing-box dir: %w", err)
 	}
 
@@ -54,9 +88,13 @@ func StartSingBox(ctx context.Context) ([]Endpoint, func(), error) {
 		return nil, func() {}, fmt.Errorf("load subscriptions: %w", err)
 	}
 
+	if limit := proxyMaxNodes(); limit > 0 && len(outbounds) > limit {
+		fmt.Printf("✂️ 订阅共 %d 个节点，超过 %s=%d，仅为前 %d 个节点创建入站\n", len(outbounds), proxyMaxNodesEnv, limit, limit)
+		outbounds = outbounds[:limit]
+	}
 	cfg, endpoints := buildConfig(outbounds)
 	if len(endpoints) == 0 {
-		return nil, func() {}, errors.New("订阅未提供可用节点(outbounds)")
+		return nil, func() {}, fmt.Errorf("订阅未提供可用节点(outbounds)：%s", LastOutboundStats())
 	}
 	if err := writeJSONFile(singboxConfigFile, cfg); err != nil {
 		return nil, func() {}, fmt.Errorf("write config: %w", err)
@@ -67,109 +105,280 @@ func StartSingBox(ctx context.Context) ([]Endpoint, func(), error) {
 		return nil, func() {}, fmt.Errorf("ensure binary: %w", err)
 	}
 
-	cmd := exec.CommandContext(ctx, bin, "run", "-c", singboxConfigFile, "--disable-color")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Start(); err != nil {
-		return nil, func() {}, fmt.Errorf("start sing-box: %w", err)
+	proc, err := startSingBoxProc(ctx, bin, readyPortsFor(endpoints))
+	if err != nil {
+		return nil, func() {}, err
 	}
 
-	stop := func() {
-		_ = cmd.Process.Kill()
-	}
+	return OrderByCooldown(endpoints), proc.stop, nil
+}
 
-	if len(endpoints) > 0 {
-		firstPort := extractPort(endpoints[0].URL)
-		if waitPortReady(ctx, "127.0.0.1", firstPort, 15*time.Second) == nil {
-			// 等待端口就绪后，额外增加一个短暂的延时，确保 sing-box 内部服务完全初始化。
-			// 这有助于避免 "connection aborted" 或 "timeout" 的竞态条件。
-			time.Sleep(500 * time.Millisecond)
+// WarmupSingBox 预先拉取订阅并下载二进制，但不启动进程。
+func WarmupSingBox(ctx context.Context) error {
+	urls := MergeEnvAndSaved(os.Getenv(singboxSubEnv))
+	if len(urls) == 0 {
+		return nil
+	}
+	_, err, shared := warmupFlight.Do("warmup:"+subsKey(urls), func() (any, error) {
+		if err := os.MkdirAll(singboxDir, fsperm.Dir()); err != nil {
+			return nil, err
 		}
+		if _, err := loadOrFetchOutbounds(ctx, urls); err != nil {
+			return nil, err
+		}
+		return ensureSingBoxBinary(ctx)
+	})
+	if shared {
+		fmt.Println("🧭 已有相同订阅的预热在进行，复用其结果")
 	}
-
-	return filterPenalized(endpoints), stop, nil
+	return err
 }
 
-// WarmupSingBox 预先拉取订阅并下载二进制，但不启动进程。
-func WarmupSingBox(ctx context.Context) error {
+// RefreshOutbounds 绕过 outbounds 缓存重新拉取订阅，成功后覆盖缓存并返回最新的节点统计。
+// 拉取失败时返回错误，原有缓存保持不变，节点池继续使用之前的节点。
+// 并发调用合并为一次刷新，重复调用只会重新拉取，不会产生其他副作用。
+func RefreshOutbounds(ctx context.Context) (OutboundStats, error) {
 	urls := MergeEnvAndSaved(os.Getenv(singboxSubEnv))
 	if len(urls) == 0 {
+		return OutboundStats{}, nil
+	}
+	_, err, shared := warmupFlight.Do("refresh:"+subsKey(urls), func() (any, error) {
+		outboundsMu.Lock()
+		defer outboundsMu.Unlock()
+		fmt.Println("🔄 重新拉取订阅，忽略 outbounds 缓存")
+		return fetchSubscriptionsLocked(ctx, urls)
+	})
+	if shared {
+		fmt.Println("🧭 已有相同订阅的刷新在进行，复用其结果")
+	}
+	if err != nil {
+		return OutboundStats{}, fmt.Errorf("%w（保留之前的节点缓存）", err)
+	}
+	return LastOutboundStats(), nil
+}
+
+// FreezeEndpoint 让节点进入软冷却：冷却期内排到候选列表末尾，仅在没有其他节点时复用。
+// 用于成功出图或配额耗尽之后，同时清零该节点的连续失败次数。
+func FreezeEndpoint(tag string) error {
+	return FreezeEndpointFor(tag, 0)
+}
+
+// FreezeEndpointFor 与 FreezeEndpoint 相同，但使用指定的冷却时长，cooldown<=0 时使用 PROXY_COOLDOWN。
+func FreezeEndpointFor(tag string, cooldown time.Duration) error {
+	tag = strings.TrimSpace(tag)
+	if tag == "" {
 		return nil
 	}
-	if err := os.MkdirAll(singboxDir, 0o755); err != nil {
+	penaltyMu.Lock()
+	defer penaltyMu.Unlock()
+	if cooldown <= 0 {
+		cooldown = envDuration(proxyCooldownEnv, defaultProxyCooldown)
+	}
+	if err := savePenalty(singboxPenalty, tag, cooldown); err != nil {
 		return err
 	}
-	if _, err := loadOrFetchOutbounds(ctx, urls); err != nil {
+	fmt.Printf("⏳ 节点 %s 进入冷却约 %s\n", tag, cooldown)
+	return nil
+}
+
+// PenalizeEndpoint 记录节点的一次失败并让其进入冷却；连续失败达到
+// PROXY_HARD_FREEZE_STRIKES 次后升级为硬冻结，冻结期内完全不再分配。
+func PenalizeEndpoint(tag string) error {
+	tag = strings.TrimSpace(tag)
+	if tag == "" {
+		return nil
+	}
+	penaltyMu.Lock()
+	defer penaltyMu.Unlock()
+	p, err := recordFailure(singboxPenalty, tag)
+	if err != nil {
 		return err
 	}
-	_, err := ensureSingBoxBinary(ctx)
-	return err
+	if p.hard() {
+		fmt.Printf("🧊 节点 %s 连续失败 %d 次，硬冻结至 %s\n", tag, p.Strikes, p.Until.Format("15:04:05"))
+	} else {
+		fmt.Printf("⏳ 节点 %s 失败 %d 次，进入冷却至 %s\n", tag, p.Strikes, p.Until.Format("15:04:05"))
+	}
+	return nil
 }
 
-// FreezeEndpoint 在成功或失败后冻结该节点 15 分钟。
-func FreezeEndpoint(tag string) error {
+// HardFreezeEndpoint 直接硬冻结节点（如节点所在地区不受支持），冻结期为 dur，
+// dur<=0 时使用 PROXY_HARD_FREEZE。
+func HardFreezeEndpoint(tag string, dur time.Duration) error {
 	tag = strings.TrimSpace(tag)
 	if tag == "" {
 		return nil
 	}
+	if dur <= 0 {
+		dur = envDuration(proxyHardFreezeEnv, defaultProxyHardFreeze)
+	}
 	penaltyMu.Lock()
 	defer penaltyMu.Unlock()
-	if err := savePenalty(singboxPenalty, tag, 15*time.Minute); err != nil {
+	penalties, err := readPenaltiesFile(singboxPenalty)
+	if err != nil {
+		return err
+	}
+	p := penalties[tag]
+	if p.Strikes < hardFreezeStrikes() {
+		p.Strikes = hardFreezeStrikes()
+	}
+	p.Until = time.Now().Add(dur)
+	penalties[tag] = p
+	if err := writePenaltiesFile(singboxPenalty, penalties); err != nil {
 		return err
 	}
-	fmt.Printf("⏳ 节点 %s 冻结 15 分钟\n", tag)
+	fmt.Printf("🧊 节点 %s 硬冻结至 %s\n", tag, p.Until.Format("01-02 15:04"))
 	return nil
 }
 
+// loadOrFetchOutbounds 读取缓存或拉取订阅；相同订阅列表的并发调用只拉取一次。
 func loadOrFetchOutbounds(ctx context.Context, urls []string) ([]map[string]any, error) {
+	v, err, _ := warmupFlight.Do("outbounds:"+subsKey(urls), func() (any, error) {
+		outboundsMu.Lock()
+		defer outboundsMu.Unlock()
+		return fetchOutboundsLocked(ctx, urls)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]map[string]any), nil
+}
+
+// fetchOutboundsLocked 需在持有 outboundsMu 时调用。
+func fetchOutboundsLocked(ctx context.Context, urls []string) ([]map[string]any, error) {
 	if data, err := os.ReadFile(singboxCacheFile); err == nil {
 		var out []map[string]any
 		if err := json.Unmarshal(data, &out); err == nil {
 			if hasRealOutbounds(out) {
 				fmt.Printf("🧭 使用 sing-box 缓存，节点数：%d\n", len(out))
+				if prev := LastOutboundStats(); prev.Usable != len(out) {
+					setOutboundStats(OutboundStats{Fetched: len(out), Usable: len(out), FromCache: true})
+				}
 				return out, nil
 			}
 			fmt.Println("ℹ️ 缓存不包含可用节点，重新拉取订阅")
 		}
 	}
+	return fetchSubscriptionsLocked(ctx, urls)
+}
 
+// fetchSubscriptionsLocked 拉取并合并全部订阅，成功后写入 outbounds 缓存；失败时不改动缓存。
+// 需在持有 outboundsMu 时调用。
+func fetchSubscriptionsLocked(ctx context.Context, urls []string) ([]map[string]any, error) {
 	fmt.Println("🧭 获取 sing-box 订阅中…")
 	seen := map[string]int{}
 	var merged []map[string]any
+	var stats OutboundStats
 	for idx, u := range urls {
-		items, err := fetchSubscription(ctx, u)
+		items, filtered, err := fetchSubscription(ctx, u)
 		if err != nil {
 			return nil, fmt.Errorf("fetch %s: %w", u, err)
 		}
 		prefix := fmt.Sprintf("sub%d-", idx+1)
-		merged = append(merged, normalizeOutbounds(items, prefix, seen)...)
-	}
+		normalized, excluded := normalizeOutbounds(items, prefix, seen)
+		stats.Fetched += len(items) + filtered
+		stats.FilteredByType += filtered
+		stats.ExcludedByKeyword += excluded
+		merged = append(merged, normalized...)
+	}
+	stats.Usable = len(merged)
+	setOutboundStats(stats)
 	if len(merged) == 0 {
+		if stats.Fetched > 0 {
+			return nil, fmt.Errorf("订阅中的节点全部被过滤：%s", stats)
+		}
 		return nil, errors.New("订阅未返回任何 outbounds")
 	}
+	// 拉取期间订阅列表可能已被修改，此时不写缓存，避免旧结果覆盖新订阅
+	if subsKey(MergeEnvAndSaved(os.Getenv(singboxSubEnv))) != subsKey(urls) {
+		fmt.Println("ℹ️ 拉取期间订阅列表已变更，跳过写入缓存")
+		return merged, nil
+	}
 	if err := writeJSONFile(singboxCacheFile, merged); err != nil {
 		return nil, err
 	}
 	return merged, nil
 }
 
-func fetchSubscription(ctx context.Context, url string) ([]map[string]any, error) {
+var (
+	outboundStatsMu   sync.Mutex
+	lastOutboundStats OutboundStats
+)
+
+// LastOutboundStats 返回最近一次加载订阅的节点统计。
+func LastOutboundStats() OutboundStats {
+	outboundStatsMu.Lock()
+	defer outboundStatsMu.Unlock()
+	return lastOutboundStats
+}
+
+func setOutboundStats(s OutboundStats) {
+	outboundStatsMu.Lock()
+	lastOutboundStats = s
+	outboundStatsMu.Unlock()
+}
+
+func subsKey(urls []string) string {
+	return strings.Join(urls, "\n")
+}
+
+// fetchSubscription 拉取并解析订阅，返回真实节点以及因类型（selector/direct 等）被过滤的数量。
+// file:// 订阅直接读取本地 sing-box 配置，适用于离线或自行维护的节点列表，只接受 PROXY_SINGBOX_SUB_URLS 中的条目。
+func fetchSubscription(ctx context.Context, url string) ([]map[string]any, int, error) {
+	if path, ok := SubscriptionFilePath(url); ok {
+		if !localSubAllowed(url) {
+			return nil, 0, fmt.Errorf("本地订阅只能通过 %s 配置，已忽略", singboxSubEnv)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer f.Close()
+		data, err := readSubscriptionBytes(f)
+		if err != nil {
+			return nil, 0, err
+		}
+		return parseSubscription(data)
+	}
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	resp, err := http.DefaultClient.Do(req)
+	req.Header.Set("Accept-Encoding", "identity")
+	// 显式超时，避免订阅主机挂起导致启动预热（context.Background）永远阻塞
+	resp, err := subscriptionClient().Do(req)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer resp.Body.Close()
-	data, err := io.ReadAll(resp.Body)
+	data, err := readSubscriptionBytes(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+	// 部分面板无视 Accept-Encoding 返回 gzip，按响应头或魔数解压
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") || isGzip(data) {
+		if dec, err := gunzip(data); err == nil {
+			data = dec
+		} else if isGzip(data) {
+			return nil, 0, fmt.Errorf("解压订阅 gzip 失败: %w", err)
+		}
+	}
+	return parseSubscription(data)
+}
+
+// parseSubscription 解析订阅内容（sing-box JSON、Base64 JSON 或 gzip 压缩的本地文件），
+// 返回真实节点以及因类型被过滤的数量。远程与本地订阅共用，校验规则一致。
+func parseSubscription(data []byte) ([]map[string]any, int, error) {
+	if isGzip(data) {
+		dec, err := gunzip(data)
+		if err != nil {
+			return nil, 0, fmt.Errorf("解压订阅 gzip 失败: %w", err)
+		}
+		data = dec
 	}
 	content := bytes.TrimSpace(data)
 	if len(content) == 0 {
-		return nil, errors.New("订阅响应为空")
+		return nil, 0, errors.New("订阅响应为空")
 	}
 	jsonBytes := content
 	if !json.Valid(content) {
@@ -179,29 +388,60 @@ func fetchSubscription(ctx context.Context, url string) ([]map[string]any, error
 	}
 	var cfg map[string]any
 	if err := json.Unmarshal(jsonBytes, &cfg); err != nil {
-		return nil, fmt.Errorf("解析订阅 JSON 失败: %w", err)
+		return nil, 0, fmt.Errorf("解析订阅 JSON 失败: %w", err)
 	}
 	outboundsAny, ok := cfg["outbounds"].([]any)
 	if !ok {
-		return nil, errors.New("订阅缺少 outbounds")
+		return nil, 0, errors.New("订阅缺少 outbounds")
 	}
 	var out []map[string]any
+	filtered := 0
 	for _, item := range outboundsAny {
 		m, ok := item.(map[string]any)
 		if !ok {
+			filtered++
 			continue
 		}
 		t, _ := m["type"].(string)
 		if !isRealOutboundType(t) {
+			filtered++
 			continue
 		}
 		out = append(out, m)
 	}
-	return out, nil
+	return out, filtered, nil
 }
 
-func normalizeOutbounds(items []map[string]any, prefix string, seen map[string]int) []map[string]any {
+func isGzip(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+// gunzip 解压 gzip 订阅，解压后的内容同样受 maxSubscriptionBytes 限制，避免体积很小的压缩包无限膨胀。
+func gunzip(data []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	return readSubscriptionBytes(gz)
+}
+
+// readSubscriptionBytes 读取订阅内容，超过 maxSubscriptionBytes 时返回错误。
+func readSubscriptionBytes(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxSubscriptionBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSubscriptionBytes {
+		return nil, fmt.Errorf("订阅内容超过 %d 字节上限", maxSubscriptionBytes)
+	}
+	return data, nil
+}
+
+// normalizeOutbounds 为节点加上订阅前缀并去重，返回保留的节点与命中黑名单被排除的数量。
+func normalizeOutbounds(items []map[string]any, prefix string, seen map[string]int) ([]map[string]any, int) {
 	var out []map[string]any
+	excluded := 0
 	for i, ob := range items {
 		tag, _ := ob["tag"].(string)
 		origTag := strings.TrimSpace(tag)
@@ -210,6 +450,7 @@ func normalizeOutbounds(items []map[string]any, prefix string, seen map[string]i
 		}
 		if shouldExcludeTag(origTag) {
 			fmt.Printf("⏭️ 跳过节点 %s (命中黑名单关键词)\n", origTag)
+			excluded++
 			continue
 		}
 		tag = prefix + origTag
@@ -223,7 +464,7 @@ func normalizeOutbounds(items []map[string]any, prefix string, seen map[string]i
 		ob["tag"] = tag
 		out = append(out, ob)
 	}
-	return out
+	return out, excluded
 }
 
 func shouldExcludeTag(tag string) bool {
@@ -244,6 +485,10 @@ func shouldExcludeTag(tag string) bool {
 }
 
 func buildConfig(outbounds []map[string]any) (map[string]any, []Endpoint) {
+	listen := proxyListenAddr()
+	if !isLoopbackAddr(listen) {
+		fmt.Printf("⚠️⚠️⚠️ sing-box socks 入站监听在 %s 且未启用认证，任何能访问该地址的人都可以使用这些代理节点！\n", listen)
+	}
 	inbounds := make([]any, 0, len(outbounds))
 	rules := make([]any, 0, len(outbounds))
 	endpoints := make([]Endpoint, 0, len(outbounds))
@@ -259,14 +504,14 @@ func buildConfig(outbounds []map[string]any) (map[string]any, []Endpoint) {
 		inbounds = append(inbounds, map[string]any{
 			"type":        "socks",
 			"tag":         inTag,
-			"listen":      "127.0.0.1",
+			"listen":      listen,
 			"listen_port": port,
 		})
 		rules = append(rules, map[string]any{
 			"inbound":  []string{inTag},
 			"outbound": tag,
 		})
-		endpoints = append(endpoints, Endpoint{Tag: tag, URL: fmt.Sprintf("socks5://127.0.0.1:%d", port)})
+		endpoints = append(endpoints, Endpoint{Tag: tag, URL: fmt.Sprintf("socks5://%s", net.JoinHostPort(listen, strconv.Itoa(port)))})
 	}
 
 	outWithDefaults := append([]map[string]any{}, outbounds...)
@@ -295,84 +540,258 @@ func buildConfig(outbounds []map[string]any) (map[string]any, []Endpoint) {
 			"final": "direct",
 		},
 	}
+	if dns := dnsConfig(); dns != nil {
+		cfg["dns"] = dns
+	}
 	return cfg, endpoints
 }
 
+// dnsSchemes 是 PROXY_DNS 接受的 sing-box DNS 地址协议
+var dnsSchemes = []string{"https", "h3", "tls", "quic", "tcp", "udp"}
+
+// dnsConfig 按 PROXY_DNS 生成 sing-box 的 dns 配置块，未设置或全部无效时返回 nil（保持默认行为）。
+// 域名形式的服务器（如 https://dns.google/dns-query）经系统解析器 dns-local 解析其自身地址。
+func dnsConfig() map[string]any {
+	var servers []any
+	needLocal := false
+	for _, addr := range strings.Split(os.Getenv(proxyDNSEnv), ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		host, ok := dnsServerHost(addr)
+		if !ok {
+			fmt.Printf("⚠️ %s 中的 DNS 地址 %q 无效，已忽略\n", proxyDNSEnv, addr)
+			continue
+		}
+		server := map[string]any{
+			"tag":     fmt.Sprintf("dns-%d", len(servers)+1),
+			"address": addr,
+			"detour":  "direct",
+		}
+		if net.ParseIP(host) == nil {
+			server["address_resolver"] = "dns-local"
+			needLocal = true
+		}
+		servers = append(servers, server)
+	}
+	if len(servers) == 0 {
+		return nil
+	}
+	if needLocal {
+		servers = append(servers, map[string]any{"tag": "dns-local", "address": "local"})
+	}
+	return map[string]any{
+		"servers": servers,
+		"final":   servers[0].(map[string]any)["tag"],
+	}
+}
+
+// dnsServerHost 解析 DNS 地址中的主机部分：支持 dnsSchemes 中的协议或裸 IP。
+func dnsServerHost(addr string) (string, bool) {
+	if ip := net.ParseIP(addr); ip != nil {
+		return addr, true
+	}
+	u, err := url.Parse(addr)
+	if err != nil || u.Hostname() == "" || !slices.Contains(dnsSchemes, u.Scheme) {
+		return "", false
+	}
+	return u.Hostname(), true
+}
+
+// proxyListenAddr 返回 socks 入站监听地址；浏览器在其他容器运行时可设置 PROXY_LISTEN_ADDR=0.0.0.0。
+func proxyListenAddr() string {
+	addr := strings.TrimSpace(os.Getenv(singboxListenAddrEnv))
+	if addr == "" {
+		return defaultSingboxListenAddr
+	}
+	return addr
+}
+
+func isLoopbackAddr(addr string) bool {
+	if addr == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.IsLoopback()
+}
+
 func writeJSONFile(path string, v any) error {
 	data, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
 		return err
 	}
-	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+	if err := os.MkdirAll(filepath.Dir(path), fsperm.Dir()); err != nil {
 		return err
 	}
-	return os.WriteFile(path, data, 0o644)
+	return os.WriteFile(path, data, fsperm.File())
 }
 
 // ------------------ penalty helpers ------------------
 
+// penalty 是单个节点的冷却记录，文件格式为 "tag,until,strikes"（旧格式无 strikes）。
+type penalty struct {
+	Until   time.Time
+	Strikes int // 连续失败次数，成功后清零
+}
+
+// hard 判断节点是否处于硬冻结（连续失败达到阈值且尚未到期）。
+func (p penalty) hard() bool {
+	return p.Strikes >= hardFreezeStrikes() && time.Now().Before(p.Until)
+}
+
+// strikeMemory 是软冷却到期后仍保留连续失败次数的时长，超过后重新计数
+const strikeMemory = 24 * time.Hour
+
+// stale 判断记录是否已失效：冷却已到期，且没有失败次数、硬冻结已到期（到期后重新计数），
+// 或到期已超过 strikeMemory。失效的记录在写入时删除，下次失败从 1 开始计数。
+func (p penalty) stale(now time.Time) bool {
+	if now.Before(p.Until) {
+		return false
+	}
+	return p.Strikes == 0 || p.Strikes >= hardFreezeStrikes() || now.Sub(p.Until) > strikeMemory
+}
+
+func hardFreezeStrikes() int {
+	raw := strings.TrimSpace(os.Getenv(proxyHardStrikesEnv))
+	if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+		return n
+	}
+	return defaultProxyHardStrikes
+}
+
+// proxyMaxNodes 读取 PROXY_MAX_NODES，未设置或非法时返回 0（不限制）。
+func proxyMaxNodes() int {
+	raw := strings.TrimSpace(os.Getenv(proxyMaxNodesEnv))
+	if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+		return n
+	}
+	return 0
+}
+
+// penaltyJitter 是冷却时长的随机浮动比例（±20%），避免同时冻结的节点同时解冻
+const penaltyJitter = 0.2
+
+// jitterDuration 在 d 的基础上随机浮动 ±penaltyJitter，平均值仍为 d。
+func jitterDuration(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	factor := 1 + penaltyJitter*(2*rand.Float64()-1)
+	return time.Duration(float64(d) * factor)
+}
+
+// savePenalty 设置节点冷却并清零失败次数。
 func savePenalty(path, tag string, dur time.Duration) error {
 	penalties, err := readPenaltiesFile(path)
 	if err != nil {
 		return err
 	}
-	penalties[tag] = time.Now().Add(dur)
+	penalties[tag] = penalty{Until: time.Now().Add(jitterDuration(dur))}
 	return writePenaltiesFile(path, penalties)
 }
 
-func readPenaltiesFile(path string) (map[string]time.Time, error) {
+// recordFailure 累加失败次数并按是否达到阈值设置冷却或硬冻结时长；
+// 硬冻结到期后的第一次失败重新从 1 计数，需要再连续失败达到阈值才会再次硬冻结。
+func recordFailure(path, tag string) (penalty, error) {
+	penalties, err := readPenaltiesFile(path)
+	if err != nil {
+		return penalty{}, err
+	}
+	p := penalties[tag]
+	if p.stale(time.Now()) {
+		p.Strikes = 0
+	}
+	p.Strikes++
+	dur := envDuration(proxyCooldownEnv, defaultProxyCooldown)
+	if p.Strikes >= hardFreezeStrikes() {
+		dur = envDuration(proxyHardFreezeEnv, defaultProxyHardFreeze)
+	}
+	p.Until = time.Now().Add(jitterDuration(dur))
+	penalties[tag] = p
+	return p, writePenaltiesFile(path, penalties)
+}
+
+func readPenaltiesFile(path string) (map[string]penalty, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return map[string]time.Time{}, nil
+			return map[string]penalty{}, nil
 		}
 		return nil, err
 	}
-	penalties := make(map[string]time.Time)
+	penalties := make(map[string]penalty)
 	lines := strings.Split(string(data), "\n")
 	for _, line := range lines {
 		line = strings.TrimSpace(line)
 		if line == "" {
 			continue
 		}
-		parts := strings.SplitN(line, ",", 2)
-		if len(parts) != 2 {
+		parts := strings.Split(line, ",")
+		if len(parts) < 2 {
 			continue
 		}
-		if ts, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64); err == nil {
-			penalties[strings.TrimSpace(parts[0])] = time.Unix(ts, 0)
+		ts, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+		if err != nil {
+			continue
+		}
+		p := penalty{Until: time.Unix(ts, 0)}
+		if len(parts) >= 3 {
+			p.Strikes, _ = strconv.Atoi(strings.TrimSpace(parts[2]))
 		}
+		penalties[strings.TrimSpace(parts[0])] = p
 	}
 	return penalties, nil
 }
 
-func writePenaltiesFile(path string, penalties map[string]time.Time) error {
+func writePenaltiesFile(path string, penalties map[string]penalty) error {
+	// 失效的条目无需保留，避免文件随出现过的节点无限增长
+	now := time.Now()
+	for k, p := range penalties {
+		if p.stale(now) {
+			delete(penalties, k)
+		}
+	}
 	if len(penalties) == 0 {
 		_ = os.Remove(path)
 		return nil
 	}
-	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+	if err := os.MkdirAll(filepath.Dir(path), fsperm.Dir()); err != nil {
 		return err
 	}
 	var lines []string
 	for k, v := range penalties {
-		lines = append(lines, fmt.Sprintf("%s,%d", k, v.Unix()))
+		lines = append(lines, fmt.Sprintf("%s,%d,%d", k, v.Until.Unix(), v.Strikes))
 	}
 	sort.Strings(lines)
-	return os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o644)
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")), fsperm.File())
 }
 
-func filterPenalized(endpoints []Endpoint) []Endpoint {
+// OrderByCooldown 将未冷却的节点排在前面，冷却中的节点按到期时间排到末尾，
+// 只有硬冻结的节点会被排除；这样节点池紧张时会降级复用而不是直接没有节点可用。
+func OrderByCooldown(endpoints []Endpoint) []Endpoint {
 	penalties, _ := readPenaltiesFile(singboxPenalty)
 	now := time.Now()
-	var out []Endpoint
+	var fresh, cooling []Endpoint
+	hardFrozen := 0
 	for _, ep := range endpoints {
-		if exp, ok := penalties[ep.Tag]; ok && now.Before(exp) {
-			continue
+		p, ok := penalties[ep.Tag]
+		switch {
+		case !ok || !now.Before(p.Until):
+			fresh = append(fresh, ep)
+		case p.hard():
+			hardFrozen++
+		default:
+			cooling = append(cooling, ep)
 		}
-		out = append(out, ep)
 	}
-	return out
+	sort.SliceStable(cooling, func(i, j int) bool {
+		return penalties[cooling[i].Tag].Until.Before(penalties[cooling[j].Tag].Until)
+	})
+	if len(cooling) > 0 || hardFrozen > 0 {
+		fmt.Printf("🧭 可用节点 %d 个，冷却中 %d 个（排在末尾），硬冻结 %d 个\n", len(fresh), len(cooling), hardFrozen)
+	}
+	return append(fresh, cooling...)
 }
 
 func hasRealOutbounds(items []map[string]any) bool {
@@ -394,9 +813,30 @@ func isRealOutboundType(t string) bool {
 	}
 }
 
+// ------------------ env helpers ------------------
+
+// envDuration 读取时长类环境变量，支持 "20s" 形式或纯秒数，非法或未设置时返回默认值。
+// 与 app 包的同名函数规则一致：0 是合法值（超时为 0 表示不限，冷却为 0 表示不冷却），负数视为非法。
+func envDuration(name string, def time.Duration) time.Duration {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return def
+	}
+	if d, err := time.ParseDuration(raw); err == nil && d >= 0 {
+		return d
+	}
+	if n, err := strconv.Atoi(raw); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second
+	}
+	fmt.Printf("⚠️ %s=%q 无效，使用默认值 %s\n", name, raw, def)
+	return def
+}
+
 // ------------------ binary handling ------------------
 
 func ensureSingBoxBinary(ctx context.Context) (string, error) {
+	binaryMu.Lock()
+	defer binaryMu.Unlock()
 	bin := singboxBinName
 	if runtime.GOOS == "windows" {
 		bin += ".exe"
@@ -415,11 +855,14 @@ func ensureSingBoxBinary(ctx context.Context) (string, error) {
 		return "", err
 	}
 	req.Header.Set("Accept-Encoding", "identity")
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := binaryDownloadClient().Do(req)
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("下载 sing-box 失败: %s: %s", url, resp.Status)
+	}
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return "", err
@@ -543,26 +986,6 @@ func writeZipFile(f *zip.File, target string) error {
 	return os.Chmod(target, 0o755)
 }
 
-func waitPortReady(ctx context.Context, host string, port int, timeout time.Duration) error {
-	if port == 0 {
-		return nil
-	}
-	deadline := time.Now().Add(timeout)
-	for time.Now().Before(deadline) {
-		conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", host, port), time.Second)
-		if err == nil {
-			_ = conn.Close()
-			return nil
-		}
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-time.After(300 * time.Millisecond):
-		}
-	}
-	return fmt.Errorf("port %d not ready", port)
-}
-
 func extractPort(url string) int {
 	parts := strings.Split(url, ":")
 	if len(parts) == 0 {
@@ -1,7 +1,22 @@
 package proxy
 
+import "fmt"
+
 // Endpoint is the resulting proxy URL for Playwright to consume.
 type Endpoint struct {
 	Tag string
 	URL string
 }
+
+// OutboundStats 记录最近一次加载订阅时各阶段的节点数量，便于区分“订阅没有节点”和“节点全被过滤”。
+type OutboundStats struct {
+	Fetched           int  `json:"fetched"`           // 订阅返回的 outbounds 总数
+	FilteredByType    int  `json:"filteredByType"`    // 因类型（selector/urltest/direct 等）被过滤
+	ExcludedByKeyword int  `json:"excludedByKeyword"` // 命中黑名单关键词被排除
+	Usable            int  `json:"usable"`            // 最终可用节点数
+	FromCache         bool `json:"fromCache,omitempty"`
+}
+
+func (s OutboundStats) String() string {
+	return fmt.Sprintf("共 %d 个，类型过滤 %d 个，关键词排除 %d 个，可用 %d 个", s.Fetched, s.FilteredByType, s.ExcludedByKeyword, s.Usable)
+}
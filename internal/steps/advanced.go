@@ -0,0 +1,96 @@
+package steps
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	playwright "github.com/playwright-community/playwright-go"
+)
+
+// ApplyAdvancedSettings best-effort sets model settings controls by their
+// accessible name (e.g. "Top-P" -> "0.9"). Comboboxes pick the matching option,
+// checkboxes/switches accept true/false, sliders and text/number inputs are filled.
+// Unknown or invisible controls are skipped with a warning. Returns the names
+// that were applied, in sorted order.
+func ApplyAdvancedSettings(page playwright.Page, settings map[string]string) []string {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var applied []string
+	for _, name := range names {
+		ok, err := applyAdvancedSetting(page, name, settings[name])
+		switch {
+		case err != nil:
+			fmt.Printf("⚠️ Advanced setting %q=%q failed: %v\n", name, settings[name], err)
+		case !ok:
+			fmt.Printf("⚠️ Advanced setting %q not found on page, skipped\n", name)
+		default:
+			fmt.Printf("✅ Advanced setting %q=%q\n", name, settings[name])
+			applied = append(applied, name)
+		}
+	}
+	return applied
+}
+
+func applyAdvancedSetting(page playwright.Page, name, value string) (bool, error) {
+	if strings.TrimSpace(name) == "" {
+		return false, nil
+	}
+	label := regexp.MustCompile("(?i)" + regexp.QuoteMeta(strings.TrimSpace(name)))
+
+	combo := page.GetByRole("combobox", playwright.PageGetByRoleOptions{Name: label}).First()
+	if vis, _ := combo.IsVisible(); vis {
+		_ = combo.ScrollIntoViewIfNeeded()
+		if err := combo.Click(playwright.LocatorClickOptions{Force: playwright.Bool(true)}); err != nil {
+			return false, err
+		}
+		time.Sleep(300 * time.Millisecond)
+		option := page.GetByRole("option", playwright.PageGetByRoleOptions{
+			Name: regexp.MustCompile(fmt.Sprintf("(?i)^\\s*%s\\s*$", regexp.QuoteMeta(value))),
+		}).First()
+		if vis, _ := option.IsVisible(); !vis {
+			_ = page.Keyboard().Press("Escape")
+			return false, fmt.Errorf("option %q not found", value)
+		}
+		if err := option.Click(playwright.LocatorClickOptions{Force: playwright.Bool(true)}); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	for _, role := range []string{"checkbox", "switch"} {
+		toggle := page.GetByRole(playwright.AriaRole(role), playwright.PageGetByRoleOptions{Name: label}).First()
+		if vis, _ := toggle.IsVisible(); !vis {
+			continue
+		}
+		on, err := strconv.ParseBool(value)
+		if err != nil {
+			return false, fmt.Errorf("%s expects true/false: %q", role, value)
+		}
+		if err := toggle.SetChecked(on, playwright.LocatorSetCheckedOptions{Force: playwright.Bool(true)}); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	for _, role := range []string{"spinbutton", "textbox", "slider"} {
+		input := page.GetByRole(playwright.AriaRole(role), playwright.PageGetByRoleOptions{Name: label}).First()
+		if vis, _ := input.IsVisible(); !vis {
+			continue
+		}
+		_ = input.ScrollIntoViewIfNeeded()
+		if err := input.Fill(value, playwright.LocatorFillOptions{Force: playwright.Bool(true)}); err != nil {
+			return false, err
+		}
+		_ = input.Press("Tab")
+		return true, nil
+	}
+	return false, nil
+}
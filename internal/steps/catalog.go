@@ -0,0 +1,165 @@
+package steps
+
+// StepInfo describes one automation step: the function that performs it and
+// the locators it tries, in the order they are tried. Selectors use Playwright
+// selector notation; role selectors list the accessible-name pattern.
+type StepInfo struct {
+	Key       string   `json:"key"`
+	Name      string   `json:"name"`
+	Func      string   `json:"func"`
+	Selectors []string `json:"selectors"`
+}
+
+// Step keys used by Catalog, in the order a scenario runs them.
+const (
+	StepKeyRegion           = "region"
+	StepKeyTerms            = "terms"
+	StepKeyCookies          = "cookies"
+	StepKeyModelSettings    = "modelSettings"
+	StepKeyResolution       = "resolution"
+	StepKeyAspectRatio      = "aspectRatio"
+	StepKeyTemperature      = "temperature"
+	StepKeyAdvancedSettings = "advancedSettings"
+	StepKeyPrompt           = "prompt"
+	StepKeyUpload           = "upload"
+	StepKeySubmit           = "submit"
+	StepKeyDownload         = "download"
+)
+
+// catalog mirrors the locators in this package. Keep it in sync when a
+// selector changes so /run?explain=1 stays an accurate reference.
+var catalog = []StepInfo{
+	{
+		Key:  StepKeyRegion,
+		Name: "Detect region block",
+		Func: "DetectRegionBlock",
+		Selectors: []string{
+			regionNoticeSelector,
+		},
+	},
+	{
+		Key:  StepKeyTerms,
+		Name: "Accept terms dialog",
+		Func: "AcceptTermsWithOptions",
+		Selectors: []string{
+			".mat-mdc-dialog-container",
+			".mat-mdc-dialog-container >> role=checkbox[name=/accept terms|accept|agree|接受|同意|使用条款/i]",
+			".mat-mdc-dialog-container >> role=button[name=/submit|accept|agree|continue|同意|提交/i]",
+		},
+	},
+	{
+		Key:  StepKeyCookies,
+		Name: "Accept cookies bar",
+		Func: "AcceptCookieBar",
+		Selectors: []string{
+			"#glue-cookie-notification-bar-1, .glue-cookie-notification-bar",
+			"button.glue-cookie-notification-bar__accept",
+			"role=button[name=/ok,?\\s*got it/i]",
+		},
+	},
+	{
+		Key:  StepKeyModelSettings,
+		Name: "Open model settings",
+		Func: "OpenModelSettings",
+		Selectors: []string{
+			`ai-llm-collapsible-panel[heading*="模型设置"], ai-llm-collapsible-panel[heading*="Model settings"] >> .collapsible-panel__toggle-button`,
+			"role=combobox[name=/output resolution|输出分辨率/i]",
+		},
+	},
+	{
+		Key:  StepKeyResolution,
+		Name: "Set output resolution",
+		Func: "SetOutputResolution",
+		Selectors: []string{
+			"role=combobox[name=/output resolution|输出分辨率/i]",
+			"role=option[name=/^\\s*<value>\\s*$/i]",
+			"mat-option:has-text(<value>)",
+			"text=<value>",
+		},
+	},
+	{
+		Key:  StepKeyAspectRatio,
+		Name: "Set aspect ratio",
+		Func: "SetAspectRatio",
+		Selectors: []string{
+			"role=combobox[name=/aspect ratio|宽高比/i]",
+			"role=option[name=/^\\s*<value>\\s*$/i]",
+			"mat-option:has-text(<value>)",
+			"text=<value>",
+		},
+	},
+	{
+		Key:  StepKeyTemperature,
+		Name: "Set temperature",
+		Func: "SetTemperature",
+		Selectors: []string{
+			"div:has-text(/温度|temperature/i)",
+			`input[type="range"][min="0"][max="2"]`,
+			"mat-slider",
+			"role=slider",
+		},
+	},
+	{
+		Key:  StepKeyAdvancedSettings,
+		Name: "Apply advanced settings",
+		Func: "ApplyAdvancedSettings",
+		Selectors: []string{
+			"role=combobox[name=/<setting>/i] >> role=option[name=/^\\s*<value>\\s*$/i]",
+			"role=checkbox[name=/<setting>/i]",
+			"role=switch[name=/<setting>/i]",
+			"role=spinbutton[name=/<setting>/i]",
+			"role=textbox[name=/<setting>/i]",
+			"role=slider[name=/<setting>/i]",
+		},
+	},
+	{
+		Key:  StepKeyPrompt,
+		Name: "Enter prompt text",
+		Func: "EnterPrompt",
+		Selectors: []string{
+			`ai-llm-prompt-input-box textarea, ai-llm-prompt-input-box [role="textbox"], ai-llm-prompt-input-box [contenteditable="true"]`,
+		},
+	},
+	{
+		Key:  StepKeyUpload,
+		Name: "Upload local image",
+		Func: "UploadLocalFile",
+		Selectors: []string{
+			"ai-llm-prompt-input-actions-button button",
+			`.cdk-overlay-pane >> a[role="menuitem"]:has-text(/上传|提供本地文件|upload/i)`,
+		},
+	},
+	{
+		Key:  StepKeySubmit,
+		Name: "Submit prompt",
+		Func: "SubmitPrompt",
+		Selectors: []string{
+			`button[instrumentationid="prompt-submit-button"]`,
+			"role=button[name=/submit|send/i]",
+		},
+	},
+	{
+		Key:  StepKeyDownload,
+		Name: "Wait for download",
+		Func: "DownloadImageDetailed",
+		Selectors: []string{
+			`button[cfctooltip="Download image"], button[cfctooltip="下载图片"]`,
+			`button[instrumentationid="prompt-stop-button"]`,
+			"role=button[name=/^(stop|停止)/i]",
+			"ai-llm-prompt-response mat-progress-bar, ai-llm-prompt-response mat-spinner, ai-llm-prompt-response mat-progress-spinner",
+			`a[href*="vertex-ai/generative-ai/docs/error-code-429"]`,
+			"text=/Resource exhausted|check quota|Deadline expired|未能提交提示|The operation was cancelled|Recaptcha token is invalid/i",
+			safetyNoticeSelector,
+		},
+	},
+}
+
+// Catalog returns a copy of all known steps in execution order.
+func Catalog() []StepInfo {
+	out := make([]StepInfo, len(catalog))
+	for i, info := range catalog {
+		info.Selectors = append([]string(nil), info.Selectors...)
+		out[i] = info
+	}
+	return out
+}
@@ -5,10 +5,13 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
 	playwright "github.com/playwright-community/playwright-go"
+
+	"vertex-nano-banana-unlimited/internal/fsperm"
 )
 
 type DownloadOutcome string
@@ -17,71 +20,199 @@ const (
 	DownloadOutcomeDownloaded DownloadOutcome = "downloaded"
 	DownloadOutcomeExhausted  DownloadOutcome = "exhausted"
 	DownloadOutcomeNone       DownloadOutcome = "none"
+	DownloadOutcomeBlocked    DownloadOutcome = "blocked" // 提示词或结果被安全过滤拦截
 )
 
+func downloadButtons(page playwright.Page) playwright.Locator {
+	return page.Locator("button[cfctooltip=\"Download image\"]").Or(
+		page.Locator("button[cfctooltip=\"下载图片\"]"),
+	)
+}
+
+// generatingIndicator matches the UI shown while a response is being generated:
+// the stop button that replaces submit, or a progress bar/spinner in the response area.
+func generatingIndicator(page playwright.Page) playwright.Locator {
+	return page.Locator("button[instrumentationid=\"prompt-stop-button\"]").Or(
+		page.GetByRole("button", playwright.PageGetByRoleOptions{
+			Name: regexp.MustCompile("(?i)^(stop|停止)"),
+		}),
+	).Or(
+		page.Locator("ai-llm-prompt-response mat-progress-bar, ai-llm-prompt-response mat-spinner, ai-llm-prompt-response mat-progress-spinner"),
+	)
+}
+
+// CountDownloadButtons returns how many download buttons are already on the page.
+func CountDownloadButtons(page playwright.Page) int {
+	n, err := downloadButtons(page).Count()
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// Download wait states reported through DownloadWaitOptions.OnProgress.
+const (
+	DownloadStateGenerating = "generating" // 已提交，等待结果出现
+	DownloadStateDone       = "done"       // 下载按钮已出现
+	DownloadStateExhausted  = "exhausted"  // 出现 429/配额提示
+	DownloadStateBlocked    = "blocked"    // 出现安全拦截提示
+)
+
+// DownloadTimeout tells why a wait ended with DownloadOutcomeNone at MaxWait.
+type DownloadTimeout string
+
+const (
+	// DownloadTimeoutGenerating means generation UI was seen: the backend is slow, waiting longer may help.
+	DownloadTimeoutGenerating DownloadTimeout = "still_generating"
+	// DownloadTimeoutNotStarted means generation UI never appeared: the submit most likely did not go through.
+	DownloadTimeoutNotStarted DownloadTimeout = "never_started"
+)
+
+// DownloadResult is the detailed result of DownloadImageDetailed.
+type DownloadResult struct {
+	Outcome DownloadOutcome
+	Path    string          // saved path, empty if not downloaded
+	Timeout DownloadTimeout // set only when the wait timed out
+	// BlockReason is the safety notice text, set only for DownloadOutcomeBlocked.
+	BlockReason string
+}
+
+// DownloadProgress is reported on every poll while waiting for the result.
+type DownloadProgress struct {
+	Elapsed time.Duration
+	State   string
+}
+
+// DownloadWaitOptions controls how DownloadImageWithOptions waits for the result.
+type DownloadWaitOptions struct {
+	MaxWait      time.Duration
+	PollInterval time.Duration          // 默认 1s
+	Seen         int                    // 页面上已有的下载按钮数量，只等待之后出现的按钮
+	OnProgress   func(DownloadProgress) // 可选，每次轮询回调
+	NameSuffix   string                 // 可选，追加在文件名扩展名之前（如 "_node-1"）
+}
+
 // DownloadImage waits for the download button or a 429 notice, then saves with a timestamped name.
 // Returns outcome and saved path (empty if not downloaded).
 func DownloadImage(ctx context.Context, page playwright.Page, dir string, maxWait time.Duration) (DownloadOutcome, string, error) {
-	button := page.Locator("button[cfctooltip=\"Download image\"]").Or(
-		page.Locator("button[cfctooltip=\"下载图片\"]"),
-	).First()
-	exhaust := page.Locator("a[href*=\"vertex-ai/generative-ai/docs/error-code-429\"]").
-		Or(page.GetByText("Resource exhausted", playwright.PageGetByTextOptions{Exact: playwright.Bool(false)})).
-		Or(page.GetByText("resource exhausted", playwright.PageGetByTextOptions{Exact: playwright.Bool(false)})).
-		Or(page.GetByText("check quota", playwright.PageGetByTextOptions{Exact: playwright.Bool(false)})).
-		Or(page.GetByText("Deadline expired before operation could complete.", playwright.PageGetByTextOptions{Exact: playwright.Bool(false)})).
-		Or(page.GetByText("未能提交提示", playwright.PageGetByTextOptions{Exact: playwright.Bool(false)})).
-		Or(page.GetByText("The operation was cancelled", playwright.PageGetByTextOptions{Exact: playwright.Bool(false)})).
-		Or(page.GetByText("Recaptcha token is invalid, please refresh the page or log in, and try again.", playwright.PageGetByTextOptions{Exact: playwright.Bool(false)}))
-
-	deadline := time.Now().Add(maxWait)
+	return DownloadImageWithOptions(ctx, page, dir, DownloadWaitOptions{MaxWait: maxWait})
+}
+
+// DownloadImageWithOptions is DownloadImage with a configurable poll interval and progress callback.
+func DownloadImageWithOptions(ctx context.Context, page playwright.Page, dir string, opts DownloadWaitOptions) (DownloadOutcome, string, error) {
+	res, err := DownloadImageDetailed(ctx, page, dir, opts)
+	return res.Outcome, res.Path, err
+}
+
+// DownloadImageDetailed is DownloadImageWithOptions that also reports, on timeout,
+// whether the studio was still generating or never started.
+// A safety block notice that appears after the wait starts ends it with DownloadOutcomeBlocked.
+func DownloadImageDetailed(ctx context.Context, page playwright.Page, dir string, opts DownloadWaitOptions) (DownloadResult, error) {
+	interval := opts.PollInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	started := time.Now()
+	progress := func(state string) {
+		if opts.OnProgress != nil {
+			opts.OnProgress(DownloadProgress{Elapsed: time.Since(started), State: state})
+		}
+	}
+	button := downloadButtons(page).Nth(opts.Seen)
+	exhaust := quotaNotice(page)
+
+	generating := generatingIndicator(page).First()
+	sawGenerating := false
+	// 页面上已有的安全提示（如持久页面中之前的场景）不算本次拦截
+	seenNotices := len(pageSafetyNotices(page))
+
+	deadline := started.Add(opts.MaxWait)
 	for time.Now().Before(deadline) {
 		select {
 		case <-ctx.Done():
-			return DownloadOutcomeNone, "", ctx.Err()
+			return DownloadResult{Outcome: DownloadOutcomeNone}, ctx.Err()
 		default:
 		}
 		if vis, _ := exhaust.First().IsVisible(); vis {
 			fmt.Println("⚠️ 429/quota notice detected")
-			return DownloadOutcomeExhausted, "", nil
+			progress(DownloadStateExhausted)
+			return DownloadResult{Outcome: DownloadOutcomeExhausted}, nil
 		}
 		if vis, _ := button.IsVisible(); vis {
 			fmt.Println("🟦 Download button visible")
+			progress(DownloadStateDone)
 			goto click
 		}
-		time.Sleep(1 * time.Second)
+		if notices := pageSafetyNotices(page); len(notices) > seenNotices {
+			reason := notices[len(notices)-1]
+			fmt.Printf("⛔ Safety block detected: %s\n", reason)
+			progress(DownloadStateBlocked)
+			return DownloadResult{Outcome: DownloadOutcomeBlocked, BlockReason: reason}, nil
+		}
+		if !sawGenerating {
+			sawGenerating, _ = generating.IsVisible()
+		}
+		progress(DownloadStateGenerating)
+		time.Sleep(interval)
+	}
+	if sawGenerating {
+		fmt.Printf("⏱️ Timed out after %s while still generating\n", opts.MaxWait)
+		return DownloadResult{Outcome: DownloadOutcomeNone, Timeout: DownloadTimeoutGenerating}, nil
 	}
-	return DownloadOutcomeNone, "", nil
+	fmt.Printf("⏱️ Timed out after %s, generation never started\n", opts.MaxWait)
+	return DownloadResult{Outcome: DownloadOutcomeNone, Timeout: DownloadTimeoutNotStarted}, nil
 
 click:
 	select {
 	case <-ctx.Done():
-		return DownloadOutcomeNone, "", ctx.Err()
+		return DownloadResult{Outcome: DownloadOutcomeNone}, ctx.Err()
 	default:
 	}
-	if err := os.MkdirAll(dir, 0o755); err != nil {
-		return DownloadOutcomeNone, "", err
+	if err := os.MkdirAll(dir, fsperm.Dir()); err != nil {
+		return DownloadResult{Outcome: DownloadOutcomeNone}, err
 	}
 	download, err := page.ExpectDownload(func() error {
 		return button.Click(playwright.LocatorClickOptions{Force: playwright.Bool(true)})
 	})
 	if err != nil {
-		return DownloadOutcomeNone, "", err
+		return DownloadResult{Outcome: DownloadOutcomeNone}, err
 	}
 	select {
 	case <-ctx.Done():
-		return DownloadOutcomeNone, "", ctx.Err()
+		_ = download.Cancel()
+		return DownloadResult{Outcome: DownloadOutcomeNone}, ctx.Err()
 	default:
 	}
 	suggested := download.SuggestedFilename()
 	ext := filepath.Ext(suggested)
 	base := strings.TrimSuffix(suggested, ext)
 	now := time.Now()
-	filename := fmt.Sprintf("%s_%s_%s%s", base, now.Format("20060102"), now.Format("150405.000"), ext)
+	filename := fmt.Sprintf("%s_%s_%s%s%s", base, now.Format("20060102"), now.Format("150405.000"), opts.NameSuffix, ext)
 	target := filepath.Join(dir, filename)
-	if err := download.SaveAs(target); err != nil {
-		return DownloadOutcomeNone, "", err
+	if err := saveDownload(ctx, target, download.SaveAs); err != nil {
+		return DownloadResult{Outcome: DownloadOutcomeNone}, err
 	}
 	fmt.Printf("🟦 Image downloaded to: %s\n", target)
-	return DownloadOutcomeDownloaded, target, nil
+	return DownloadResult{Outcome: DownloadOutcomeDownloaded, Path: target}, nil
+}
+
+// saveDownload saves through save into a ".part" file next to target and renames
+// it into place only if ctx is still live, so a cancelled or failed download
+// never leaves a partial file behind.
+func saveDownload(ctx context.Context, target string, save func(path string) error) error {
+	partial := target + ".part"
+	if err := save(partial); err != nil {
+		_ = os.Remove(partial)
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		_ = os.Remove(partial)
+		return err
+	}
+	_ = os.Chmod(partial, fsperm.File())
+	if err := os.Rename(partial, target); err != nil {
+		_ = os.Remove(partial)
+		return err
+	}
+	return nil
 }
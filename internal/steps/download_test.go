@@ -0,0 +1,71 @@
+package steps
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveDownloadCancelledLeavesNoPartialFile(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "image.png")
+	ctx, cancel := context.WithCancel(context.Background())
+	// The run is cancelled while the browser is still writing the file.
+	err := saveDownload(ctx, target, func(path string) error {
+		if err := os.WriteFile(path, []byte("half an ima"), 0o600); err != nil {
+			return err
+		}
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("saveDownload() error = %v, want context.Canceled", err)
+	}
+	assertNoFiles(t, dir)
+}
+
+func TestSaveDownloadFailedWriteLeavesNoPartialFile(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "image.png")
+	errSave := errors.New("download interrupted")
+	err := saveDownload(context.Background(), target, func(path string) error {
+		if err := os.WriteFile(path, []byte("half"), 0o600); err != nil {
+			return err
+		}
+		return errSave
+	})
+	if !errors.Is(err, errSave) {
+		t.Fatalf("saveDownload() error = %v, want %v", err, errSave)
+	}
+	assertNoFiles(t, dir)
+}
+
+func TestSaveDownloadRenamesIntoPlace(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "image.png")
+	err := saveDownload(context.Background(), target, func(path string) error {
+		return os.WriteFile(path, []byte("png"), 0o600)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(target); err != nil || string(data) != "png" {
+		t.Fatalf("target = %q, %v; want %q", data, err, "png")
+	}
+	if _, err := os.Stat(target + ".part"); !os.IsNotExist(err) {
+		t.Fatalf(".part file still present: %v", err)
+	}
+}
+
+func assertNoFiles(t *testing.T, dir string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("unexpected file left behind: %s", e.Name())
+	}
+}
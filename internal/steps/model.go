@@ -9,14 +9,21 @@ import (
 	playwright "github.com/playwright-community/playwright-go"
 )
 
-// OpenModelSettings opens the model settings panel by clicking the header.
-func OpenModelSettings(page playwright.Page) (bool, error) {
-	// 最终方案：结合正确的定位器和最简单的“发射后不管”策略。
+// openSettingsAttempts 是点击“模型设置”切换按钮的最大次数
+const openSettingsAttempts = 3
 
+// OpenModelSettings opens the model settings panel by clicking the header,
+// retrying until the panel content (the output resolution combobox) is visible.
+func OpenModelSettings(page playwright.Page) (bool, error) {
 	// 1. 正确的定位器：在“模型设置”面板中找到切换按钮。
 	panel := page.Locator(`ai-llm-collapsible-panel[heading*="模型设置"], ai-llm-collapsible-panel[heading*="Model settings"]`)
 	toggleButton := panel.Locator(".collapsible-panel__toggle-button")
 
+	// 面板已展开时不再点击，否则会把它折叠回去。
+	if modelSettingsExpanded(page) {
+		return true, nil
+	}
+
 	// 2. 检查按钮是否可见。
 	vis, err := toggleButton.IsVisible()
 	if err != nil {
@@ -26,8 +33,29 @@ func OpenModelSettings(page playwright.Page) (bool, error) {
 		return false, nil // Button not visible.
 	}
 
-	// 3. 直接点击，然后立即返回，不进行任何状态验证。
-	return true, toggleButton.Click(playwright.LocatorClickOptions{Force: playwright.Bool(true)})
+	// 3. 点击后确认面板内容可见，未展开则重试。
+	for attempt := 1; attempt <= openSettingsAttempts; attempt++ {
+		if err := toggleButton.Click(playwright.LocatorClickOptions{Force: playwright.Bool(true)}); err != nil {
+			return false, err
+		}
+		for i := 0; i < 4; i++ {
+			time.Sleep(250 * time.Millisecond)
+			if modelSettingsExpanded(page) {
+				return true, nil
+			}
+		}
+		fmt.Printf("⚠️ 模型设置面板未展开，重试点击 (%d/%d)\n", attempt, openSettingsAttempts)
+	}
+	return false, fmt.Errorf("model settings panel did not expand after %d clicks", openSettingsAttempts)
+}
+
+// modelSettingsExpanded 通过输出分辨率下拉框是否可见判断面板是否已展开。
+func modelSettingsExpanded(page playwright.Page) bool {
+	combo := page.GetByRole("combobox", playwright.PageGetByRoleOptions{
+		Name: regexp.MustCompile("(?i)output resolution|输出分辨率"),
+	})
+	vis, _ := combo.First().IsVisible()
+	return vis
 }
 
 // SetOutputResolution chooses a resolution option in the combobox.
@@ -124,8 +152,7 @@ func SetTemperature(page playwright.Page, temperature float64) (bool, error) {
 	}
 
 	// Calculate the percentage position for the slider
-	// Temperature range: 0.0 - 2.0
-	percentage := (temperature / 2.0) * 100
+	percentage := (temperature / MaxTemperature) * 100
 	if percentage > 100 {
 		percentage = 100
 	}
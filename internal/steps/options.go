@@ -0,0 +1,97 @@
+package steps
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Option values offered by the studio's model settings panel. These lists are
+// the single source of truth for request validation and the /options endpoint.
+
+// Resolutions lists the selectable output resolutions.
+var Resolutions = []string{"1K", "2K", "4K"}
+
+// commonAspectRatios are offered at every resolution.
+var commonAspectRatios = []string{"1:1", "3:2", "2:3", "3:4", "4:3", "4:5", "5:4", "9:16", "16:9"}
+
+// ResolutionAspectRatios lists the aspect ratios selectable at each resolution (4K has no 21:9).
+var ResolutionAspectRatios = map[string][]string{
+	"1K": append(append([]string{}, commonAspectRatios...), "21:9"),
+	"2K": append(append([]string{}, commonAspectRatios...), "21:9"),
+	"4K": commonAspectRatios,
+}
+
+// Temperature slider range; 0 means "leave the page default".
+const (
+	MinTemperature = 0.0
+	MaxTemperature = 2.0
+)
+
+// TemperaturePresets maps named presets to slider values.
+var TemperaturePresets = map[string]float64{
+	"precise":  0.4,
+	"balanced": 1.0,
+	"creative": 1.6,
+}
+
+// ResolveTemperature accepts a number ("1.2") or a preset name ("creative") and
+// returns the slider value plus the preset name when one was used. Range checks
+// are left to the caller.
+func ResolveTemperature(raw string) (float64, string, error) {
+	s := strings.ToLower(strings.TrimSpace(raw))
+	if v, ok := TemperaturePresets[s]; ok {
+		return v, s, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("temperature 无效: %s（可用数字或预设 precise、balanced、creative）", raw)
+	}
+	return v, "", nil
+}
+
+// aspectRatioAliases maps named shapes to canonical ratios.
+var aspectRatioAliases = map[string]string{
+	"square":     "1:1",
+	"landscape":  "16:9",
+	"widescreen": "16:9",
+	"portrait":   "9:16",
+	"vertical":   "9:16",
+	"ultrawide":  "21:9",
+}
+
+// NormalizeAspectRatio maps common spellings ("1x1", "1 : 1", "16/9", "1920x1080",
+// "square") to the canonical "N:M" form the settings panel uses. It returns an
+// error when the value is not one of the selectable ratios at any resolution.
+func NormalizeAspectRatio(raw string) (string, error) {
+	s := strings.ToLower(strings.TrimSpace(raw))
+	if alias, ok := aspectRatioAliases[s]; ok {
+		return alias, nil
+	}
+	s = strings.NewReplacer(" ", "", "x", ":", "×", ":", "/", ":", "*", ":").Replace(s)
+	w, h, ok := strings.Cut(s, ":")
+	wn, werr := strconv.Atoi(w)
+	hn, herr := strconv.Atoi(h)
+	if !ok || werr != nil || herr != nil || wn <= 0 || hn <= 0 {
+		return "", fmt.Errorf("无法识别的宽高比 %q，应为 N:M 形式（如 16:9）", raw)
+	}
+	// Try the ratio as written first: 21:9 is canonical even though it reduces to 7:3.
+	g := gcd(wn, hn)
+	for _, canonical := range []string{fmt.Sprintf("%d:%d", wn, hn), fmt.Sprintf("%d:%d", wn/g, hn/g)} {
+		for _, ratios := range ResolutionAspectRatios {
+			for _, r := range ratios {
+				if r == canonical {
+					return canonical, nil
+				}
+			}
+		}
+	}
+	return "", fmt.Errorf("不支持的宽高比 %q（可选 %s）", raw, strings.Join(ResolutionAspectRatios["1K"], ", "))
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
@@ -0,0 +1,63 @@
+package steps
+
+import (
+	"regexp"
+
+	playwright "github.com/playwright-community/playwright-go"
+)
+
+// QuotaKind classifies a quota notice shown after submitting.
+type QuotaKind string
+
+const (
+	QuotaSoft    QuotaKind = "soft"    // per-minute rate limit, usually clears within a minute or two
+	QuotaHard    QuotaKind = "hard"    // daily quota or account-level block lasting hours
+	QuotaUnknown QuotaKind = "unknown" // generic "resource exhausted" or other failure text
+)
+
+var (
+	hardQuotaPattern = regexp.MustCompile(`(?i)per day|daily (limit|quota)|quota .*exceeded for .*day|billing|account (has been )?(suspended|disabled|blocked)|每日|每天|当日|账号.*(封禁|停用)`)
+	softQuotaPattern = regexp.MustCompile(`(?i)per minute|rate limit|too many requests|try again (in|later)|每分钟|请求过于频繁|稍后重试`)
+)
+
+// ClassifyQuotaText maps the text of a quota notice to a QuotaKind.
+func ClassifyQuotaText(text string) QuotaKind {
+	switch {
+	case hardQuotaPattern.MatchString(text):
+		return QuotaHard
+	case softQuotaPattern.MatchString(text):
+		return QuotaSoft
+	default:
+		return QuotaUnknown
+	}
+}
+
+// quotaNotice matches the studio's 429, quota and failed-submit notices.
+func quotaNotice(page playwright.Page) playwright.Locator {
+	return page.Locator("a[href*=\"vertex-ai/generative-ai/docs/error-code-429\"]").
+		Or(page.GetByText("Resource exhausted", playwright.PageGetByTextOptions{Exact: playwright.Bool(false)})).
+		Or(page.GetByText("resource exhausted", playwright.PageGetByTextOptions{Exact: playwright.Bool(false)})).
+		Or(page.GetByText("check quota", playwright.PageGetByTextOptions{Exact: playwright.Bool(false)})).
+		Or(page.GetByText("Deadline expired before operation could complete.", playwright.PageGetByTextOptions{Exact: playwright.Bool(false)})).
+		Or(page.GetByText("未能提交提示", playwright.PageGetByTextOptions{Exact: playwright.Bool(false)})).
+		Or(page.GetByText("The operation was cancelled", playwright.PageGetByTextOptions{Exact: playwright.Bool(false)})).
+		Or(page.GetByText("Recaptcha token is invalid, please refresh the page or log in, and try again.", playwright.PageGetByTextOptions{Exact: playwright.Bool(false)}))
+}
+
+// DetectQuotaKind reads the quota notice after DownloadOutcomeExhausted and
+// classifies it. Only the notice and its immediate container are read, so
+// unrelated page text (help panels, earlier responses) cannot change the kind.
+// It returns QuotaUnknown when the notice cannot be read.
+func DetectQuotaKind(page playwright.Page) QuotaKind {
+	notice := quotaNotice(page).First()
+	opts := playwright.LocatorInnerTextOptions{Timeout: playwright.Float(3000)}
+	// The 429 link is usually a bare "learn more" anchor; its parent holds the message.
+	text, err := notice.Locator("xpath=..").InnerText(opts)
+	if err != nil {
+		text, err = notice.InnerText(opts)
+	}
+	if err != nil {
+		return QuotaUnknown
+	}
+	return ClassifyQuotaText(text)
+}
@@ -0,0 +1,31 @@
+package steps
+
+import (
+	"regexp"
+	"strings"
+
+	playwright "github.com/playwright-community/playwright-go"
+)
+
+// regionBlockPattern matches the studio's "not available in your country/region" notices.
+var regionBlockPattern = regexp.MustCompile(`(?i)(not|isn't|is not) (yet )?available in your (country|region|location)|unsupported (country|region)|在您所在的(国家|地区|国家/地区)(不可用|无法使用)|所在(国家|地区)不受支持`)
+
+// regionNoticeSelector matches the elements a region restriction notice can appear
+// in: alerts, dialogs, snack bars and form errors. The response area, help panels
+// and the prompt box are not read, so text that merely mentions availability does
+// not freeze a healthy node.
+const regionNoticeSelector = `[role="alert"], [role="alertdialog"], [role="dialog"], mat-snack-bar-container, .mat-mdc-snack-bar-container, mat-error`
+
+// DetectRegionBlock reports whether the page shows a region restriction notice,
+// returning the matched text when it does. It returns false when no notice
+// element is present.
+func DetectRegionBlock(page playwright.Page) (bool, string) {
+	texts, err := page.Locator(regionNoticeSelector).AllInnerTexts()
+	if err != nil || len(texts) == 0 {
+		return false, ""
+	}
+	if m := regionBlockPattern.FindString(strings.Join(texts, "\n")); m != "" {
+		return true, m
+	}
+	return false, ""
+}
@@ -0,0 +1,46 @@
+package steps
+
+import (
+	"regexp"
+	"strings"
+
+	playwright "github.com/playwright-community/playwright-go"
+)
+
+// safetyBlockPattern matches the studio's notices when a prompt or its response is
+// blocked by safety filters. It deliberately avoids the bare word "safety", which
+// also labels the "Safety settings" panel.
+var safetyBlockPattern = regexp.MustCompile(`(?i)(prompt|response|content|image|output)s? (was |were |has been |have been )?blocked|blocked (due to|because of|for) (safety|policy|responsible ai)|(may )?violate[sd]? (our|the|google's) [a-z ]*polic(y|ies)|safety (filter|reason|polic)[a-z]*|prohibited content|(因|由于)安全(原因|策略|政策)|(提示|回复|内容|图片)(已)?被(屏蔽|拦截|阻止)|违反.{0,12}(政策|准则)`)
+
+// maxSafetyReasonLen caps the notice text returned as the block reason.
+const maxSafetyReasonLen = 300
+
+// safetyNotices returns the lines of text that look like safety block notices.
+func safetyNotices(text string) []string {
+	var out []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || !safetyBlockPattern.MatchString(line) {
+			continue
+		}
+		if r := []rune(line); len(r) > maxSafetyReasonLen {
+			line = string(r[:maxSafetyReasonLen]) + "…"
+		}
+		out = append(out, line)
+	}
+	return out
+}
+
+// safetyNoticeSelector matches the elements a block notice can appear in: the
+// response area and error alerts/snack bars. The prompt box and settings panels
+// are not read, so a prompt that merely mentions a policy is not a block.
+const safetyNoticeSelector = `ai-llm-prompt-response, [role="alert"], mat-snack-bar-container, .mat-mdc-snack-bar-container`
+
+// pageSafetyNotices reads the response and error elements and returns their safety block notices.
+func pageSafetyNotices(page playwright.Page) []string {
+	texts, err := page.Locator(safetyNoticeSelector).AllInnerTexts()
+	if err != nil {
+		return nil
+	}
+	return safetyNotices(strings.Join(texts, "\n"))
+}
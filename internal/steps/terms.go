@@ -2,6 +2,7 @@ package steps
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"regexp"
 	"time"
@@ -36,26 +37,84 @@ func StartTermsAutoAccept(page playwright.Page) func() {
 	return func() { cancel() }
 }
 
+// ErrTermsDialogMissing is returned when a required terms dialog never showed up.
+var ErrTermsDialogMissing = errors.New("terms dialog never appeared")
+
+// TermsOutcome describes how the terms step finished.
+type TermsOutcome string
+
+const (
+	TermsAccepted TermsOutcome = "accepted" // dialog appeared and was accepted (or dismissed)
+	TermsAbsent   TermsOutcome = "absent"   // dialog never appeared; account likely accepted already
+)
+
+// TermsOptions controls AcceptTermsWithOptions.
+type TermsOptions struct {
+	Timeout    time.Duration // overall budget for accepting the dialog
+	AppearWait time.Duration // how long to wait for the dialog to show up when Optional
+	Optional   bool          // a dialog that never appears counts as success instead of failure
+}
+
 // AcceptTermsBlocking waits until the terms dialog is accepted or absent.
-// Returns true when accepted or not present; errors on timeout or click failure.
-func AcceptTermsBlocking(page playwright.Page, timeout time.Duration) (bool, error) {
-	deadline := time.Now().Add(timeout)
-	for time.Now().Before(deadline) {
+// Returns true when accepted or not present; errors on timeout, click failure or ctx cancellation.
+func AcceptTermsBlocking(ctx context.Context, page playwright.Page, timeout time.Duration) (bool, error) {
+	_, err := AcceptTermsWithOptions(ctx, page, TermsOptions{Timeout: timeout, Optional: true})
+	return err == nil, err
+}
+
+// AcceptTermsWithOptions accepts the terms dialog, distinguishing a dialog that
+// appeared but could not be accepted (always an error) from one that never
+// appeared (TermsAbsent when Optional, ErrTermsDialogMissing otherwise).
+// It stops polling as soon as ctx is cancelled.
+func AcceptTermsWithOptions(ctx context.Context, page playwright.Page, opts TermsOptions) (TermsOutcome, error) {
+	start := time.Now()
+	deadline := start.Add(opts.Timeout)
+	appearWait := opts.AppearWait
+	if !opts.Optional {
+		appearWait = opts.Timeout
+	}
+	seen := false
+	for {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
 		ok, err := acceptTerms(page)
 		if err != nil {
-			return false, err
+			return "", fmt.Errorf("terms dialog appeared but could not be accepted: %w", err)
 		}
 		if ok {
-			return true, nil
+			return TermsAccepted, nil
 		}
 
 		dialog := page.Locator(".mat-mdc-dialog-container").First()
-		if vis, _ := dialog.IsVisible(); !vis {
-			return true, nil // dialog not present; treat as already accepted
+		vis, _ := dialog.IsVisible()
+		switch {
+		case vis:
+			seen = true
+		case seen:
+			return TermsAccepted, nil // dialog went away on its own
+		case time.Since(start) >= appearWait:
+			if opts.Optional {
+				return TermsAbsent, nil
+			}
+			return "", ErrTermsDialogMissing
 		}
-		time.Sleep(1500 * time.Millisecond)
+		if !time.Now().Before(deadline) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(1500 * time.Millisecond):
+		}
+	}
+	if seen {
+		return "", fmt.Errorf("terms dialog appeared but was not accepted within %s", opts.Timeout)
+	}
+	if opts.Optional {
+		return TermsAbsent, nil
 	}
-	return false, fmt.Errorf("terms dialog not accepted within %s", timeout)
+	return "", ErrTermsDialogMissing
 }
 
 func acceptTerms(page playwright.Page) (bool, error) {